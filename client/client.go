@@ -0,0 +1,181 @@
+// client.go
+
+// Package client is a minimal client library for the server's
+// newline-delimited JSON protocol: a Client for one connection and a Pool
+// that spreads requests over several.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a message on the wire, in the server's default RFC 3339 time
+// format
+type Message struct {
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+	Time    time.Time              `json:"time"`
+	ID      string                 `json:"id"`
+	Source  string                 `json:"source"`
+
+	// CorrelationID pairs a server-initiated request with the client's reply
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// CloseAfter asks the server to close the connection once it has sent
+	// the response
+	CloseAfter bool `json:"close_after,omitempty"`
+	// IdempotencyKey identifies a request so a resend returns the first
+	// result instead of running it again
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// TraceID correlates a message with its response and the server's log
+	// lines; the server generates one when it is empty
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// Client is a connection to the server for request/response use: Do sends
+// one message and waits for the response with the same ID, skipping
+// anything else, such as broadcasts. A Client runs one request at a time;
+// use a Pool for concurrency.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// Dial connects a Client to addr, giving up after timeout if it is positive
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}, nil
+}
+
+// Do sends msg, giving it a fresh ID if it has none, and returns the
+// response. ctx's deadline bounds the exchange; after an error the Client
+// may be out of step with the server and should be closed.
+func (c *Client) Do(ctx context.Context, msg Message) (Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	deadline, _ := ctx.Deadline() // Zero clears any earlier deadline
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return Message{}, err
+	}
+	if err := c.enc.Encode(msg); err != nil {
+		return Message{}, err
+	}
+	for {
+		var resp Message
+		if err := c.dec.Decode(&resp); err != nil {
+			return Message{}, err
+		}
+		if resp.ID == msg.ID {
+			return resp, nil
+		}
+	}
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// idSeq numbers the IDs newID hands out when random bytes are unavailable
+var idSeq atomic.Uint64
+
+// newID returns a random message ID, or a sequence number if the system's
+// random source fails, as the server numbers its connection IDs
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "req-" + strconv.FormatUint(idSeq.Add(1), 10)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Pool spreads requests round-robin over up to size connections to one
+// server, dialing each on first use and redialing it after a failure, so
+// concurrent callers reuse connections instead of dialing per request. It
+// is safe for concurrent use.
+type Pool struct {
+	addr  string
+	slots []poolSlot
+	next  atomic.Uint64
+	dials atomic.Uint64
+}
+
+type poolSlot struct {
+	mu     sync.Mutex
+	client *Client // Nil until dialed, and after a failure
+}
+
+// poolDialTimeout bounds each connection a Pool dials
+const poolDialTimeout = 5 * time.Second
+
+// NewPool returns a pool of up to size connections to addr; they are
+// dialed lazily
+func NewPool(addr string, size int) *Pool {
+	return &Pool{addr: addr, slots: make([]poolSlot, max(size, 1))}
+}
+
+// Do sends msg on the next connection in turn and returns the response. A
+// request that fails on a connection that was already open is retried once
+// on a fresh connection, since the server may have closed the old one.
+func (p *Pool) Do(ctx context.Context, msg Message) (Message, error) {
+	slot := &p.slots[(p.next.Add(1)-1)%uint64(len(p.slots))]
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		reused := slot.client != nil
+		if !reused {
+			client, err := Dial(p.addr, poolDialTimeout)
+			if err != nil {
+				return Message{}, err
+			}
+			p.dials.Add(1)
+			slot.client = client
+		}
+		resp, err := slot.client.Do(ctx, msg)
+		if err == nil {
+			return resp, nil
+		}
+		slot.client.Close()
+		slot.client = nil
+		if !reused || attempt > 0 || ctx.Err() != nil {
+			return Message{}, err
+		}
+	}
+}
+
+// Dials returns how many connections the pool has dialed, including
+// redials after failures
+func (p *Pool) Dials() uint64 {
+	return p.dials.Load()
+}
+
+// Close closes the pool's open connections; a later Do dials again
+func (p *Pool) Close() error {
+	var errs []error
+	for i := range p.slots {
+		slot := &p.slots[i]
+		slot.mu.Lock()
+		if slot.client != nil {
+			errs = append(errs, slot.client.Close())
+			slot.client = nil
+		}
+		slot.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,191 @@
+// client_test.go
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer answers on a loopback listener with whatever reply returns for
+// each request, tagging every connection with the order it was accepted in
+type stubServer struct {
+	ln    net.Listener
+	reply func(conn int, req Message) (replies []Message, hangUp bool)
+
+	mu     sync.Mutex
+	served []int // Connection of each request, in arrival order
+}
+
+func newStubServer(t *testing.T, reply func(conn int, req Message) ([]Message, bool)) *stubServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{ln: ln, reply: reply}
+	go s.accept()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// echo replies with the request itself
+func echo(conn int, req Message) ([]Message, bool) {
+	return []Message{req}, false
+}
+
+func (s *stubServer) addr() string { return s.ln.Addr().String() }
+
+func (s *stubServer) accept() {
+	for n := 0; ; n++ {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(n, conn)
+	}
+}
+
+func (s *stubServer) serve(n int, conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req Message
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.served = append(s.served, n)
+		s.mu.Unlock()
+		replies, hangUp := s.reply(n, req)
+		for _, r := range replies {
+			if err := enc.Encode(r); err != nil {
+				return
+			}
+		}
+		if hangUp {
+			return
+		}
+	}
+}
+
+func (s *stubServer) servedBy() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.served...)
+}
+
+// testContext bounds a test's exchanges so a broken stub fails rather than
+// hangs
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestDoSkipsResponsesForOtherIDs(t *testing.T) {
+	s := newStubServer(t, func(conn int, req Message) ([]Message, bool) {
+		return []Message{{Type: "tick", ID: "broadcast"}, req}, false
+	})
+	c, err := Dial(s.addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.Do(testContext(t), Message{Type: "echo"})
+	if err != nil || resp.Type != "echo" || resp.ID == "" || resp.ID == "broadcast" {
+		t.Fatalf("Do = %+v, %v; want the echo under a generated ID", resp, err)
+	}
+	if resp, err := c.Do(testContext(t), Message{Type: "echo", ID: "mine"}); err != nil || resp.ID != "mine" {
+		t.Fatalf("Do = %+v, %v; want the response with ID mine", resp, err)
+	}
+}
+
+func TestPoolRoundRobinsOverSlots(t *testing.T) {
+	s := newStubServer(t, echo)
+	p := NewPool(s.addr(), 2)
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, err := p.Do(testContext(t), Message{Type: "echo"}); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if got, want := s.servedBy(), []int{0, 1, 0, 1}; !reflect.DeepEqual(got, want) || p.Dials() != 2 {
+		t.Fatalf("requests served by connections %v after %d dials, want %v after 2", got, p.Dials(), want)
+	}
+}
+
+func TestPoolRetriesOnlyReusedConnections(t *testing.T) {
+	// hangUpAfterFirst answers once per connection and then closes it
+	hangUpAfterFirst := func(conn int, req Message) ([]Message, bool) { return []Message{req}, true }
+	// hangUpAtOnce closes every connection without answering
+	hangUpAtOnce := func(conn int, req Message) ([]Message, bool) { return nil, true }
+
+	t.Run("reused connection retried once", func(t *testing.T) {
+		p := NewPool(newStubServer(t, hangUpAfterFirst).addr(), 1)
+		defer p.Close()
+		for i := 0; i < 2; i++ {
+			if _, err := p.Do(testContext(t), Message{Type: "echo"}); err != nil {
+				t.Fatalf("request %d: %v", i, err)
+			}
+		}
+		if p.Dials() != 2 {
+			t.Fatalf("Dials = %d, want 2: the first connection and its replacement", p.Dials())
+		}
+	})
+
+	t.Run("fresh connection not retried", func(t *testing.T) {
+		p := NewPool(newStubServer(t, hangUpAtOnce).addr(), 1)
+		defer p.Close()
+		if _, err := p.Do(testContext(t), Message{Type: "echo"}); err == nil {
+			t.Fatal("Do succeeded against a server that never answers")
+		}
+		if p.Dials() != 1 {
+			t.Fatalf("Dials = %d, want 1", p.Dials())
+		}
+	})
+
+	t.Run("cancelled context not retried", func(t *testing.T) {
+		p := NewPool(newStubServer(t, hangUpAfterFirst).addr(), 1)
+		defer p.Close()
+		if _, err := p.Do(testContext(t), Message{Type: "echo"}); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := p.Do(ctx, Message{Type: "echo"}); err == nil {
+			t.Fatal("Do succeeded on a connection the server closed")
+		}
+		if p.Dials() != 1 {
+			t.Fatalf("Dials = %d, want 1: no redial once the context is done", p.Dials())
+		}
+	})
+}
+
+func TestPoolRedialsAfterClose(t *testing.T) {
+	s := newStubServer(t, echo)
+	p := NewPool(s.addr(), 1)
+	if _, err := p.Do(testContext(t), Message{Type: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if p.Dials() != 1 {
+		t.Fatalf("Dials = %d after Close, want 1: it must not dial eagerly", p.Dials())
+	}
+	if _, err := p.Do(testContext(t), Message{Type: "echo"}); err != nil {
+		t.Fatalf("Do after Close: %v", err)
+	}
+	defer p.Close()
+	if p.Dials() != 2 {
+		t.Fatalf("Dials = %d, want 2", p.Dials())
+	}
+}
@@ -0,0 +1,5 @@
+module high-performance-server
+
+go 1.21
+
+require golang.org/x/sys v0.20.0
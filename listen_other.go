@@ -0,0 +1,32 @@
+// listen_other.go
+
+//go:build !unix || solaris
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// listenBacklogSupported reports whether listenWithBacklog can set the
+// backlog on this platform
+const listenBacklogSupported = false
+
+// listenWithBacklog falls back to a plain listener with the system default
+// backlog: building the socket by hand needs Unix socket calls
+func listenWithBacklog(network, address string, backlog int, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// reusePortControl fails: SO_REUSEPORT is not available on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on %s", runtime.GOOS)
+}
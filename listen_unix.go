@@ -0,0 +1,112 @@
+// listen_unix.go
+
+//go:build unix && !solaris
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenBacklogSupported reports whether listenWithBacklog can set the
+// backlog on this platform
+const listenBacklogSupported = true
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound. On
+// Linux the kernel then load-balances incoming connections across every
+// process listening on the port with the option set by the same user; the
+// BSDs and macOS accept the option without balancing, which is why Validate
+// only allows ReusePort on Linux.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("setsockopt SO_REUSEPORT: %w", sockErr)
+	}
+	return nil
+}
+
+// listenWithBacklog builds the listening socket by hand so the backlog can be
+// passed to listen(2); net.Listen always uses the system maximum. The kernel
+// still caps the value at net.core.somaxconn.
+func listenWithBacklog(network, address string, backlog int, reusePort bool) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	family := syscall.AF_INET6
+	if network == "tcp4" || (addr.IP != nil && addr.IP.To4() != nil) {
+		family = syscall.AF_INET
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil && family == syscall.AF_INET6 && network == "tcp" {
+		// IPv6 unavailable: fall back to IPv4 for dual-stack listening
+		family = syscall.AF_INET
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := bindAndListen(fd, family, network, addr, backlog, reusePort); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close() // FileListener dups the descriptor
+	return net.FileListener(f)
+}
+
+// bindAndListen applies socket options, binds fd to addr and starts listening
+func bindAndListen(fd, family int, network string, addr *net.TCPAddr, backlog int, reusePort bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
+	}
+	if reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("setsockopt SO_REUSEPORT: %w", err)
+		}
+	}
+
+	var sa syscall.Sockaddr
+	if family == syscall.AF_INET {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		if addr.IP != nil {
+			copy(sa4.Addr[:], addr.IP.To4())
+		}
+		sa = sa4
+	} else {
+		v6only := 0
+		if network == "tcp6" {
+			v6only = 1
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only); err != nil {
+			return fmt.Errorf("setsockopt IPV6_V6ONLY: %w", err)
+		}
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		if addr.IP != nil {
+			copy(sa6.Addr[:], addr.IP.To16())
+		}
+		sa = sa6
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	return nil
+}
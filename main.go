@@ -2,18 +2,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // Config holds server configuration
@@ -23,198 +45,6473 @@ type Config struct {
 	WriteTimeout    time.Duration
 	MaxConnections  int
 	ShutdownTimeout time.Duration
+	ForceExitAfter  time.Duration // After a shutdown signal, exit without waiting for the drain past this; 0 waits
+	EnableAdmin     bool          // Accept admin message types such as list_inflight
+	LogLevel        string        // "info" (default) or "debug"; change at runtime with SetLogLevel
+	AddressFamily   string        // "dual" (default), "ipv4" or "ipv6"
+	ListenBacklog   int           // Pending-connection queue length on Unix systems; 0, or another OS, uses the OS default
+	AcceptLoops     int           // Goroutines accepting on the listener concurrently; 0 means one
+	ReusePort       bool          // Set SO_REUSEPORT so several processes share the port's connections (Linux only)
+	AckOnly         bool          // Respond with just type, id and time instead of echoing the message
+	DeltaResponses  bool          // Respond with only the fields that differ from the request, plus id
+	WriteBufferSize int           // Batch responses in a buffer of this size; 0 writes each response directly
+	MaxFlushLatency time.Duration // Longest a batched response may wait before being flushed
+	TLSCertFile     string        // PEM certificate chain; TLS is enabled when set with TLSKeyFile
+	TLSKeyFile      string        // PEM private key for TLSCertFile
+	TLSClientCAFile string        // PEM CAs that sign client certificates; one verified against them authenticates the connection
+
+	// ALPN routing for a TLS port shared by several protocols. ALPNProtocol
+	// names this server's own protocol, e.g. "json-tcp"; ALPNHandlers maps
+	// other protocols, such as "h2", to the function that serves them, for
+	// instance an HTTP/2 server's connection handler. Both are advertised
+	// in the handshake, and a connection that negotiates a protocol in
+	// ALPNHandlers is handed to its function, which owns it from then on
+	// and must close it. It holds a MaxConnections slot until the function
+	// returns but is not otherwise tracked, so Shutdown does not wait for
+	// it. Clients that negotiate no protocol get this server's pipeline.
+	ALPNProtocol string
+	ALPNHandlers map[string]func(net.Conn)
+
+	// StreamFlushElements is how many elements an ArrayStream writes between
+	// flushes to the client, bounding both the memory held for a large
+	// streamed response and how late its first elements arrive
+	StreamFlushElements int
+
+	// MaxConnFDFraction, if set, limits connections to this fraction of the
+	// open file soft limit (RLIMIT_NOFILE) read when the server is created,
+	// so the limit follows the environment. When MaxConnections is also set
+	// the lower of the two applies; WithDefaults leaves it unset. Platforms
+	// without RLIMIT_NOFILE ignore it, with a warning at Start.
+	MaxConnFDFraction float64
+
+	// WriteRetries gives each write to a client a WriteTimeout deadline
+	// and retries one that times out up to this many times, backing off
+	// from writeRetryBackoff and giving each attempt a fresh deadline,
+	// before the connection is closed. Only the unwritten rest of the data
+	// is resent, so the stream stays intact. Other write errors, and writes
+	// on TLS connections, which crypto/tls cannot resume after a timeout,
+	// are never retried.
+	WriteRetries int
+
+	// Listener, if set, is served instead of a TCP listener opened from Port,
+	// AddressFamily, ListenBacklog and ReusePort: for example an in-memory
+	// listener in tests. Its connections need not be TCP. Shutdown closes it.
+	Listener net.Listener
+
+	// MaxConnBytes, if set, caps the bytes a connection may read and write
+	// in total; past it the client is sent a quota_exceeded error and the
+	// connection is closed. Bytes are counted inside TLS, so compressed
+	// traffic counts at its compressed size.
+	MaxConnBytes int64
+
+	// ShutdownNotifyTimeout and ShutdownDrainTimeout bound the notify-clients
+	// and drain-handlers phases of Shutdown; zero derives each from the time
+	// left on the shutdown context
+	ShutdownNotifyTimeout time.Duration
+	ShutdownDrainTimeout  time.Duration
+
+	// DrainBroadcasts has each connection deliver the broadcasts still
+	// queued for it during the drain-handlers phase before it closes;
+	// otherwise they are dropped as the connection stops. Either way
+	// Shutdown logs how many were queued when the drain began and how many
+	// were delivered or dropped; see ShutdownBacklog.
+	DrainBroadcasts bool
+
+	// RedirectAddr, if set, is sent in the shutdown notice as the address
+	// clients should reconnect to. AffinityFunc, if set, picks the address
+	// per connection instead, so clients with sticky sessions reach the
+	// successor holding their state; an empty result falls back to
+	// RedirectAddr.
+	RedirectAddr string
+	AffinityFunc func(ConnContext) string
+
+	// CertReloadInterval, if set, re-checks TLSCertFile and TLSKeyFile this
+	// often and reloads them when either changes, so renewed certificates
+	// (e.g. from ACME) are served by new handshakes without a restart. The
+	// certificate file may hold the full chain as a bundle of PEM blocks.
+	CertReloadInterval time.Duration
+
+	// MaxConnLifetime closes connections older than this, after the response
+	// in progress is sent, so clients reconnect. Go's TLS server never
+	// renegotiates, so on long-lived TLS connections this is the way to force
+	// a fresh handshake and new session keys. Zero means no limit.
+	MaxConnLifetime time.Duration
+
+	// MaxPingOnlyDuration closes connections that have sent nothing but
+	// "ping" messages this long after connecting: they are alive but do no
+	// work, and a client keeping such a connection forever only holds a slot.
+	// Any other message exempts the connection. Zero disables it.
+	MaxPingOnlyDuration time.Duration
+
+	// MaxConcurrentHandshakes bounds how many TLS handshakes run at once,
+	// independently of MaxConnections, since handshakes are CPU-heavy.
+	// Zero means unlimited.
+	MaxConcurrentHandshakes int
+
+	// HandshakeTimeout closes TLS connections whose handshake has not
+	// completed this long after it started, so a client that connects and
+	// stalls cannot hold a slot indefinitely. Zero uses 10 seconds.
+	HandshakeTimeout time.Duration
+
+	// PostHandshakeIdleTimeout closes connections that send no message within
+	// this long of becoming ready: after the TLS handshake and authentication,
+	// when those apply. Cleared by the first data message. Zero disables it.
+	PostHandshakeIdleTimeout time.Duration
+
+	// MetricsSampleRate is the fraction of messages, in (0, 1], whose
+	// processing time is observed in server_message_duration_seconds
+	// (default 1, every message; zero also times every message). Each
+	// sampled observation is weighted by the inverse rate so the
+	// histogram's count and sum estimate totals; counters are always exact.
+	MetricsSampleRate float64
+
+	// SlowHandlerThreshold logs a warning for each handler call that takes
+	// longer than this (default 5s, also used for zero), with its type,
+	// duration and message ID, and counts such calls by type in
+	// server_slow_handler_calls_total
+	SlowHandlerThreshold time.Duration
+
+	// BreakerThreshold opens a circuit breaker on a message type after this
+	// many consecutive handler failures: its messages are rejected with
+	// circuit_open for BreakerCooldown (default 10s), after which one trial
+	// call is let through and closes the breaker if it succeeds. Zero
+	// disables breakers.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// ReplayOnRecovery keeps the messages a connection had rejected by an
+	// open breaker, up to ReplayBufferSize (default 16) per connection, and
+	// handles them again in order once the breaker lets them through. The
+	// oldest is the half-open trial. Replays run before the connection's
+	// next message and send a second response with the original ID.
+	ReplayOnRecovery bool
+	ReplayBufferSize int
+
+	// MaxGoroutines rejects new connections with server_overloaded while the
+	// sampled goroutine count is at or above it. Zero disables the check.
+	MaxGoroutines int
+
+	// MaxPendingFirstMessage sheds load when connections arrive faster than
+	// they start talking: while this many accepted connections have yet to
+	// send their first message, newer ones are rejected with
+	// server_overloaded, keeping capacity for established clients. Zero
+	// disables it.
+	MaxPendingFirstMessage int
+
+	StrictDecoding bool // Reject messages with unknown fields instead of ignoring them
+	UseJSONNumber  bool // Decode payload numbers as json.Number, preserving large integers
+
+	// TimeFormat controls how Message.Time is written on the wire:
+	// "rfc3339nano" (default), "rfc3339", "unix" (seconds) or "unix_millis".
+	// Incoming times are accepted as RFC 3339 strings or numbers in the
+	// configured unix unit.
+	TimeFormat string
+
+	// InvalidUTF8 controls strings in outgoing payloads that are not valid
+	// UTF-8, e.g. binary a client put in a string field. By default the
+	// encoder replaces each bad byte with U+FFFD. "replace" replaces each
+	// bad sequence with a single U+FFFD; "base64" base64-encodes the whole
+	// string and lists its path, such as "a.b" or "list[2]", in the
+	// payload's "base64_fields" so the client can decode it.
+	InvalidUTF8 string
+
+	// Compression selects the stream codec: "" or "none" for plain JSON,
+	// "deflate" to compress both directions, sync-flushing after each message,
+	// or "message" to compress individual messages of at least
+	// CompressMinBytes into {"compressed":true,"data":...} frames while
+	// smaller ones are sent as plain JSON.
+	// CompressionDict names a file used as a preset dictionary, which makes
+	// small, similar messages compress far better; clients must use the same
+	// dictionary. (zstd would need a third-party module, so DEFLATE's preset
+	// dictionary support from the standard library is used instead.)
+	Compression      string
+	CompressionDict  string
+	CompressMinBytes int
+
+	// MaxCompressionLevel, with "message" compression, lets each client pick
+	// its DEFLATE level (1 fastest to 9 smallest) by sending
+	// compression_level in a hello message; the request is clamped to
+	// MinCompressionLevel (default 1) through MaxCompressionLevel. Zero
+	// disables negotiation. The "deflate" mode compresses the stream from
+	// its first byte, before any hello, so its level is fixed.
+	MinCompressionLevel int
+	MaxCompressionLevel int
+
+	// Authenticate, if set, requires each connection to send an auth message
+	// whose payload "token" it validates, returning the client identity.
+	// PreAuthPolicy controls messages that arrive before authentication:
+	// "reject" (default) answers them with an unauthenticated error, "queue"
+	// holds up to PreAuthQueueSize of them and processes them once auth succeeds.
+	//
+	// With TLSClientCAFile also set, AuthPrecedence decides between the two:
+	// "cert" (default) lets a verified client certificate authenticate the
+	// connection as its subject common name, or first DNS name, with no auth
+	// message, and requires the token only of clients without one; "token"
+	// always requires the token and takes the identity from it. Without
+	// Authenticate every client must present a verified certificate.
+	Authenticate     func(token string) (identity string, err error)
+	PreAuthPolicy    string
+	PreAuthQueueSize int
+	AuthPrecedence   string
+
+	// Publisher, if set, mirrors traffic to an external queue: each message
+	// a handler processes successfully is published once its response has
+	// been sent, under PublishTopic or, when that is empty, the message
+	// type. Publish failures are logged and do not affect the client.
+	Publisher    Publisher
+	PublishTopic string
+
+	// MetricsSink, if set, receives a MetricsSnapshot every
+	// MetricsPushInterval (default 10s), taken with SnapshotAndReset so each
+	// push carries that interval's deltas. FlushMetricsOnShutdown pushes a
+	// final snapshot at the end of Shutdown, within its context, so the
+	// last interval is not lost.
+	MetricsSink            MetricsSink
+	MetricsPushInterval    time.Duration
+	FlushMetricsOnShutdown bool
+
+	// IdempotencyTTL enables deduplication of messages carrying an
+	// idempotency_key: the response is cached for this long and returned for
+	// resends instead of processing them again. The cache is scoped to the
+	// session named by the "session" field of the auth payload, so it survives
+	// reconnects; connections without a session are scoped individually.
+	IdempotencyTTL time.Duration
+
+	// MetricsAddr, if set, serves Prometheus metrics at /metrics on this
+	// address. MetricsCardinalityMode is "aggregate" (the default), exposing
+	// only server-wide series, or "per_connection", which adds series
+	// labelled by connection ID: one per connection ever seen by the scraper,
+	// so only for small deployments. Per-connection detail is otherwise
+	// available from the list_connections admin command.
+	MetricsAddr            string
+	MetricsCardinalityMode string
+
+	// ProtocolVersions, if set, enables version negotiation. A client's
+	// "hello" message lists the versions it speaks in payload "versions",
+	// and the server answers with "version", the first of ProtocolVersions
+	// the client offered. Connection and message counters are also exported
+	// by negotiated version, with "none" for clients that never negotiate,
+	// so their cardinality is bounded by this list.
+	ProtocolVersions []string
+
+	// TraceBufferSize keeps each connection's last this many request and
+	// response pairs, by type and ID, for the admin trace command and
+	// ConnTrace; with TracePayloads the payloads are kept too. Zero
+	// disables tracing.
+	TraceBufferSize int
+	TracePayloads   bool
+
+	// MaxPayloadKeys caps the number of object keys in a message payload,
+	// counted across all nesting levels, and MaxKeyLength the length in bytes
+	// of any one key. Violating messages are rejected; zero disables a limit.
+	MaxPayloadKeys int
+	MaxKeyLength   int
+
+	// DetectGzip accepts connections whose stream starts with the gzip magic
+	// bytes, decompressing their input and gzip-compressing responses; other
+	// connections stay plain. It requires Compression "none".
+	DetectGzip bool
+
+	// ConnectionSummaryLog logs one JSON line per closed connection with its
+	// lifetime totals, for offline analysis and billing
+	ConnectionSummaryLog bool
+
+	// EnableTransactions handles the begin, commit and rollback message types,
+	// which bracket messages whose handlers share a Transaction. A
+	// transaction may hold up to MaxTransactionMessages messages and is
+	// rolled back if not committed within TransactionTimeout.
+	EnableTransactions     bool
+	MaxTransactionMessages int
+	TransactionTimeout     time.Duration
+
+	// EnableSubscriptions handles the subscribe and unsubscribe message
+	// types, whose payload names a topic, so BroadcastTopic reaches only the
+	// connections subscribed to it. MaxTopicsPerConn bounds the distinct
+	// topics a connection may hold at once; further subscribes are rejected
+	// with too_many_subscriptions until it unsubscribes. Zero means no limit.
+	EnableSubscriptions bool
+	MaxTopicsPerConn    int
+
+	// EnableTypeDeclarations lets a client declare in its hello message the
+	// message types it will send, as payload.types mapping each type to a
+	// schema listing its required payload fields, e.g.
+	// {"order":{"required":["sku"]}}. Once declared, messages of other types
+	// are rejected with undeclared_type and messages missing a required
+	// field with schema_violation. Clients that declare nothing are not
+	// restricted.
+	EnableTypeDeclarations bool
+
+	// AllowNoResponse lets a fire-and-forget client, such as a telemetry
+	// agent that never reads, send no_response: true in a hello message.
+	// The server then processes its messages but writes nothing to it: no
+	// responses or errors (including to the hello), broadcasts or requests.
+	AllowNoResponse bool
+
+	// MaxClockSkew detects clients whose clocks are off: a message whose
+	// client time differs from the server's by more than this is logged and
+	// counted, and with RejectClockSkew answered with clock_skew so the
+	// client can correct. Messages without a time are not checked. Zero
+	// disables the check.
+	MaxClockSkew    time.Duration
+	RejectClockSkew bool
+
+	// ReplyFiltered answers messages dropped by the SetFilter filter with a
+	// filtered error instead of dropping them silently
+	ReplyFiltered bool
+
+	// FlowControlWindow, if set, enables credit-based flow control. On
+	// connect the server sends {"type":"window_update","payload":{"credits":N}}
+	// granting FlowControlWindow credits; each message the client sends
+	// spends one, and the server returns credits with further window_update
+	// messages as its handlers complete, once half the window is owed and
+	// the server has caught up with the client's input. A client that waits
+	// for credit is therefore never throttled, while a message sent with no
+	// credit left is rejected with a retryable flow_control error.
+	// Replies to server-initiated Requests are not counted.
+	FlowControlWindow int
+
+	// Codec is the wire encoding: "json" (the default) or "msgpack". With
+	// SniffCodec each connection's codec is picked from the first byte its
+	// client sends, falling back to Codec when that byte is ambiguous.
+	Codec      string
+	SniffCodec bool
+
+	// Broadcast delivery. Each connection queues up to OutboundQueueSize
+	// broadcast messages; when BroadcastRate is set, its writer sends at most
+	// that many per second (bursting to BroadcastBurst), so slow clients are
+	// paced and only lose messages once their queue is full.
+	OutboundQueueSize int
+	BroadcastRate     float64
+	BroadcastBurst    int
+
+	// MaxBufferedBytes bounds the approximate encoded size of the broadcast
+	// messages queued across all connections. A broadcast that would exceed
+	// it sheds the oldest messages in the target connection's queue, or the
+	// new message when that queue is empty. Zero means no limit.
+	MaxBufferedBytes int64
+
+	// EventLogFile, if set, persists every lifecycle event as a JSON line
+	// appended to this file. The file and its directory are probed every
+	// EventLogCheckInterval; while a write or probe fails (the disk is full
+	// or the path unwritable) the server reports itself not ready and
+	// rejects new connections with persistence_unavailable, rather than
+	// serving traffic whose events would be lost.
+	EventLogFile          string
+	EventLogCheckInterval time.Duration
+
+	// WarmupDuration keeps the server not ready for this long after Start,
+	// while handlers and caches fill; AwaitMarkReady keeps it not ready
+	// until MarkReady is called. Either way MarkReady ends the warmup early.
+	// While warming up, new connections are rejected with not_ready and
+	// /readyz reports unavailable.
+	WarmupDuration time.Duration
+	AwaitMarkReady bool
+
+	// SourceQuota caps the messages each listed Source may send, across all
+	// of its connections, per SourceQuotaWindow (default one minute);
+	// further messages in the window are answered with a retryable
+	// quota_exceeded error. Sources not listed are unlimited and, since
+	// clients choose their Source, not counted. SourceCounts reports totals.
+	SourceQuota       map[string]int
+	SourceQuotaWindow time.Duration
+
+	// Inbound rate limits per connection. MessagesPerSecond counts messages
+	// and BytesPerSecond their size on the wire, so one huge message costs as
+	// much as many small ones; either or both may be set, each allowing a
+	// burst of one second's worth. Under RateLimitPolicy "throttle" (the
+	// default) a client over its limit is slowed down: the read loop waits
+	// before reading further, pushing back through TCP. Under "reject" the
+	// message is answered with a rate_limited error whose retry_after_ms
+	// says when the limiter will next admit it.
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+	RateLimitPolicy   string
+
+	// DrainPolicy picks the connections DrainToCount closes first: "oldest"
+	// (default) or "idlest", those longest without a message
+	DrainPolicy string
+
+	// OnDrainProgress, if set, is called periodically during Shutdown with
+	// the number of connections still active, until drain completes or times out
+	OnDrainProgress       func(remaining int)
+	DrainProgressInterval time.Duration
+}
+
+// Validate checks every field and returns an error listing all problems found
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Listener != nil {
+		// Port is unused
+	} else if c.Port == "" {
+		invalid("Port", "must not be empty")
+	} else if n, err := strconv.Atoi(c.Port); err != nil || n < 0 || n > 65535 {
+		invalid("Port", "%q is not a valid port number", c.Port)
+	}
+	if c.ReadTimeout < 0 {
+		invalid("ReadTimeout", "must not be negative, got %v", c.ReadTimeout)
+	}
+	if c.WriteRetries < 0 {
+		invalid("WriteRetries", "must not be negative, got %d", c.WriteRetries)
+	}
+	if c.WriteTimeout < 0 {
+		invalid("WriteTimeout", "must not be negative, got %v", c.WriteTimeout)
+	}
+	if c.MaxConnections <= 0 {
+		invalid("MaxConnections", "must be positive, got %d", c.MaxConnections)
+	}
+	if c.MaxConnFDFraction < 0 || c.MaxConnFDFraction > 1 {
+		invalid("MaxConnFDFraction", "must be between 0 and 1, got %v", c.MaxConnFDFraction)
+	}
+	if c.ShutdownTimeout < 0 {
+		invalid("ShutdownTimeout", "must not be negative, got %v", c.ShutdownTimeout)
+	}
+	if c.MaxConnBytes < 0 {
+		invalid("MaxConnBytes", "must not be negative, got %d", c.MaxConnBytes)
+	}
+	if c.ShutdownNotifyTimeout < 0 {
+		invalid("ShutdownNotifyTimeout", "must not be negative, got %v", c.ShutdownNotifyTimeout)
+	}
+	if c.ShutdownDrainTimeout < 0 {
+		invalid("ShutdownDrainTimeout", "must not be negative, got %v", c.ShutdownDrainTimeout)
+	}
+	if c.ForceExitAfter < 0 {
+		invalid("ForceExitAfter", "must not be negative, got %v", c.ForceExitAfter)
+	}
+	if _, err := c.listenNetwork(); err != nil {
+		invalid("AddressFamily", "%v", err)
+	}
+	if c.AcceptLoops < 0 {
+		invalid("AcceptLoops", "must not be negative, got %d", c.AcceptLoops)
+	}
+	if c.ListenBacklog < 0 {
+		invalid("ListenBacklog", "must not be negative, got %d", c.ListenBacklog)
+	}
+	// Other systems either lack SO_REUSEPORT or accept it without spreading
+	// connections across the listeners
+	if c.ReusePort && runtime.GOOS != "linux" {
+		invalid("ReusePort", "not supported on %s", runtime.GOOS)
+	}
+	if c.StreamFlushElements < 0 {
+		invalid("StreamFlushElements", "must not be negative, got %d", c.StreamFlushElements)
+	}
+	if c.WriteBufferSize < 0 {
+		invalid("WriteBufferSize", "must not be negative, got %d", c.WriteBufferSize)
+	}
+	if c.MaxFlushLatency < 0 {
+		invalid("MaxFlushLatency", "must not be negative, got %v", c.MaxFlushLatency)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		invalid("TLSCertFile/TLSKeyFile", "both must be set to enable TLS")
+	}
+	if (c.ALPNProtocol != "" || len(c.ALPNHandlers) > 0) && c.TLSCertFile == "" {
+		invalid("ALPNProtocol/ALPNHandlers", "require TLSCertFile and TLSKeyFile")
+	}
+	if _, ok := c.ALPNHandlers[c.ALPNProtocol]; ok {
+		invalid("ALPNHandlers", "must not handle ALPNProtocol %q, which is served by this server", c.ALPNProtocol)
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		invalid("TLSClientCAFile", "requires TLSCertFile and TLSKeyFile")
+	}
+	switch c.AuthPrecedence {
+	case "", "cert", "token":
+	default:
+		invalid("AuthPrecedence", "must be \"cert\" or \"token\", got %q", c.AuthPrecedence)
+	}
+	if c.CertReloadInterval < 0 {
+		invalid("CertReloadInterval", "must not be negative, got %v", c.CertReloadInterval)
+	}
+	if c.CertReloadInterval > 0 && c.TLSCertFile == "" {
+		invalid("CertReloadInterval", "requires TLSCertFile and TLSKeyFile")
+	}
+	if c.MaxConcurrentHandshakes < 0 {
+		invalid("MaxConcurrentHandshakes", "must not be negative, got %d", c.MaxConcurrentHandshakes)
+	}
+	if c.HandshakeTimeout < 0 {
+		invalid("HandshakeTimeout", "must not be negative, got %v", c.HandshakeTimeout)
+	}
+	if c.PostHandshakeIdleTimeout < 0 {
+		invalid("PostHandshakeIdleTimeout", "must not be negative, got %v", c.PostHandshakeIdleTimeout)
+	}
+	if c.MaxClockSkew < 0 {
+		invalid("MaxClockSkew", "must not be negative, got %v", c.MaxClockSkew)
+	}
+	if c.RejectClockSkew && c.MaxClockSkew == 0 {
+		invalid("RejectClockSkew", "needs MaxClockSkew")
+	}
+	if c.MetricsSampleRate < 0 || c.MetricsSampleRate > 1 {
+		invalid("MetricsSampleRate", "must be between 0 and 1, got %v", c.MetricsSampleRate)
+	}
+	if c.SlowHandlerThreshold < 0 {
+		invalid("SlowHandlerThreshold", "must not be negative, got %v", c.SlowHandlerThreshold)
+	}
+	if c.BreakerThreshold < 0 {
+		invalid("BreakerThreshold", "must not be negative, got %d", c.BreakerThreshold)
+	}
+	if c.BreakerCooldown < 0 {
+		invalid("BreakerCooldown", "must not be negative, got %v", c.BreakerCooldown)
+	}
+	if c.ReplayBufferSize < 0 {
+		invalid("ReplayBufferSize", "must not be negative, got %d", c.ReplayBufferSize)
+	}
+	if c.ReplayOnRecovery && c.BreakerThreshold == 0 {
+		invalid("ReplayOnRecovery", "needs BreakerThreshold")
+	}
+	if c.MaxPendingFirstMessage < 0 {
+		invalid("MaxPendingFirstMessage", "must not be negative, got %d", c.MaxPendingFirstMessage)
+	}
+	if c.MaxGoroutines < 0 {
+		invalid("MaxGoroutines", "must not be negative, got %d", c.MaxGoroutines)
+	}
+	if c.MaxConnLifetime < 0 {
+		invalid("MaxConnLifetime", "must not be negative, got %v", c.MaxConnLifetime)
+	}
+	if c.MaxPingOnlyDuration < 0 {
+		invalid("MaxPingOnlyDuration", "must not be negative, got %v", c.MaxPingOnlyDuration)
+	}
+	switch c.TimeFormat {
+	case "", TimeFormatRFC3339Nano, TimeFormatRFC3339, TimeFormatUnix, TimeFormatUnixMillis:
+	default:
+		invalid("TimeFormat", "must be one of %s, %s, %s or %s, got %q",
+			TimeFormatRFC3339Nano, TimeFormatRFC3339, TimeFormatUnix, TimeFormatUnixMillis, c.TimeFormat)
+	}
+	if _, ok := parseLogLevel(c.LogLevel); !ok {
+		invalid("LogLevel", "must be \"info\" or \"debug\", got %q", c.LogLevel)
+	}
+	switch c.InvalidUTF8 {
+	case "", "replace", "base64":
+	default:
+		invalid("InvalidUTF8", "must be \"replace\" or \"base64\", got %q", c.InvalidUTF8)
+	}
+	switch c.Compression {
+	case "", "none", "deflate", "message":
+	default:
+		invalid("Compression", "must be \"none\", \"deflate\" or \"message\", got %q", c.Compression)
+	}
+	if c.CompressionDict != "" && c.Compression != "deflate" && c.Compression != "message" {
+		invalid("CompressionDict", "requires Compression \"deflate\" or \"message\"")
+	}
+	if c.MaxCompressionLevel != 0 {
+		if c.Compression != "message" {
+			invalid("MaxCompressionLevel", "needs Compression \"message\", got %q", c.Compression)
+		}
+		if c.MaxCompressionLevel < flate.BestSpeed || c.MaxCompressionLevel > flate.BestCompression {
+			invalid("MaxCompressionLevel", "must be between %d and %d, got %d", flate.BestSpeed, flate.BestCompression, c.MaxCompressionLevel)
+		}
+		if c.MinCompressionLevel < flate.BestSpeed || c.MinCompressionLevel > c.MaxCompressionLevel {
+			invalid("MinCompressionLevel", "must be between %d and MaxCompressionLevel, got %d", flate.BestSpeed, c.MinCompressionLevel)
+		}
+	}
+	if c.CompressMinBytes < 0 {
+		invalid("CompressMinBytes", "must not be negative, got %d", c.CompressMinBytes)
+	}
+	seenVersions := make(map[string]bool)
+	for _, v := range c.ProtocolVersions {
+		if v == "" || v == "none" || seenVersions[v] {
+			invalid("ProtocolVersions", "%q is empty, reserved or repeated", v)
+		}
+		seenVersions[v] = true
+	}
+	switch c.MetricsCardinalityMode {
+	case "", "aggregate", "per_connection":
+	default:
+		invalid("MetricsCardinalityMode", "must be \"aggregate\" or \"per_connection\", got %q", c.MetricsCardinalityMode)
+	}
+	if c.TraceBufferSize < 0 {
+		invalid("TraceBufferSize", "must not be negative, got %d", c.TraceBufferSize)
+	}
+	if c.TracePayloads && c.TraceBufferSize == 0 {
+		invalid("TracePayloads", "needs TraceBufferSize")
+	}
+	if c.MaxPayloadKeys < 0 {
+		invalid("MaxPayloadKeys", "must not be negative, got %d", c.MaxPayloadKeys)
+	}
+	if c.MaxKeyLength < 0 {
+		invalid("MaxKeyLength", "must not be negative, got %d", c.MaxKeyLength)
+	}
+	if c.DetectGzip && c.Compression != "" && c.Compression != "none" {
+		invalid("DetectGzip", "cannot be combined with Compression %q", c.Compression)
+	}
+	if c.FlowControlWindow < 0 {
+		invalid("FlowControlWindow", "must not be negative, got %d", c.FlowControlWindow)
+	}
+	if c.MaxTransactionMessages < 0 {
+		invalid("MaxTransactionMessages", "must not be negative, got %d", c.MaxTransactionMessages)
+	}
+	if c.TransactionTimeout < 0 {
+		invalid("TransactionTimeout", "must not be negative, got %v", c.TransactionTimeout)
+	}
+	if c.MaxTopicsPerConn < 0 {
+		invalid("MaxTopicsPerConn", "must not be negative, got %d", c.MaxTopicsPerConn)
+	}
+	if c.DeltaResponses && c.AckOnly {
+		invalid("DeltaResponses", "cannot be combined with AckOnly")
+	}
+	switch c.Codec {
+	case "", "json", "msgpack":
+	default:
+		invalid("Codec", "must be \"json\" or \"msgpack\", got %q", c.Codec)
+	}
+	if c.Compression == "message" && (c.Codec == "msgpack" || c.SniffCodec) {
+		invalid("Compression", "\"message\" compression frames are JSON only and cannot be used with msgpack")
+	}
+	switch c.PreAuthPolicy {
+	case "", "reject", "queue":
+	default:
+		invalid("PreAuthPolicy", "must be \"reject\" or \"queue\", got %q", c.PreAuthPolicy)
+	}
+	if c.PreAuthQueueSize < 0 {
+		invalid("PreAuthQueueSize", "must not be negative, got %d", c.PreAuthQueueSize)
+	}
+	if c.IdempotencyTTL < 0 {
+		invalid("IdempotencyTTL", "must not be negative, got %v", c.IdempotencyTTL)
+	}
+	if c.MaxBufferedBytes < 0 {
+		invalid("MaxBufferedBytes", "must not be negative, got %d", c.MaxBufferedBytes)
+	}
+	if c.OutboundQueueSize < 0 {
+		invalid("OutboundQueueSize", "must not be negative, got %d", c.OutboundQueueSize)
+	}
+	if c.WarmupDuration < 0 {
+		invalid("WarmupDuration", "must not be negative, got %v", c.WarmupDuration)
+	}
+	if c.MetricsPushInterval < 0 {
+		invalid("MetricsPushInterval", "must not be negative, got %v", c.MetricsPushInterval)
+	}
+	if c.FlushMetricsOnShutdown && c.MetricsSink == nil {
+		invalid("FlushMetricsOnShutdown", "needs a MetricsSink")
+	}
+	if c.EventLogCheckInterval < 0 {
+		invalid("EventLogCheckInterval", "must not be negative, got %v", c.EventLogCheckInterval)
+	}
+	for source, limit := range c.SourceQuota {
+		if limit < 0 {
+			invalid("SourceQuota", "quota for %q must not be negative, got %d", source, limit)
+		}
+	}
+	if c.SourceQuotaWindow < 0 {
+		invalid("SourceQuotaWindow", "must not be negative, got %v", c.SourceQuotaWindow)
+	}
+	if c.MessagesPerSecond < 0 {
+		invalid("MessagesPerSecond", "must not be negative, got %v", c.MessagesPerSecond)
+	}
+	if c.BytesPerSecond < 0 {
+		invalid("BytesPerSecond", "must not be negative, got %v", c.BytesPerSecond)
+	}
+	switch c.RateLimitPolicy {
+	case "", "throttle", "reject":
+	default:
+		invalid("RateLimitPolicy", "must be \"throttle\" or \"reject\", got %q", c.RateLimitPolicy)
+	}
+	if c.BroadcastRate < 0 {
+		invalid("BroadcastRate", "must not be negative, got %v", c.BroadcastRate)
+	}
+	if c.BroadcastBurst < 0 {
+		invalid("BroadcastBurst", "must not be negative, got %d", c.BroadcastBurst)
+	}
+	switch c.DrainPolicy {
+	case "", "oldest", "idlest":
+	default:
+		invalid("DrainPolicy", "must be \"oldest\" or \"idlest\", got %q", c.DrainPolicy)
+	}
+	if c.DrainProgressInterval < 0 {
+		invalid("DrainProgressInterval", "must not be negative, got %v", c.DrainProgressInterval)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Documented defaults applied by WithDefaults to unset fields
+const (
+	defaultPort                  = "8080"
+	defaultReadTimeout           = 30 * time.Second
+	defaultWriteTimeout          = 30 * time.Second
+	defaultMaxConnections        = 10000 // Raise with the file descriptor limit; see checkFDLimit
+	defaultShutdownTimeout       = 30 * time.Second
+	defaultAddressFamily         = "dual"
+	defaultDrainProgressInterval = 500 * time.Millisecond
+	defaultMaxFlushLatency       = 10 * time.Millisecond // Used when batching without a MaxFlushLatency
+	defaultStreamFlushElements   = 256
+	defaultPreAuthQueueSize      = 16
+	defaultCompressMinBytes      = 512 // Below this DEFLATE overhead outweighs savings
+	defaultOutboundQueueSize     = 256
+	defaultShutdownNotifyTimeout = time.Second // Notify budget when Shutdown has no deadline
+	defaultMaxTransactionMsgs    = 100
+	defaultTransactionTimeout    = 30 * time.Second
+	defaultHandshakeTimeout      = 10 * time.Second
+	defaultEventLogCheckInterval = 5 * time.Second
+	defaultSourceQuotaWindow     = time.Minute
+	defaultMetricsPushInterval   = 10 * time.Second
+	defaultSlowHandlerThreshold  = 5 * time.Second
+	defaultBreakerCooldown       = 10 * time.Second
+	defaultReplayBufferSize      = 16
+)
+
+// goroutineSampleInterval is how often the goroutine count is sampled for
+// MaxGoroutines; sampling keeps runtime.NumGoroutine off the accept path
+const goroutineSampleInterval = 100 * time.Millisecond
+
+// rejectWriteTimeout bounds the write of a rejection message to a new client
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// outboundFlushPoll is how often a connection closing under DrainBroadcasts
+// checks whether its queue has emptied
+const outboundFlushPoll = 5 * time.Millisecond
+
+// closeWriteTimeout bounds the write of the close notice to a client the
+// server is disconnecting, so one that has stopped reading cannot hold it open
+const closeWriteTimeout = 100 * time.Millisecond
+
+// maxInflatedBytes caps a decompressed message frame to defuse zip bombs
+const maxInflatedBytes = 16 << 20
+
+// Limits on client-supplied msgpack: nesting depth and the length of any
+// single string or binary value
+const (
+	maxMsgpackDepth = 100
+	maxMsgpackBytes = 16 << 20
+)
+
+// WithDefaults returns a copy of c with every unset field that has no
+// meaningful zero value filled in from the documented defaults. Apply it
+// after loading a partial config so zero values do not break the server.
+func (c Config) WithDefaults() Config {
+	if c.Port == "" {
+		c.Port = defaultPort
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.SourceQuotaWindow == 0 {
+		c.SourceQuotaWindow = defaultSourceQuotaWindow
+	}
+	if c.MetricsSink != nil && c.MetricsPushInterval == 0 {
+		c.MetricsPushInterval = defaultMetricsPushInterval
+	}
+	if c.MetricsSampleRate == 0 {
+		c.MetricsSampleRate = 1
+	}
+	if c.SlowHandlerThreshold == 0 {
+		c.SlowHandlerThreshold = defaultSlowHandlerThreshold
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown == 0 {
+		c.BreakerCooldown = defaultBreakerCooldown
+	}
+	if c.ReplayOnRecovery && c.ReplayBufferSize == 0 {
+		c.ReplayBufferSize = defaultReplayBufferSize
+	}
+	if c.EventLogCheckInterval == 0 {
+		c.EventLogCheckInterval = defaultEventLogCheckInterval
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.MaxConnections == 0 && c.MaxConnFDFraction == 0 {
+		c.MaxConnections = defaultMaxConnections
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.AddressFamily == "" {
+		c.AddressFamily = defaultAddressFamily
+	}
+	if c.StreamFlushElements == 0 {
+		c.StreamFlushElements = defaultStreamFlushElements
+	}
+	if c.WriteBufferSize > 0 && c.MaxFlushLatency == 0 {
+		c.MaxFlushLatency = defaultMaxFlushLatency
+	}
+	if c.MaxCompressionLevel != 0 && c.MinCompressionLevel == 0 {
+		c.MinCompressionLevel = flate.BestSpeed
+	}
+	if c.Compression == "message" && c.CompressMinBytes == 0 {
+		c.CompressMinBytes = defaultCompressMinBytes
+	}
+	if c.PreAuthPolicy == "queue" && c.PreAuthQueueSize == 0 {
+		c.PreAuthQueueSize = defaultPreAuthQueueSize
+	}
+	if c.OutboundQueueSize == 0 {
+		c.OutboundQueueSize = defaultOutboundQueueSize
+	}
+	if c.MaxTransactionMessages == 0 {
+		c.MaxTransactionMessages = defaultMaxTransactionMsgs
+	}
+	if c.TransactionTimeout == 0 {
+		c.TransactionTimeout = defaultTransactionTimeout
+	}
+	if c.DrainProgressInterval == 0 {
+		c.DrainProgressInterval = defaultDrainProgressInterval
+	}
+	return c
+}
+
+// listenNetwork maps the configured address family to a net.Listen network
+func (c Config) listenNetwork() (string, error) {
+	switch c.AddressFamily {
+	case "", "dual":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("unknown address family %q", c.AddressFamily)
+	}
+}
+
+// Message represents the JSON structure for client communication
+type Message struct {
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+	Time    time.Time              `json:"time"`
+	ID      string                 `json:"id"`
+	Source  string                 `json:"source"`
+
+	// CorrelationID pairs a server-initiated Request with the client's reply
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// CloseAfter asks the server to close the connection once it has sent
+	// the response, giving one-shot request/response semantics
+	CloseAfter bool `json:"close_after,omitempty"`
+	// IdempotencyKey identifies a request so a resend returns the first
+	// result instead of running it again; see IdempotencyTTL
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// TraceID correlates a message with its response and log lines. The
+	// server generates one when the client does not supply it.
+	TraceID string `json:"trace_id,omitempty"`
+	// ClientTime is the time the client stamped on the message, zero if it
+	// sent none. It is kept when the server replaces Time in a response and
+	// is never sent on the wire.
+	ClientTime time.Time `json:"-"`
+
+	// Compressed marks a frame whose Data holds a DEFLATE-compressed message,
+	// used by the "message" compression mode
+	Compressed bool   `json:"compressed,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// batchWriter coalesces writes in a buffer. The buffer is flushed when it
+// fills, or at most maxLatency after the first write that left it non-empty,
+// so batching never delays a response by more than maxLatency.
+type batchWriter struct {
+	mu         sync.Mutex
+	buf        *bufio.Writer
+	maxLatency time.Duration
+	timer      *time.Timer
+	armed      bool
+	err        error // Sticky error from a timed flush
+}
+
+// newBatchWriter wraps w in a batchWriter with the given buffer size
+func newBatchWriter(w io.Writer, size int, maxLatency time.Duration) *batchWriter {
+	if maxLatency <= 0 {
+		maxLatency = defaultMaxFlushLatency
+	}
+	b := &batchWriter{
+		buf:        bufio.NewWriterSize(w, size),
+		maxLatency: maxLatency,
+	}
+	b.timer = time.AfterFunc(maxLatency, b.timedFlush)
+	b.timer.Stop()
+	return b
+}
+
+// Write buffers p and arms the flush timer if the buffer was empty
+func (b *batchWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.buf.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if b.buf.Buffered() > 0 && !b.armed {
+		b.armed = true
+		b.timer.Reset(b.maxLatency)
+	}
+	return n, nil
+}
+
+// Flush writes any buffered data to the underlying writer
+func (b *batchWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked flushes the buffer and disarms the timer; b.mu must be held
+func (b *batchWriter) flushLocked() error {
+	if b.armed {
+		b.timer.Stop()
+		b.armed = false
+	}
+	if b.err != nil {
+		return b.err
+	}
+	return b.buf.Flush()
+}
+
+// timedFlush runs when maxLatency has elapsed since the batch started
+func (b *batchWriter) timedFlush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.armed {
+		return // Flushed explicitly after the timer fired
+	}
+	b.armed = false
+	if err := b.buf.Flush(); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+// Close flushes pending data and stops the timer
+func (b *batchWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.flushLocked()
+	b.timer.Stop()
+	return err
+}
+
+// Wire formats for Message.Time, selected by Config.TimeFormat
+const (
+	TimeFormatRFC3339Nano = "rfc3339nano"
+	TimeFormatRFC3339     = "rfc3339"
+	TimeFormatUnix        = "unix"
+	TimeFormatUnixMillis  = "unix_millis"
+)
+
+// wireTime marshals a time in one of the TimeFormat encodings
+type wireTime struct {
+	t      time.Time
+	format string
+}
+
+func (w wireTime) MarshalJSON() ([]byte, error) {
+	switch w.format {
+	case TimeFormatUnix, TimeFormatUnixMillis:
+		if w.t.IsZero() {
+			return []byte("0"), nil
+		}
+		if w.format == TimeFormatUnix {
+			return strconv.AppendInt(nil, w.t.Unix(), 10), nil
+		}
+		return strconv.AppendInt(nil, w.t.UnixMilli(), 10), nil
+	case TimeFormatRFC3339:
+		return json.Marshal(w.t.Format(time.RFC3339))
+	default:
+		return json.Marshal(w.t.Format(time.RFC3339Nano))
+	}
+}
+
+// UnmarshalJSON accepts an RFC 3339 string in any format, or a number in the
+// unix unit of w.format (seconds unless unix_millis)
+func (w *wireTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &w.t)
+	}
+
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("time must be an RFC 3339 string or integer unix time: %s", data)
+	}
+	switch {
+	case n == 0:
+		w.t = time.Time{}
+	case w.format == TimeFormatUnixMillis:
+		w.t = time.UnixMilli(n)
+	default:
+		w.t = time.Unix(n, 0)
+	}
+	return nil
+}
+
+// wireMessage and wireAck shadow the embedded Time field so it is encoded
+// in the configured format; encoding/json prefers the shallower field
+type wireMessage struct {
+	Message
+	Time wireTime `json:"time"`
+}
+
+type wireAck struct {
+	ack
+	Time wireTime `json:"time"`
+}
+
+// toWire converts a Message or ack for encoding in timeFormat. The default
+// format needs no conversion, which keeps the wire output unchanged.
+func toWire(v interface{}, timeFormat string) interface{} {
+	if timeFormat == "" || timeFormat == TimeFormatRFC3339Nano {
+		return v
+	}
+	switch m := v.(type) {
+	case Message:
+		return wireMessage{Message: m, Time: wireTime{m.Time, timeFormat}}
+	case ack:
+		return wireAck{ack: m, Time: wireTime{m.Time, timeFormat}}
+	}
+	return v
+}
+
+// hasInvalidUTF8 reports whether any string or key within v is not valid
+// UTF-8
+func hasInvalidUTF8(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return !utf8.ValidString(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			if !utf8.ValidString(k) || hasInvalidUTF8(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if hasInvalidUTF8(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sanitizePayload returns a copy of payload with its invalid UTF-8 handled
+// per mode (see Config.InvalidUTF8). Keys always get U+FFFD; a key cannot
+// be flagged for decoding.
+func sanitizePayload(payload map[string]interface{}, mode string) map[string]interface{} {
+	var encoded []string
+	var walk func(v interface{}, path string) interface{}
+	walk = func(v interface{}, path string) interface{} {
+		switch v := v.(type) {
+		case string:
+			if utf8.ValidString(v) {
+				return v
+			}
+			if mode == "base64" {
+				encoded = append(encoded, path)
+				return base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			return strings.ToValidUTF8(v, "\uFFFD")
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(v))
+			for k, e := range v {
+				k = strings.ToValidUTF8(k, "\uFFFD")
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				out[k] = walk(e, p)
+			}
+			return out
+		case []interface{}:
+			out := make([]interface{}, len(v))
+			for i, e := range v {
+				out[i] = walk(e, fmt.Sprintf("%s[%d]", path, i))
+			}
+			return out
+		}
+		return v
+	}
+	out := walk(payload, "").(map[string]interface{})
+	if len(encoded) > 0 {
+		sort.Strings(encoded)
+		out["base64_fields"] = encoded
+	}
+	return out
+}
+
+// messageDecoder reads successive messages from a connection; Buffered
+// returns input already read from the connection but not yet decoded
+type messageDecoder interface {
+	Decode(v interface{}) error
+	Buffered() io.Reader
+}
+
+// messageEncoder writes successive messages to a connection, each in a single
+// Write call
+type messageEncoder interface {
+	Encode(v interface{}) error
+}
+
+// newCodec returns the decoder and encoder for codec ("json" when empty)
+func (s *Server) newCodec(codec string, r io.Reader, w io.Writer) (messageDecoder, messageEncoder) {
+	if codec == "msgpack" {
+		return &msgpackDecoder{r: bufio.NewReader(r), s: s}, &msgpackEncoder{w: w}
+	}
+	return s.newDecoder(r), json.NewEncoder(w)
+}
+
+// sniffCodec picks a codec from the first byte a client sends: JSON values
+// open with '{' or '[', msgpack messages with a map or array marker.
+// Anything else, leading whitespace included, is ambiguous and gets fallback.
+func sniffCodec(b byte, fallback string) string {
+	switch {
+	case b == '{' || b == '[':
+		return "json"
+	case b&0xe0 == 0x80, b == 0xdc, b == 0xdd, b == 0xde, b == 0xdf:
+		return "msgpack" // fixmap, fixarray, array16/32, map16/32
+	}
+	return fallback
+}
+
+// sniffingDecoder defers choosing a connection's codec until the first
+// message arrives. choose builds the decoder for the sniffed codec and
+// switches the connection's encoder to match.
+type sniffingDecoder struct {
+	r        *bufio.Reader
+	fallback string
+	choose   func(codec string, r io.Reader) messageDecoder
+	dec      messageDecoder
+}
+
+func (d *sniffingDecoder) Decode(v interface{}) error {
+	if d.dec == nil {
+		b, err := d.r.Peek(1)
+		if err != nil {
+			return err
+		}
+		d.dec = d.choose(sniffCodec(b[0], d.fallback), d.r)
+	}
+	return d.dec.Decode(v)
+}
+
+func (d *sniffingDecoder) Buffered() io.Reader {
+	if d.dec == nil {
+		b, _ := d.r.Peek(d.r.Buffered())
+		return bytes.NewReader(b)
+	}
+	return d.dec.Buffered()
+}
+
+// msgpackDecoder decodes msgpack values by converting each to JSON and
+// decoding that with the server's JSON settings, so field names, time
+// formats, StrictDecoding and UseJSONNumber behave as they do for JSON
+type msgpackDecoder struct {
+	r *bufio.Reader
+	s *Server
+}
+
+func (d *msgpackDecoder) Decode(v interface{}) error {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	val, err := readMsgpack(d.r, b, 0)
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	return d.s.newDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (d *msgpackDecoder) Buffered() io.Reader {
+	b, _ := d.r.Peek(d.r.Buffered())
+	return bytes.NewReader(b)
+}
+
+// readMsgpack decodes the value whose first byte is b. Maps must have string
+// keys; binary data decodes to []byte. Extension types are not supported.
+func readMsgpack(r *bufio.Reader, b byte, depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("value nested too deeply")
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return readMsgpackMap(r, int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return readMsgpackArray(r, int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		data, err := readMsgpackBytes(r, int(b&0x1f))
+		return string(data), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		n, err := readMsgpackUint(r, 1<<(b-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, int(n))
+	case 0xca:
+		n, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8/16/32/64
+		n, err := readMsgpackUint(r, 1<<(b-0xcc))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8/16/32/64
+		size := 1 << (b - 0xd0)
+		n, err := readMsgpackUint(r, size)
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, err // Sign-extend
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		n, err := readMsgpackUint(r, 1<<(b-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readMsgpackBytes(r, int(n))
+		return string(data), err
+	case 0xdc, 0xdd: // array 16/32
+		n, err := readMsgpackUint(r, 2<<(b-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, int(n), depth)
+	case 0xde, 0xdf: // map 16/32
+		n, err := readMsgpackUint(r, 2<<(b-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, int(n), depth)
+	}
+	return nil, fmt.Errorf("unsupported type 0x%02x", b)
+}
+
+// readMsgpackUint reads a big-endian unsigned integer of size bytes
+func readMsgpackUint(r *bufio.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, noEOF(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func readMsgpackBytes(r *bufio.Reader, n int) ([]byte, error) {
+	if n > maxMsgpackBytes {
+		return nil, fmt.Errorf("%d-byte value exceeds limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, noEOF(err)
+	}
+	return data, nil
+}
+
+func readMsgpackArray(r *bufio.Reader, n, depth int) ([]interface{}, error) {
+	arr := make([]interface{}, 0, min(n, 1024)) // n is client-supplied
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		v, err := readMsgpack(r, b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n, depth int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		k, err := readMsgpack(r, b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %T", k)
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return nil, noEOF(err)
+		}
+		if m[key], err = readMsgpack(r, b, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// noEOF reports a stream ending inside a value as unexpected
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// msgpackEncoder encodes values to msgpack via their JSON form, so the
+// output has the same fields and time format as the JSON codec
+type msgpackEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *msgpackEncoder) Encode(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var val interface{}
+	if err := decoder.Decode(&val); err != nil {
+		return err
+	}
+	e.buf = appendMsgpack(e.buf[:0], val)
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// appendMsgpack appends the msgpack encoding of a decoded JSON value. Map
+// keys are written in sorted order, as encoding/json does.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			switch {
+			case i >= 0 && i <= 0x7f:
+				return append(b, byte(i))
+			case i < 0 && i >= -32:
+				return append(b, byte(int8(i)))
+			}
+			return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+		}
+		f, _ := v.Float64() // Valid: produced by encoding/json
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...)
+	case []interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+		}
+		for _, elem := range v {
+			b = appendMsgpack(b, elem)
+		}
+		return b
+	case map[string]interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+		}
+		keys := make([]string, 0, n)
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = appendMsgpack(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	}
+	return b
+}
+
+// newDecoder returns a message decoder configured per StrictDecoding and
+// UseJSONNumber
+func (s *Server) newDecoder(r io.Reader) *json.Decoder {
+	decoder := json.NewDecoder(r)
+	if s.config.StrictDecoding {
+		decoder.DisallowUnknownFields()
+	}
+	if s.config.UseJSONNumber {
+		decoder.UseNumber()
+	}
+	return decoder
+}
+
+// decodeMessage reads the next message, parsing its time per timeFormat
+func decodeMessage(decoder messageDecoder, timeFormat string) (Message, error) {
+	if timeFormat == "" || timeFormat == TimeFormatRFC3339Nano {
+		var msg Message
+		err := decoder.Decode(&msg)
+		return msg, err
+	}
+	w := wireMessage{Time: wireTime{format: timeFormat}}
+	err := decoder.Decode(&w)
+	w.Message.Time = w.Time.t
+	return w.Message, err
+}
+
+// flushWriter sync-flushes a compressor after every write. The encoder writes
+// each message in one call, so every message reaches the client as soon as
+// it is encoded instead of waiting for the compressor's window to fill.
+type flushWriter struct {
+	w interface {
+		io.Writer
+		Flush() error
+	}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+// gzipDetector defers choosing between a plain and a gzip stream until the
+// client's first bytes arrive. If they carry the gzip magic, onGzip is called
+// before any decompressed data is returned.
+type gzipDetector struct {
+	br     *bufio.Reader
+	r      io.Reader // Chosen stream; nil until detected
+	onGzip func()
+}
+
+func (d *gzipDetector) Read(p []byte) (int, error) {
+	if d.r == nil {
+		magic, err := d.br.Peek(2)
+		switch {
+		case len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+			zr, err := gzip.NewReader(d.br)
+			if err != nil {
+				return 0, err
+			}
+			d.onGzip()
+			d.r = zr
+		case err != nil && !errors.Is(err, io.EOF):
+			return 0, err // E.g. a deadline: detect on the next Read
+		default:
+			d.r = d.br
+		}
+	}
+	return d.r.Read(p)
+}
+
+// switchWriter lets the start of the writer chain change after encoders
+// are built on it. Writes and switches are serialized by
+// clientConn.writeMutex.
+type switchWriter struct {
+	w io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// messageCompressor implements the "message" compression mode. Each write is
+// one encoded message: those of at least minBytes are DEFLATE-compressed into
+// a frame flagged "compressed", smaller ones pass through unchanged. Writes
+// are serialized by clientConn.send.
+type messageCompressor struct {
+	w        io.Writer
+	minBytes int
+	fw       *flate.Writer // Reset per frame; keeps the preset dictionary
+	buf      bytes.Buffer
+}
+
+// compressedFrame is the wire form of a compressed message
+type compressedFrame struct {
+	Compressed bool   `json:"compressed"`
+	Data       []byte `json:"data"`
+}
+
+func (m *messageCompressor) Write(p []byte) (int, error) {
+	if len(p) < m.minBytes {
+		return m.w.Write(p)
+	}
+
+	m.buf.Reset()
+	m.fw.Reset(&m.buf)
+	if _, err := m.fw.Write(bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	if err := m.fw.Close(); err != nil {
+		return 0, err
+	}
+	frame, err := json.Marshal(compressedFrame{Compressed: true, Data: m.buf.Bytes()})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.w.Write(append(frame, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setCompressionLevel switches the connection's "message" compressor to
+// level for the messages it sends from now on
+func (c *clientConn) setCompressionLevel(level int, dict []byte) error {
+	if c.compressor == nil {
+		return errors.New("connection is not using message compression")
+	}
+	fw, err := flate.NewWriterDict(io.Discard, level, dict)
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	c.compressor.fw = fw
+	c.writeMutex.Unlock()
+	return nil
+}
+
+// payloadInt converts a decoded payload number, whichever codec or
+// UseJSONNumber produced it, to an int
+func payloadInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), n == float64(int(n))
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case int64:
+		return int(n), true
+	case uint64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// inflateMessage decodes the message carried by a compressed frame
+func (s *Server) inflateMessage(frame Message) (Message, error) {
+	r := flate.NewReaderDict(bytes.NewReader(frame.Data), s.dict)
+	defer r.Close()
+
+	decoder := s.newDecoder(io.LimitReader(r, maxInflatedBytes))
+	msg, err := decodeMessage(decoder, s.config.TimeFormat)
+	if err != nil {
+		return Message{}, fmt.Errorf("inflating frame: %w", err)
+	}
+	if msg.Compressed {
+		return Message{}, errors.New("nested compressed frame")
+	}
+	return msg, nil
+}
+
+// WeightedPicker spreads picks over backends in proportion to their
+// weights, for handlers that forward messages to several backends. It uses
+// smooth weighted round-robin, so a heavy backend's picks are interleaved
+// with the others' rather than bunched together. It is safe for concurrent
+// use.
+type WeightedPicker struct {
+	mu       sync.Mutex
+	backends []string // Sorted, so the sequence of picks is deterministic
+	weights  []int
+	current  []int
+	total    int
+}
+
+// NewWeightedPicker returns a picker over the backends in weights; those
+// with a weight of zero or less are never picked
+func NewWeightedPicker(weights map[string]int) *WeightedPicker {
+	p := &WeightedPicker{}
+	for backend, w := range weights {
+		if w > 0 {
+			p.backends = append(p.backends, backend)
+		}
+	}
+	sort.Strings(p.backends)
+	for _, backend := range p.backends {
+		p.weights = append(p.weights, weights[backend])
+		p.total += weights[backend]
+	}
+	p.current = make([]int, len(p.backends))
+	return p
+}
+
+// Pick returns the next backend, or "" when there are none
+func (p *WeightedPicker) Pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.backends) == 0 {
+		return ""
+	}
+	best := 0
+	for i, w := range p.weights {
+		p.current[i] += w
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.backends[best]
+}
+
+// tokenBucket is a minimal token-bucket rate limiter: tokens refill at rate
+// per second up to burst, and takers may go into debt that later takers
+// wait out
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket; burst is at least one token
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(max(burst, 1))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// refill adds the tokens accrued since the last call; b.mu must be held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// acting so the rate is honoured
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens if they are available and reports whether it did
+func (b *tokenBucket) allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// take takes n tokens if they are available and otherwise returns how long
+// until they will be. A request larger than the burst is admitted, going
+// into debt, once the bucket is full, so it is not refused forever.
+func (b *tokenBucket) take(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	need := min(n, b.burst)
+	if b.tokens >= need {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens, blocking until they are available or ctx is done
+func (b *tokenBucket) Wait(ctx context.Context, n float64) error {
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Repeated error log lines: each distinct line is logged up to
+// logRepeatBurst times in a row, then about once per logSummaryInterval,
+// with the suppressed repeats counted in a summary line every interval.
+// At most maxThrottledLines distinct lines are tracked at once.
+const (
+	logRepeatBurst     = 5
+	logSummaryInterval = 10 * time.Second
+	maxThrottledLines  = 1024
+)
+
+// logThrottle collapses repeated identical error log lines
+type logThrottle struct {
+	mu    sync.Mutex
+	lines map[string]*throttledLine
+}
+
+type throttledLine struct {
+	bucket     *tokenBucket
+	suppressed int
+	seen       bool // Since the last summary
+}
+
+// allow records an occurrence of the line with key and reports whether it
+// should be logged
+func (t *logThrottle) allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	line, ok := t.lines[key]
+	if !ok {
+		if len(t.lines) >= maxThrottledLines {
+			return true
+		}
+		line = &throttledLine{bucket: newTokenBucket(1/logSummaryInterval.Seconds(), logRepeatBurst)}
+		t.lines[key] = line
+	}
+	line.seen = true
+	if line.bucket.allow(1) {
+		return true
+	}
+	line.suppressed++
+	return false
+}
+
+// summarize returns "N more occurrences" lines for the suppressed repeats
+// since the last call, and forgets lines not seen in the meantime
+func (t *logThrottle) summarize() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var summaries []string
+	for key, line := range t.lines {
+		if line.suppressed > 0 {
+			summaries = append(summaries, fmt.Sprintf("%d more occurrences of: %s", line.suppressed, key))
+			line.suppressed = 0
+		} else if !line.seen {
+			delete(t.lines, key)
+		}
+		line.seen = false
+	}
+	sort.Strings(summaries)
+	return summaries
+}
+
+// throttleKey is line without its trace ID, so that one error repeated on
+// different messages counts as identical
+func throttleKey(line string) string {
+	i := strings.Index(line, " [trace ")
+	if i < 0 {
+		return line
+	}
+	j := strings.IndexByte(line[i:], ']')
+	if j < 0 {
+		return line
+	}
+	return line[:i] + line[i+j+1:]
+}
+
+// ack is the reduced response sent instead of the full message in AckOnly mode
+type ack struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	TraceID string    `json:"trace_id,omitempty"`
+}
+
+// Handler processes a message of a registered type and returns the response.
+// The context is cancelled when the connection closes or the invocation is
+// cancelled through the cancel_inflight admin command.
+// A handler returning ErrNoResponse sends nothing back, for fire-and-forget
+// message types.
+type Handler func(ctx context.Context, msg Message) (Message, error)
+
+// Publisher publishes processed messages to an external message queue such
+// as Kafka, NATS or Redis Streams; see Config.Publisher. Publish is called
+// from the connection's read loop, so a slow publisher delays that client.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, msg Message) error
+}
+
+// MetricsSink pushes metrics to a collector such as a Prometheus
+// Pushgateway or StatsD; see Config.MetricsSink. A failed push is logged and
+// its snapshot is not retried.
+type MetricsSink interface {
+	Push(ctx context.Context, snap MetricsSnapshot) error
+}
+
+// ErrNoResponse is returned by a Handler to send no response to the client
+var ErrNoResponse = errors.New("no response")
+
+// InflightCall describes a handler invocation that has not returned yet
+type InflightCall struct {
+	ID        string    `json:"id"`
+	ConnID    string    `json:"conn_id"`
+	MessageID string    `json:"message_id"`
+	Type      string    `json:"type"`
+	StartedAt time.Time `json:"started_at"`
+
+	cancel context.CancelFunc
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// total returns the bytes transferred in both directions
+func (c *countingConn) total() uint64 {
+	return c.read.Load() + c.written.Load()
+}
+
+// writeRetryBackoff is the pause before the first write retry; it doubles
+// with each further attempt
+const writeRetryBackoff = 10 * time.Millisecond
+
+// retryConn gives each write attempt a WriteTimeout deadline and retries
+// attempts that time out; see Config.WriteRetries
+type retryConn struct {
+	net.Conn
+	retries  int
+	timeout  time.Duration
+	logf     func(format string, args ...interface{})
+	deadline atomic.Int64 // UnixNano of a SetWriteDeadline cap; 0 for none
+}
+
+// SetWriteDeadline caps the deadline of later write attempts at t, so a
+// short caller deadline, such as the close notice's, still holds; a zero t
+// removes the cap
+func (c *retryConn) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.deadline.Store(0)
+	} else {
+		c.deadline.Store(t.UnixNano())
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// attemptDeadline returns the deadline for a write attempt starting now
+func (c *retryConn) attemptDeadline() time.Time {
+	d := time.Now().Add(c.timeout)
+	if limit := c.deadline.Load(); limit != 0 && limit < d.UnixNano() {
+		return time.Unix(0, limit)
+	}
+	return d
+}
+
+func (c *retryConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(c.attemptDeadline()); err != nil {
+		return 0, err
+	}
+	written := 0
+	backoff := writeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		n, err := c.Conn.Write(p[written:])
+		written += n
+		var netErr net.Error
+		if err == nil || attempt == c.retries || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return written, err
+		}
+		c.logf("Write to %s timed out after %d of %d bytes; retrying in %v", peerAddr(c.Conn), written, len(p), backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		deadline := c.attemptDeadline()
+		if !deadline.After(time.Now()) {
+			return written, err // The caller's cap has passed
+		}
+		if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+			return written, err
+		}
+	}
+}
+
+// clientConn is the registry entry for a client connection
+type clientConn struct {
+	id          string
+	conn        net.Conn
+	remoteAddr  string
+	connectedAt time.Time
+	done        chan struct{}   // Closed when the connection handler exits
+	ctx         context.Context // Cancelled when the connection closes
+
+	serveMutex sync.Mutex // Serializes message processing with Inject
+
+	writeMutex sync.Mutex         // Serializes writes from the read loop and Request
+	encoder    messageEncoder     // Replaced under writeMutex once a sniffed codec is known
+	out        io.Writer          // What encoder writes to; for ArrayStream
+	compressor *messageCompressor // "message" compression; its level changes under writeMutex
+	timeFormat string
+	utf8Mode   string // Config.InvalidUTF8
+
+	pendingMutex sync.Mutex
+	pending      map[string]chan Message // Outstanding Requests by correlation ID
+
+	stopReason atomic.Pointer[closeReason] // Why the read loop was asked to stop
+	draining   atomic.Bool                 // Reject new messages; set by DrainTag
+	identity   atomic.Pointer[string]      // Set once the auth message succeeds
+	session    string                      // Idempotency scope; read loop only
+
+	quarantinedUntil atomic.Int64 // UnixNano; messages are refused until then
+
+	// Broadcast queue, drained by a writer goroutine started on first use
+	outbound     chan outboundMessage
+	outboundOnce sync.Once
+	outboundLeft atomic.Int64 // Queued or being sent; DrainBroadcasts waits for zero
+
+	traceMutex   sync.Mutex
+	trace        []TraceEntry // Ring of TraceBufferSize entries; see ConnTrace
+	traceNext    int          // Index the next entry is written to
+	sendLimiter  *tokenBucket // Paces the writer; nil when unlimited
+	dropped      atomic.Uint64
+	lastActivity atomic.Int64                          // UnixNano of the last message received
+	messages     atomic.Uint64                         // Messages received
+	counter      *countingConn                         // Counts the connection's traffic
+	gzipped      atomic.Bool                           // DetectGzip found a gzip stream
+	errorsSent   atomic.Uint64                         // Error responses sent
+	tx           *Transaction                          // Open transaction; guarded by serveMutex
+	replay       []Message                             // Rejected by an open breaker; guarded by serveMutex
+	overQuota    atomic.Bool                           // Sent quota_exceeded for MaxConnBytes
+	credits      int                                   // FlowControlWindow credits the client holds; read loop only
+	msgLimiter   *tokenBucket                          // MessagesPerSecond; nil when unlimited
+	version      atomic.Pointer[string]                // Negotiated protocol version
+	byteLimiter  *tokenBucket                          // BytesPerSecond; nil when unlimited
+	bytesMetered uint64                                // counter.read already charged to byteLimiter; read loop only
+	owedCredits  int                                   // Spent credits whose handlers have finished; read loop only
+	workSeen     atomic.Bool                           // A message other than ping was received
+	declared     atomic.Pointer[map[string]typeSchema] // From hello; see EnableTypeDeclarations
+	noResponse   atomic.Bool                           // Send-only client; see AllowNoResponse
+
+	// Hijack state. The decoder and batch are those of the read loop, which
+	// Hijack may use only while the loop is parked in a handler.
+	hijackMutex sync.Mutex
+	hijackReq   chan net.Conn // Set by Hijack while waiting for the read loop
+	loopParked  bool
+	decoder     messageDecoder
+	batch       *batchWriter
+	hijacked    atomic.Bool // The conn belongs to a Hijack caller; set under writeMutex
+
+	firstMessageTimer *time.Timer // PostHandshakeIdleTimeout; read loop only
+
+	tagMutex sync.Mutex
+	tags     map[string]struct{}
+
+	topicMutex sync.Mutex
+	topics     map[string]struct{} // Subscriptions; see EnableSubscriptions
+}
+
+// Age returns how long the connection has been open
+func (c *clientConn) Age() time.Duration {
+	return time.Since(c.connectedAt)
+}
+
+// closeReason is why the server closed a connection: code is sent to the
+// client in the close notice, message is also logged
+type closeReason struct {
+	code, message string
+}
+
+// stop asks the read loop to exit once the response in progress has been
+// sent. Only the first reason is kept.
+func (c *clientConn) stop(code, message string) {
+	if c.hijacked.Load() {
+		return // No longer ours to stop
+	}
+	c.stopReason.CompareAndSwap(nil, &closeReason{code: code, message: message})
+	c.conn.SetReadDeadline(time.Now()) // Unblock a pending Decode
+}
+
+// ConnContext lets a handler adjust the connection its message arrived on;
+// get it with ConnContextFrom
+type ConnContext struct {
+	cc     *clientConn
+	s      *Server
+	stream *ArrayStream // The latest StreamArray of the handler call, if any
+}
+
+type connContextKey struct{}
+
+// ConnContextFrom returns the connection of the message a handler is
+// processing
+func ConnContextFrom(ctx context.Context) (*ConnContext, bool) {
+	c, ok := ctx.Value(connContextKey{}).(*ConnContext)
+	return c, ok
+}
+
+// ID returns the connection ID
+func (c *ConnContext) ID() string {
+	return c.cc.id
+}
+
+// SetReadDeadline sets the deadline for the server's subsequent reads from
+// the connection, e.g. to allow a slow next message; a zero t removes it.
+// It never overrides the server stopping or hijacking the read loop, which
+// also use the read deadline.
+func (c *ConnContext) SetReadDeadline(t time.Time) error {
+	if c.cc.hijacked.Load() {
+		return ErrConnHijacked
+	}
+	if err := c.cc.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	// stop and Hijack record their request before setting the deadline, so
+	// checking afterwards catches one that raced with the call above
+	if c.cc.stopReason.Load() != nil || c.cc.hijackRequest() != nil {
+		return c.cc.conn.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for subsequent writes to the
+// connection, including responses still buffered; a zero t removes it
+func (c *ConnContext) SetWriteDeadline(t time.Time) error {
+	if c.cc.hijacked.Load() {
+		return ErrConnHijacked
+	}
+	return c.cc.counter.SetWriteDeadline(t)
+}
+
+// ArrayStream writes a response whose payload.items is a JSON array, one
+// element at a time, so a handler can return a large result set without
+// building it in memory. Get one with ConnContext.StreamArray.
+type ArrayStream struct {
+	cc         *clientConn
+	w          *bufio.Writer
+	buf        bytes.Buffer
+	enc        *json.Encoder // Encodes elements into buf
+	n          int
+	flushEvery int
+	err        error // Sticky; the stream is unusable once a write fails
+	closed     bool
+}
+
+// StreamArray starts a response to msg and holds the connection's writes
+// until Close, so other responses and broadcasts wait behind the stream.
+// The stream is the handler's response: once the handler has started one,
+// what it returns is not sent, and a stream it leaves open when it returns
+// or panics is closed by the server. Only one stream may be open at a time.
+// Streaming needs the JSON codec and is not supported with per-message
+// compression, which compresses each message in one piece.
+func (c *ConnContext) StreamArray(msg Message) (*ArrayStream, error) {
+	if c.stream != nil && !c.stream.closed {
+		return nil, errors.New("an array stream is already open") // Its writeMutex would deadlock us
+	}
+	cc, cfg := c.cc, &c.s.config
+	cc.writeMutex.Lock()
+	_, isJSON := cc.encoder.(*json.Encoder)
+	switch {
+	case cc.hijacked.Load():
+		cc.writeMutex.Unlock()
+		return nil, ErrConnHijacked
+	case cc.noResponse.Load():
+		cc.writeMutex.Unlock()
+		return nil, ErrSendOnly
+	case !isJSON || cfg.Compression == "message":
+		cc.writeMutex.Unlock()
+		return nil, errors.New("streaming responses need the json codec without per-message compression")
+	}
+
+	a := &ArrayStream{cc: cc, w: bufio.NewWriter(cc.out), flushEvery: cfg.StreamFlushElements}
+	a.enc = json.NewEncoder(&a.buf)
+	head, err := json.Marshal(struct {
+		Type    string   `json:"type"`
+		ID      string   `json:"id"`
+		TraceID string   `json:"trace_id,omitempty"`
+		Time    wireTime `json:"time"`
+	}{msg.Type, msg.ID, msg.TraceID, wireTime{time.Now(), cc.timeFormat}})
+	if err != nil {
+		cc.writeMutex.Unlock()
+		return nil, err
+	}
+	a.w.Write(head[:len(head)-1]) // Reopen the object for the payload
+	a.w.WriteString(`,"payload":{"items":[`)
+	c.stream = a
+	return a, nil
+}
+
+// endStream closes a stream the handler left open, releasing the
+// connection's writes, and reports whether the handler streamed a response
+func (c *ConnContext) endStream(msg Message) bool {
+	if c.stream == nil {
+		return false
+	}
+	if !c.stream.closed {
+		c.s.logger.Printf("Warning: handler for %q on %s left its array stream open after %d elements; closing it (message %s) [trace %s]",
+			msg.Type, c.cc.id, c.stream.n, msg.ID, msg.TraceID)
+		if err := c.stream.Close(); err != nil {
+			c.s.logErrorf("Error closing array stream to %s [trace %s]: %v", c.cc.remoteAddr, msg.TraceID, err)
+		}
+	}
+	return true
+}
+
+// Append writes v as the next element of the array
+func (a *ArrayStream) Append(v interface{}) error {
+	if a.closed {
+		return errors.New("array stream is closed")
+	}
+	if a.err != nil {
+		return a.err
+	}
+	a.buf.Reset()
+	if err := a.enc.Encode(v); err != nil {
+		return err // Nothing written; the stream is still usable
+	}
+	if a.n > 0 {
+		a.w.WriteByte(',')
+	}
+	a.w.Write(bytes.TrimSuffix(a.buf.Bytes(), []byte("\n")))
+	a.n++
+	if a.n%a.flushEvery == 0 {
+		a.err = a.flush()
+	}
+	return a.err
+}
+
+// Close ends the array and the response, flushes it to the client and
+// releases the connection's writes. It must be called even after an error.
+func (a *ArrayStream) Close() error {
+	if a.closed {
+		return a.err
+	}
+	a.closed = true
+	defer a.cc.writeMutex.Unlock()
+	if a.err == nil {
+		a.w.WriteString("]}}\n")
+		a.err = a.flush()
+	}
+	return a.err
+}
+
+// flush pushes buffered elements through to the connection, including a
+// WriteBufferSize batch
+func (a *ArrayStream) flush() error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if a.cc.batch != nil {
+		return a.cc.batch.Flush()
+	}
+	return nil
+}
+
+// startFirstMessageTimer begins the post-handshake grace period
+func (s *Server) startFirstMessageTimer(cc *clientConn) {
+	if s.config.PostHandshakeIdleTimeout <= 0 {
+		return
+	}
+	timeout := s.config.PostHandshakeIdleTimeout
+	cc.firstMessageTimer = time.AfterFunc(timeout, func() {
+		cc.stop("idle_timeout", fmt.Sprintf("no message within %v of handshake", timeout))
+	})
+}
+
+// clearFirstMessageTimer ends the grace period on the first data message
+func (c *clientConn) clearFirstMessageTimer() {
+	if c.firstMessageTimer != nil {
+		c.firstMessageTimer.Stop()
+		c.firstMessageTimer = nil
+	}
+}
+
+// quarantined reports whether the connection is currently quarantined
+func (c *clientConn) quarantined() bool {
+	until := c.quarantinedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// protocolVersion returns the negotiated protocol version, or "" before
+// negotiation
+func (c *clientConn) protocolVersion() string {
+	if v := c.version.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// identityName returns the authenticated identity, or "" before auth
+func (c *clientConn) identityName() string {
+	if id := c.identity.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+// send encodes v to the client; safe for concurrent use
+func (c *clientConn) send(v interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.hijacked.Load() {
+		return ErrConnHijacked
+	}
+	if c.noResponse.Load() {
+		return nil // The client never reads; see AllowNoResponse
+	}
+	if m, ok := v.(Message); ok {
+		if m.Type == "error" {
+			c.errorsSent.Add(1)
+		}
+		if c.utf8Mode != "" && hasInvalidUTF8(m.Payload) {
+			m.Payload = sanitizePayload(m.Payload, c.utf8Mode)
+			v = m
+		}
+	}
+	return c.encoder.Encode(toWire(v, c.timeFormat))
+}
+
+// deliverReply hands msg to the Request waiting on its correlation ID and
+// reports whether one was waiting
+func (c *clientConn) deliverReply(msg Message) bool {
+	if msg.CorrelationID == "" {
+		return false
+	}
+	c.pendingMutex.Lock()
+	reply, ok := c.pending[msg.CorrelationID]
+	delete(c.pending, msg.CorrelationID)
+	c.pendingMutex.Unlock()
+	if ok {
+		reply <- msg // Buffered; each channel receives at most one reply
+	}
+	return ok
+}
+
+// addTags attaches tags to the connection
+func (c *clientConn) addTags(tags ...string) {
+	c.tagMutex.Lock()
+	defer c.tagMutex.Unlock()
+	if c.tags == nil {
+		c.tags = make(map[string]struct{}, len(tags))
+	}
+	for _, tag := range tags {
+		c.tags[tag] = struct{}{}
+	}
+}
+
+// hasTag reports whether the connection carries tag
+func (c *clientConn) hasTag(tag string) bool {
+	c.tagMutex.Lock()
+	defer c.tagMutex.Unlock()
+	_, ok := c.tags[tag]
+	return ok
+}
+
+// tagList returns the connection's tags in sorted order
+func (c *clientConn) tagList() []string {
+	c.tagMutex.Lock()
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	c.tagMutex.Unlock()
+	sort.Strings(tags)
+	return tags
+}
+
+// ConnInfo describes a tracked connection for operators
+type ConnInfo struct {
+	ID           string    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	AgeSeconds   float64   `json:"age_seconds"`
+	IdleSeconds  float64   `json:"idle_seconds"`
+	TLS          bool      `json:"tls"`
+	Tags         []string  `json:"tags,omitempty"`
+	Identity     string    `json:"identity,omitempty"`
+	Messages     uint64    `json:"messages"`
+	Version      string    `json:"protocol_version,omitempty"`
+	PingOnly     bool      `json:"ping_only"` // Nothing but pings received so far
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+}
+
+// EventType identifies a server lifecycle event
+type EventType int
+
+const (
+	ServerStarted EventType = iota + 1
+	ConnAccepted
+	ConnClosed
+	DrainStarted
+	ShutdownComplete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ServerStarted:
+		return "ServerStarted"
+	case ConnAccepted:
+		return "ConnAccepted"
+	case ConnClosed:
+		return "ConnClosed"
+	case DrainStarted:
+		return "DrainStarted"
+	case ShutdownComplete:
+		return "ShutdownComplete"
+	default:
+		return "EventType(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+// Event is delivered to subscribers registered with Subscribe
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	ConnID     string // Set for connection events
+	RemoteAddr string // Set for connection events
+}
+
+// eventBufferSize bounds queued events; further events are dropped rather
+// than blocking the connection path
+const eventBufferSize = 1024
+
+// eventBus delivers events to subscribers asynchronously, in order, from a
+// single goroutine started by the first Subscribe
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[uint64]func(Event)
+	nextID      uint64
+	active      atomic.Bool // A subscriber exists; checked by emit
+	events      chan Event
+	dropped     atomic.Uint64
+	start       sync.Once
+}
+
+// Server handles all client connections and message processing
+type Server struct {
+	config    Config
+	listener  net.Listener
+	connMutex sync.RWMutex
+	conns     map[net.Conn]*clientConn
+	connsByID map[string]*clientConn
+	liveIDs   sync.Map     // Mirror of connsByID's keys for IsConnected
+	liveCount atomic.Int64 // len(conns), kept in step under connMutex for lock-free reads
+	closing   bool         // Set by Shutdown under connMutex; no new registrations
+	shutdown  chan struct{}
+	logger    *log.Logger
+	connSem   chan struct{}   // Semaphore for connection limiting
+	hsSem     chan struct{}   // Semaphore for TLS handshakes; nil when unlimited
+	ctx       context.Context // Cancelled by Shutdown
+	dict      []byte          // Preset compression dictionary, loaded by Start
+	cancel    context.CancelFunc
+	connSeq   atomic.Uint64
+
+	goroutines atomic.Int64 // Last sampled runtime.NumGoroutine
+
+	pendingFirst atomic.Int64 // Accepted connections yet to send a message
+
+	requestSeq atomic.Uint64 // Correlation IDs for server-initiated requests
+
+	// handlers is replaced wholesale, never mutated, so each dispatch sees a
+	// consistent routing table; handlersMutex serializes writers
+	handlers      atomic.Pointer[map[string]Handler]
+	transforms    atomic.Pointer[map[string]func(*Message)]       // Echo-path tweaks by type; see RegisterTransform
+	filter        atomic.Pointer[func(ConnContext, Message) bool] // See SetFilter
+	pausedTypes   sync.Map                                        // Message type to struct{}; see PauseType
+	breakers      sync.Map                                        // Message type to *circuitBreaker; see BreakerThreshold
+	handlerInfo   map[string]HandlerInfo                          // Set by HandleWithInfo; guarded by handlersMutex
+	handlersMutex sync.Mutex
+
+	inflightMutex sync.Mutex
+	inflight      map[string]*InflightCall
+	inflightSeq   atomic.Uint64
+
+	bus eventBus
+
+	idemMutex sync.Mutex
+	idemCache map[string]idempotentResult // By session and idempotency key
+
+	acceptLoops sync.WaitGroup
+
+	// PauseAccept state; resumeAccept is closed by ResumeAccept
+	acceptPaused atomic.Bool
+	pauseMutex   sync.Mutex
+	resumeAccept chan struct{}
+
+	errorLog logThrottle     // See logErrorf
+	backlog  shutdownBacklog // See ShutdownBacklog
+	debugLog atomic.Bool     // Log level is debug; see SetLogLevel
+
+	metrics       serverMetrics
+	metricsServer *http.Server     // Nil unless MetricsAddr is set
+	components    []namedComponent // Started by Start, stopped by Shutdown; see AddComponent
+
+	eventLog *eventLog // Nil unless EventLogFile is set
+
+	metricsPushDone chan struct{} // Closed when pushMetrics returns; nil without a MetricsSink
+
+	bufferedBytes atomic.Int64 // Queued broadcast bytes; see MaxBufferedBytes
+
+	sourceQuotas map[string]*sourceQuota // By Source; fixed by NewServer
+
+	startedAt time.Time   // Set by Start
+	warmingUp atomic.Bool // From Start until MarkReady; see WarmupDuration
+}
+
+// sourceQuota counts one Source's messages in fixed SourceQuotaWindow
+// windows
+type sourceQuota struct {
+	limit int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	inWindow    int
+	total       uint64
+}
+
+// idempotentResult is a cached response for an idempotency key
+type idempotentResult struct {
+	resp    Message
+	noReply bool // The handler returned ErrNoResponse
+	expires time.Time
+}
+
+// NewServer creates and initializes a new server instance
+func NewServer(config Config) *Server {
+	if config.MaxConnFDFraction > 0 {
+		config.MaxConnections = fdFractionLimit(config.MaxConnections, config.MaxConnFDFraction)
+	}
+	s := &Server{
+		config:    config,
+		conns:     make(map[net.Conn]*clientConn),
+		connsByID: make(map[string]*clientConn),
+		shutdown:  make(chan struct{}),
+		logger:    log.New(os.Stdout, "[SERVER] ", log.LstdFlags|log.Lmicroseconds),
+		connSem:   make(chan struct{}, max(config.MaxConnections, 0)), // Validated in Start
+		inflight:  make(map[string]*InflightCall),
+		idemCache: make(map[string]idempotentResult),
+		errorLog:  logThrottle{lines: make(map[string]*throttledLine)},
+		metrics: serverMetrics{
+			connDuration:    newHistogram(connDurationBuckets...),
+			messageDuration: newHistogram(messageDurationBuckets...),
+		},
+	}
+	if len(config.SourceQuota) > 0 {
+		s.sourceQuotas = make(map[string]*sourceQuota, len(config.SourceQuota))
+		for source, limit := range config.SourceQuota {
+			s.sourceQuotas[source] = &sourceQuota{limit: limit}
+		}
+	}
+	if len(config.ProtocolVersions) > 0 {
+		s.metrics.byVersion = map[string]*versionCounters{"none": {}}
+		for _, v := range config.ProtocolVersions {
+			s.metrics.byVersion[v] = &versionCounters{}
+		}
+	}
+	if config.MaxConcurrentHandshakes > 0 {
+		s.hsSem = make(chan struct{}, config.MaxConcurrentHandshakes)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.handlers.Store(&map[string]Handler{})
+	s.transforms.Store(&map[string]func(*Message){})
+	s.debugLog.Store(config.LogLevel == "debug")
+	return s
+}
+
+// Subscribe registers fn to receive lifecycle events. Events are delivered
+// asynchronously and in order on a dedicated goroutine, so a slow subscriber
+// delays later events but never the server; if the queue fills, events are
+// dropped. The returned function removes the subscription.
+func (s *Server) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b := &s.bus
+	b.start.Do(func() {
+		b.events = make(chan Event, eventBufferSize)
+		go s.dispatchEvents()
+	})
+
+	b.mu.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[uint64]func(Event))
+	}
+	b.nextID++
+	id := b.nextID
+	b.subscribers[id] = fn
+	b.active.Store(true)
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.active.Store(len(b.subscribers) > 0)
+		b.mu.Unlock()
+	}
+}
+
+// emit queues an event without blocking
+func (s *Server) emit(t EventType, cc *clientConn) {
+	b := &s.bus
+	if !b.active.Load() {
+		return
+	}
+	ev := Event{Type: t, Time: time.Now()}
+	if cc != nil {
+		ev.ConnID, ev.RemoteAddr = cc.id, cc.remoteAddr
+	}
+	select {
+	case b.events <- ev:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// dispatchEvents delivers queued events until ShutdownComplete
+func (s *Server) dispatchEvents() {
+	b := &s.bus
+	for ev := range b.events {
+		b.mu.Lock()
+		subscribers := make([]func(Event), 0, len(b.subscribers))
+		for _, fn := range b.subscribers {
+			subscribers = append(subscribers, fn)
+		}
+		b.mu.Unlock()
+
+		for _, fn := range subscribers {
+			s.deliverEvent(fn, ev)
+		}
+		if ev.Type == ShutdownComplete {
+			if n := b.dropped.Load(); n > 0 {
+				s.logger.Printf("Dropped %d lifecycle events: subscribers too slow", n)
+			}
+			return
+		}
+	}
+}
+
+// deliverEvent calls a subscriber, containing any panic it raises
+func (s *Server) deliverEvent(fn func(Event), ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Printf("Event subscriber panicked on %v: %v", ev.Type, r)
+		}
+	}()
+	fn(ev)
+}
+
+// eventLog appends events to EventLogFile and tracks whether the file can
+// still be written
+type eventLog struct {
+	path string
+
+	mu     sync.Mutex
+	f      *os.File
+	err    error         // Last write or probe failure; nil while healthy
+	closed chan struct{} // Closed once ShutdownComplete is written
+}
+
+// eventLogFlushTimeout bounds how long Shutdown waits for the event log to
+// record ShutdownComplete
+const eventLogFlushTimeout = time.Second
+
+// openEventLog opens path for appending, creating it if needed
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{path: path, f: f, closed: make(chan struct{})}, nil
+}
+
+// write appends ev as a JSON line
+func (l *eventLog) write(ev Event) error {
+	line, err := json.Marshal(struct {
+		Type       string    `json:"type"`
+		Time       time.Time `json:"time"`
+		ConnID     string    `json:"conn_id,omitempty"`
+		RemoteAddr string    `json:"remote_addr,omitempty"`
+	}{ev.Type.String(), ev.Time, ev.ConnID, ev.RemoteAddr})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		l.err = err
+		return err
+	}
+	return nil
+}
+
+// probe checks that the log's directory still accepts new data, since an
+// open descriptor can outlive a permission change, and records the result.
+// A failed write stays recorded until a probe succeeds.
+func (l *eventLog) probe() error {
+	err := func() error {
+		f, err := os.CreateTemp(filepath.Dir(l.path), ".eventlog-probe-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err == nil {
+		l.mu.Lock()
+		err = l.f.Sync()
+		l.mu.Unlock()
+	}
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	return err
+}
+
+// health returns the last recorded failure, or nil
+func (l *eventLog) health() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *eventLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// startEventLog opens EventLogFile, subscribes it to the event bus and
+// starts the periodic health probe
+func (s *Server) startEventLog() error {
+	l, err := openEventLog(s.config.EventLogFile)
+	if err != nil {
+		return err
+	}
+	if err := l.probe(); err != nil {
+		l.close()
+		return err
+	}
+	s.eventLog = l
+	s.Subscribe(func(ev Event) {
+		if err := l.write(ev); err != nil {
+			s.logErrorf("Error writing event log %s: %v", l.path, err)
+		}
+		if ev.Type == ShutdownComplete {
+			l.close()
+			close(l.closed)
+		}
+	})
+	go s.checkEventLog()
+	return nil
+}
+
+// checkEventLog probes the event log every EventLogCheckInterval, logging
+// each change in its health
+func (s *Server) checkEventLog() {
+	ticker := time.NewTicker(s.config.EventLogCheckInterval)
+	defer ticker.Stop()
+	healthy := true
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			err := s.eventLog.probe()
+			if err != nil && healthy {
+				s.logger.Printf("Event log %s is unavailable, rejecting new connections: %v", s.eventLog.path, err)
+			} else if err == nil && !healthy {
+				s.logger.Printf("Event log %s is available again", s.eventLog.path)
+			}
+			healthy = err == nil
+		}
+	}
+}
+
+// Ready reports whether the server should receive new connections: it is
+// not shutting down or warming up, and EventLogFile, when set, is writable
+func (s *Server) Ready() error {
+	select {
+	case <-s.shutdown:
+		return errors.New("server is shutting down")
+	default:
+	}
+	if s.warmingUp.Load() {
+		return errors.New("server is warming up")
+	}
+	if s.eventLog != nil {
+		if err := s.eventLog.health(); err != nil {
+			return fmt.Errorf("event log unavailable: %w", err)
+		}
+	}
+	return nil
+}
+
+// MarkReady ends the warmup begun by Start when WarmupDuration or
+// AwaitMarkReady is set, so the server accepts connections. Calling it
+// again, or without a warmup, does nothing.
+func (s *Server) MarkReady() {
+	if s.warmingUp.CompareAndSwap(true, false) {
+		s.logger.Printf("Warmup complete after %v; accepting connections", time.Since(s.startedAt).Round(time.Millisecond))
+	}
+}
+
+// Handle registers a handler for a message type. Messages without a
+// registered handler are echoed back. It is safe to call while serving.
+func (s *Server) Handle(msgType string, h Handler) {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	delete(s.handlerInfo, msgType) // Described the handler being replaced
+	s.handleLocked(msgType, h)
+}
+
+// HandlerInfo describes a registered handler for clients discovering what
+// the server accepts; see HandleWithInfo
+type HandlerInfo struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"` // Of the payload, e.g. a JSON Schema
+}
+
+// HandleWithInfo is Handle with a description and optional payload schema,
+// reported by Handlers and the built-in describe message
+func (s *Server) HandleWithInfo(info HandlerInfo, h Handler) {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	if s.handlerInfo == nil {
+		s.handlerInfo = make(map[string]HandlerInfo)
+	}
+	s.handlerInfo[info.Type] = info
+	s.handleLocked(info.Type, h)
+}
+
+// Handlers returns the registered message types, sorted, with the
+// description and schema of those registered by HandleWithInfo
+func (s *Server) Handlers() []HandlerInfo {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	current := *s.handlers.Load()
+	infos := make([]HandlerInfo, 0, len(current))
+	for t := range current {
+		info, ok := s.handlerInfo[t]
+		if !ok {
+			info = HandlerInfo{Type: t}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Type < infos[j].Type })
+	return infos
+}
+
+// handleLocked registers h; the caller holds handlersMutex
+func (s *Server) handleLocked(msgType string, h Handler) {
+	current := *s.handlers.Load()
+	next := make(map[string]Handler, len(current)+1)
+	for t, handler := range current {
+		next[t] = handler
+	}
+	next[msgType] = h
+	s.handlers.Store(&next)
+}
+
+// RegisterTransform registers fn to adjust echoed messages of msgType, for
+// small tweaks such as normalising a field or stamping the payload, without
+// writing a Handler. It runs on the response after the server sets its
+// time, with its own copy of the top-level payload map; nested values are
+// shared with the request and must not be modified in place. Types with a
+// Handler are not echoed, so their transform never runs. It is safe to
+// call while serving, and a nil fn removes the transform.
+func (s *Server) RegisterTransform(msgType string, fn func(*Message)) {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+
+	current := *s.transforms.Load()
+	next := make(map[string]func(*Message), len(current)+1)
+	for t, transform := range current {
+		next[t] = transform
+	}
+	if fn == nil {
+		delete(next, msgType)
+	} else {
+		next[msgType] = fn
+	}
+	s.transforms.Store(&next)
+}
+
+// SetHandlers atomically replaces the whole routing table. Dispatches already
+// running keep the table they started with; the map must not be modified
+// by the caller afterwards. Descriptions from HandleWithInfo are kept for
+// the types the new table still handles.
+func (s *Server) SetHandlers(handlers map[string]Handler) {
+	if handlers == nil {
+		handlers = map[string]Handler{}
+	}
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+	s.handlers.Store(&handlers)
+}
+
+// SetFilter installs fn to vet every message before it is dispatched,
+// including built-in message types, for global policy such as dropping
+// deprecated types. Messages for which fn returns false are dropped, or
+// answered with a filtered error when ReplyFiltered is set. fn runs on the
+// connection's read loop and must be quick. It is safe to call while
+// serving, and a nil fn removes the filter.
+func (s *Server) SetFilter(fn func(ConnContext, Message) bool) {
+	if fn == nil {
+		s.filter.Store(nil)
+		return
+	}
+	s.filter.Store(&fn)
+}
+
+// PauseType rejects messages of msgType on every connection with
+// type_paused until ResumeType, e.g. to contain a misbehaving handler
+// during an incident without stopping the server
+func (s *Server) PauseType(msgType string) {
+	if _, loaded := s.pausedTypes.LoadOrStore(msgType, struct{}{}); !loaded {
+		s.logger.Printf("Paused message type %q", msgType)
+	}
+}
+
+// ResumeType lifts a PauseType
+func (s *Server) ResumeType(msgType string) {
+	if _, loaded := s.pausedTypes.LoadAndDelete(msgType); loaded {
+		s.logger.Printf("Resumed message type %q", msgType)
+	}
+}
+
+// Start begins listening for connections
+func (s *Server) Start() error {
+	if err := s.config.Validate(); err != nil {
+		return err
+	}
+	network, _ := s.config.listenNetwork()
+	if s.config.CompressionDict != "" {
+		dict, err := os.ReadFile(s.config.CompressionDict)
+		if err != nil {
+			return fmt.Errorf("loading compression dictionary: %w", err)
+		}
+		s.dict = dict
+	}
+	listener := s.config.Listener
+	if listener == nil {
+		var err error
+		if listener, err = s.listen(network, ":"+s.config.Port); err != nil {
+			return err
+		}
+	}
+	if s.config.TLSCertFile != "" {
+		certs, err := newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		if s.config.CertReloadInterval > 0 {
+			go s.watchCertificates(certs)
+		}
+		tlsConfig := &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     s.config.nextProtos(),
+		}
+		if s.config.TLSClientCAFile != "" {
+			pem, err := os.ReadFile(s.config.TLSClientCAFile)
+			if err != nil {
+				listener.Close()
+				return fmt.Errorf("loading client CAs: %w", err)
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				listener.Close()
+				return fmt.Errorf("loading client CAs: no certificates in %s", s.config.TLSClientCAFile)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if s.config.Authenticate != nil {
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven // Token auth is the fallback
+			}
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	s.listener = listener
+	s.startedAt = time.Now()
+	if s.config.AwaitMarkReady || s.config.WarmupDuration > 0 {
+		s.warmingUp.Store(true)
+		if s.config.WarmupDuration > 0 {
+			time.AfterFunc(s.config.WarmupDuration, s.MarkReady)
+		}
+	}
+	if s.config.Listener != nil {
+		s.logger.Printf("Server started on %s listener %s", listener.Addr().Network(), listener.Addr())
+	} else {
+		s.logger.Printf("Server started on port %s (%s)", s.config.Port, network)
+	}
+	s.checkFDLimit()
+
+	if s.config.MetricsAddr != "" {
+		s.components = append([]namedComponent{{"metrics listener", metricsComponent{s}}}, s.components...)
+	}
+	// rollback shuts down the first started components and closes the
+	// listener, undoing a Start that fails partway
+	rollback := func(started int) {
+		for j := started - 1; j >= 0; j-- {
+			s.components[j].Shutdown(context.Background())
+		}
+		listener.Close()
+	}
+	for i, c := range s.components {
+		if err := c.Start(); err != nil {
+			rollback(i)
+			return fmt.Errorf("failed to start %s: %w", c.name, err)
+		}
+	}
+	if s.config.EventLogFile != "" {
+		if err := s.startEventLog(); err != nil {
+			rollback(len(s.components))
+			return fmt.Errorf("opening event log: %w", err)
+		}
+	}
+	go s.summarizeErrorLogs()
+	if s.config.MetricsSink != nil {
+		s.metricsPushDone = make(chan struct{})
+		go s.pushMetrics()
+	}
+	if s.config.IdempotencyTTL > 0 {
+		go s.sweepIdempotencyCache()
+	}
+	if s.config.MaxGoroutines > 0 {
+		s.goroutines.Store(int64(runtime.NumGoroutine()))
+		go s.sampleGoroutines()
+	}
+
+	for i := 0; i < max(s.config.AcceptLoops, 1); i++ {
+		s.acceptLoops.Add(1)
+		go s.acceptConnections()
+	}
+	s.emit(ServerStarted, nil)
+	return nil
+}
+
+// pushMetrics pushes to MetricsSink every MetricsPushInterval until
+// Shutdown begins, which makes the final push itself
+func (s *Server) pushMetrics() {
+	defer close(s.metricsPushDone)
+	ticker := time.NewTicker(s.config.MetricsPushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.flushMetrics(s.ctx)
+		}
+	}
+}
+
+// flushMetrics pushes the metrics since the previous push to MetricsSink
+func (s *Server) flushMetrics(ctx context.Context) error {
+	if err := s.config.MetricsSink.Push(ctx, s.SnapshotAndReset()); err != nil {
+		s.logErrorf("Error pushing metrics: %v", err)
+		return err
+	}
+	return nil
+}
+
+// sampleGoroutines refreshes the goroutine count used by MaxGoroutines
+func (s *Server) sampleGoroutines() {
+	ticker := time.NewTicker(goroutineSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.goroutines.Store(int64(runtime.NumGoroutine()))
+		}
+	}
+}
+
+// logErrorf logs an error line, collapsing rapid repeats of an identical line
+// into periodic summaries so a client looping on a bad message cannot flood
+// the log
+func (s *Server) logErrorf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if s.errorLog.allow(throttleKey(line)) {
+		s.logger.Print(line)
+	}
+}
+
+// logDebugf logs a line only while the log level is debug
+func (s *Server) logDebugf(format string, args ...interface{}) {
+	if s.debugLog.Load() {
+		s.logger.Printf("[debug] "+format, args...)
+	}
+}
+
+// parseLogLevel reports whether level is debug, treating "" as info, and
+// whether it is a known level
+func parseLogLevel(level string) (debug, ok bool) {
+	switch level {
+	case "", "info":
+		return false, true
+	case "debug":
+		return true, true
+	}
+	return false, false
+}
+
+// LogLevel returns the current log level, "info" or "debug"
+func (s *Server) LogLevel() string {
+	if s.debugLog.Load() {
+		return "debug"
+	}
+	return "info"
+}
+
+// SetLogLevel changes the log level while the server runs, e.g. to turn on
+// debug logging during an incident; it takes effect for the next line
+func (s *Server) SetLogLevel(level string) error {
+	debug, ok := parseLogLevel(level)
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if s.debugLog.Swap(debug) != debug {
+		s.logger.Printf("Log level set to %s", s.LogLevel())
+	}
+	return nil
+}
+
+// summarizeErrorLogs logs the repeats logErrorf suppressed, every
+// logSummaryInterval until shutdown
+func (s *Server) summarizeErrorLogs() {
+	ticker := time.NewTicker(logSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, summary := range s.errorLog.summarize() {
+				s.logger.Print(summary)
+			}
+		}
+	}
+}
+
+// rejectConnection tells a newly accepted client why it is being turned away
+// and closes the connection. It runs on the accept loop, so the write has a
+// short deadline; TLS connections are closed without a message because
+// writing would first require a full handshake.
+func (s *Server) rejectConnection(conn net.Conn, code, detail string) {
+	defer conn.Close()
+	s.logErrorf("Rejecting connection from %s: %s", peerAddr(conn), code)
+	if _, ok := conn.(*tls.Conn); ok {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	json.NewEncoder(conn).Encode(toWire(errorResponse(Message{}, code, detail), s.config.TimeFormat))
+}
+
+// sendCloseNotice tells a client the server is closing its connection, and
+// why, if it was closed for a policy reason. The write has a short deadline
+// so a client that has stopped reading cannot delay the close.
+func (s *Server) sendCloseNotice(cc *clientConn) {
+	reason := cc.stopReason.Load()
+	if reason == nil || cc.hijacked.Load() {
+		return
+	}
+	cc.counter.SetWriteDeadline(time.Now().Add(closeWriteTimeout)) // Through retryConn, which would otherwise extend it
+	notice := Message{
+		Type:    "close",
+		Payload: map[string]interface{}{"reason": reason.code, "message": reason.message},
+		Time:    time.Now(),
+	}
+	err := cc.send(notice)
+	if err == nil && cc.batch != nil {
+		err = cc.batch.Flush()
+	}
+	if err != nil {
+		s.logger.Printf("Error sending close notice to %s: %v", cc.remoteAddr, err)
+	}
+}
+
+// certReloader serves the current certificate to TLS handshakes and
+// reloads it from disk when the files change
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the two files when loaded
+}
+
+// newCertReloader loads the initial certificate
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reloadIfChanged reloads the key pair if either file is newer than the
+// loaded one. It reports whether a new certificate was loaded; on error the
+// current certificate stays in use.
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watchCertificates polls the certificate files every CertReloadInterval
+func (s *Server) watchCertificates(certs *certReloader) {
+	ticker := time.NewTicker(s.config.CertReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := certs.reloadIfChanged()
+			if err != nil {
+				s.logger.Printf("Error reloading TLS certificate, keeping current one: %v", err)
+			} else if reloaded {
+				s.logger.Printf("Reloaded TLS certificate from %s", certs.certFile)
+			}
+		}
+	}
+}
+
+// listen creates the server listener, honouring ListenBacklog and ReusePort
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	if s.config.ListenBacklog > 0 {
+		if !listenBacklogSupported {
+			s.logger.Printf("Warning: ListenBacklog is not supported on %s; using the system default", runtime.GOOS)
+		}
+		return listenWithBacklog(network, address, s.config.ListenBacklog, s.config.ReusePort)
+	}
+
+	var lc net.ListenConfig
+	if s.config.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// PauseAccept stops taking new connections without closing the listener,
+// for momentary overload relief: new dials queue in the listen backlog
+// until ResumeAccept, while existing connections are unaffected. An Accept
+// already in progress may still complete; that connection is held, not
+// served, until resumed.
+func (s *Server) PauseAccept() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumeAccept == nil {
+		s.resumeAccept = make(chan struct{})
+		s.acceptPaused.Store(true)
+		s.logger.Printf("Accepting paused")
+	}
+}
+
+// ResumeAccept undoes PauseAccept
+func (s *Server) ResumeAccept() {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.resumeAccept != nil {
+		close(s.resumeAccept)
+		s.resumeAccept = nil
+		s.acceptPaused.Store(false)
+		s.logger.Printf("Accepting resumed")
+	}
+}
+
+// awaitResume blocks while accepting is paused. It returns false if the
+// server shuts down first.
+func (s *Server) awaitResume() bool {
+	if !s.acceptPaused.Load() {
+		return true
+	}
+	s.pauseMutex.Lock()
+	resume := s.resumeAccept
+	s.pauseMutex.Unlock()
+	if resume == nil {
+		return true
+	}
+	select {
+	case <-resume:
+		return true
+	case <-s.shutdown:
+		return false
+	}
+}
+
+// acceptConnections handles incoming client connections. AcceptLoops copies
+// run at once; Accept is safe for concurrent use.
+func (s *Server) acceptConnections() {
+	defer s.acceptLoops.Done()
+	for {
+		if !s.awaitResume() {
+			return
+		}
+		select {
+		case <-s.shutdown:
+			return
+		case s.connSem <- struct{}{}: // Acquire semaphore slot
+			conn, err := s.listener.Accept()
+			if err != nil {
+				<-s.connSem // Release semaphore slot on error
+				select {
+				case <-s.shutdown:
+					return
+				default:
+					s.logErrorf("Error accepting connection: %v", err)
+					continue
+				}
+			}
+
+			if !s.awaitResume() { // Hold a connection accepted as PauseAccept was called
+				conn.Close()
+				<-s.connSem
+				return
+			}
+			select {
+			case <-s.shutdown:
+				// Accepted just as Shutdown closed the listener: don't serve it
+				conn.Close()
+				<-s.connSem
+				return
+			default:
+			}
+
+			if s.config.MaxGoroutines > 0 && s.goroutines.Load() >= int64(s.config.MaxGoroutines) {
+				s.rejectConnection(conn, "server_overloaded", "server is overloaded, retry later")
+				<-s.connSem
+				continue
+			}
+			if s.warmingUp.Load() {
+				s.rejectConnection(conn, "not_ready", "server is warming up, retry later")
+				<-s.connSem
+				continue
+			}
+			if s.eventLog != nil && s.eventLog.health() != nil {
+				s.rejectConnection(conn, "persistence_unavailable", "event log is unavailable, retry later")
+				<-s.connSem
+				continue
+			}
+
+			if limit := s.config.MaxPendingFirstMessage; limit > 0 && s.pendingFirst.Load() >= int64(limit) {
+				s.rejectConnection(conn, "server_overloaded", "too many connections awaiting their first message, retry later")
+				<-s.connSem
+				continue
+			}
+
+			s.pendingFirst.Add(1) // Released by handleConnection
+			go s.handleConnection(conn)
+		}
+	}
+}
+
+// prettyPrintJSON formats a map for logging using strings.Builder for efficiency
+func prettyPrintJSON(data map[string]interface{}, indent string) string {
+	var builder strings.Builder
+	for key, value := range data {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			builder.WriteString(fmt.Sprintf("%s%s:\n%s", indent, key, prettyPrintJSON(v, indent+"  ")))
+		case []interface{}:
+			builder.WriteString(fmt.Sprintf("%s%s: [array of %d elements]\n", indent, key, len(v)))
+		default:
+			builder.WriteString(fmt.Sprintf("%s%s: %v\n", indent, key, v))
+		}
+	}
+	return builder.String()
+}
+
+// overByteQuota reports whether cc has used up MaxConnBytes. The first time
+// it has, the client is sent quota_exceeded and the connection is stopped.
+func (s *Server) overByteQuota(cc *clientConn) bool {
+	if s.config.MaxConnBytes <= 0 || cc.counter.total() < uint64(s.config.MaxConnBytes) {
+		return false
+	}
+	if cc.overQuota.CompareAndSwap(false, true) {
+		detail := fmt.Sprintf("connection exceeded its %d-byte quota", s.config.MaxConnBytes)
+		if err := cc.send(errorResponse(Message{}, "quota_exceeded", detail)); err != nil {
+			s.logger.Printf("Error sending quota notice to %s: %v", cc.remoteAddr, err)
+		}
+		s.logger.Printf("Closing connection %s: exceeded MaxConnBytes after %d bytes", cc.id, cc.counter.total())
+		cc.stop("quota_exceeded", "exceeded MaxConnBytes")
+	}
+	return true
+}
+
+// connSummary is the ConnectionSummaryLog record of a closed connection
+type connSummary struct {
+	ID              string    `json:"id"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Identity        string    `json:"identity,omitempty"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesRead       uint64    `json:"bytes_read"`
+	BytesWritten    uint64    `json:"bytes_written"`
+	Messages        uint64    `json:"messages"`
+	Errors          uint64    `json:"errors"`
+	Tags            []string  `json:"tags,omitempty"`
+	CloseReason     string    `json:"close_reason,omitempty"`
+}
+
+// logConnSummary logs the lifetime totals of a closed connection
+func (s *Server) logConnSummary(cc *clientConn) {
+	summary := connSummary{
+		ID:              cc.id,
+		RemoteAddr:      cc.remoteAddr,
+		Identity:        cc.identityName(),
+		ConnectedAt:     cc.connectedAt,
+		DurationSeconds: cc.Age().Seconds(),
+		BytesRead:       cc.counter.read.Load(),
+		BytesWritten:    cc.counter.written.Load(),
+		Messages:        cc.messages.Load(),
+		Errors:          cc.errorsSent.Load(),
+		Tags:            cc.tagList(),
+	}
+	if reason := cc.stopReason.Load(); reason != nil {
+		summary.CloseReason = reason.message
+	}
+	line, err := json.Marshal(summary)
+	if err != nil {
+		s.logger.Printf("Error encoding summary of %s: %v", cc.id, err)
+		return
+	}
+	s.logger.Printf("Connection summary: %s", line)
+}
+
+// checkPayload enforces MaxPayloadKeys and MaxKeyLength on a payload
+func (s *Server) checkPayload(payload map[string]interface{}) error {
+	if s.config.MaxPayloadKeys == 0 && s.config.MaxKeyLength == 0 {
+		return nil
+	}
+	keys := 0
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			keys += len(v)
+			if s.config.MaxPayloadKeys > 0 && keys > s.config.MaxPayloadKeys {
+				return fmt.Errorf("payload has more than %d keys", s.config.MaxPayloadKeys)
+			}
+			for key, elem := range v {
+				if s.config.MaxKeyLength > 0 && len(key) > s.config.MaxKeyLength {
+					return fmt.Errorf("payload key of %d bytes exceeds the %d-byte limit", len(key), s.config.MaxKeyLength)
+				}
+				if err := walk(elem); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, elem := range v {
+				if err := walk(elem); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(payload)
+}
+
+// peerAddr returns the peer address of conn for logs. Connections from a
+// custom Listener may have none.
+func peerAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return "unknown"
+}
+
+// handleConnection processes individual client connections
+func (s *Server) handleConnection(conn net.Conn) {
+	cc := &clientConn{
+		id:          "conn-" + strconv.FormatUint(s.connSeq.Add(1), 10),
+		conn:        conn,
+		remoteAddr:  peerAddr(conn),
+		connectedAt: time.Now(),
+		done:        make(chan struct{}),
+		timeFormat:  s.config.TimeFormat,
+		utf8Mode:    s.config.InvalidUTF8,
+	}
+	cc.lastActivity.Store(cc.connectedAt.UnixNano())
+	pendingFirst := true
+	defer func() {
+		if pendingFirst {
+			s.pendingFirst.Add(-1)
+		}
+		if !cc.hijacked.Load() {
+			conn.Close()
+		}
+		<-s.connSem // Release semaphore slot
+		if s.removeConnection(cc) {
+			s.emit(ConnClosed, cc)
+		}
+		s.logger.Printf("Connection %s from %s closed after %v", cc.id, cc.remoteAddr, cc.Age().Round(time.Millisecond))
+		if s.config.ConnectionSummaryLog && cc.counter != nil {
+			s.logConnSummary(cc)
+		}
+		close(cc.done)
+	}()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the handshake before registering the connection so the
+		// handshake semaphore bounds the expensive part
+		if err := s.handshake(tlsConn); err != nil {
+			s.logger.Printf("TLS handshake with %s failed: %v", cc.remoteAddr, err)
+			return
+		}
+		proto := tlsConn.ConnectionState().NegotiatedProtocol
+		if serve, ok := s.config.ALPNHandlers[proto]; ok {
+			s.logger.Printf("Handing connection %s from %s to the %q handler", cc.id, cc.remoteAddr, proto)
+			cc.hijacked.Store(true) // Its handler closes it
+			// The handler's protocol may never send us a message, so the
+			// connection stops counting against MaxPendingFirstMessage now
+			pendingFirst = false
+			s.pendingFirst.Add(-1)
+			serve(conn)
+			return
+		}
+		if identity, ok := s.certIdentity(tlsConn); ok {
+			cc.identity.Store(&identity)
+			s.logger.Printf("Connection %s authenticated by client certificate as %q", cc.id, identity)
+		}
+	}
+
+	if _, isTLS := conn.(*tls.Conn); s.config.WriteRetries > 0 && !isTLS {
+		writeTimeout := s.config.WriteTimeout
+		if writeTimeout <= 0 {
+			writeTimeout = defaultWriteTimeout
+		}
+		cc.counter = &countingConn{Conn: &retryConn{Conn: conn, retries: s.config.WriteRetries, timeout: writeTimeout, logf: s.logErrorf}}
+	} else {
+		cc.counter = &countingConn{Conn: conn}
+	}
+	var in io.Reader = cc.counter
+	var out io.Writer = cc.counter
+	var batch *batchWriter
+	if s.config.WriteBufferSize > 0 {
+		batch = newBatchWriter(cc.counter, s.config.WriteBufferSize, s.config.MaxFlushLatency)
+		defer batch.Close() // Runs before conn.Close above
+		out = batch
+	}
+	if s.config.Compression == "deflate" {
+		in = flate.NewReaderDict(cc.counter, s.dict)
+		fw, err := flate.NewWriterDict(out, flate.DefaultCompression, s.dict)
+		if err != nil {
+			s.logger.Printf("Error creating compressor for %s: %v", cc.remoteAddr, err)
+			return
+		}
+		out = &flushWriter{fw}
+	}
+	if s.config.Compression == "message" {
+		fw, err := flate.NewWriterDict(io.Discard, flate.DefaultCompression, s.dict)
+		if err != nil {
+			s.logger.Printf("Error creating compressor for %s: %v", cc.remoteAddr, err)
+			return
+		}
+		cc.compressor = &messageCompressor{w: out, minBytes: s.config.CompressMinBytes, fw: fw}
+		out = cc.compressor
+	}
+
+	if s.config.DetectGzip {
+		sw := &switchWriter{w: out}
+		in = &gzipDetector{br: bufio.NewReader(in), onGzip: func() {
+			cc.writeMutex.Lock()
+			sw.w = &flushWriter{gzip.NewWriter(sw.w)}
+			cc.gzipped.Store(true)
+			cc.writeMutex.Unlock()
+			s.logger.Printf("Connection %s is gzip-compressed", cc.id)
+		}}
+		out = sw
+	}
+
+	var decoder messageDecoder
+	decoder, cc.encoder = s.newCodec(s.config.Codec, in, out)
+	if s.config.SniffCodec {
+		decoder = &sniffingDecoder{
+			r:        bufio.NewReader(in),
+			fallback: s.config.Codec,
+			choose: func(codec string, r io.Reader) messageDecoder {
+				dec, enc := s.newCodec(codec, r, out)
+				cc.writeMutex.Lock()
+				cc.encoder = enc
+				cc.writeMutex.Unlock()
+				s.logger.Printf("Connection %s using %s codec", cc.id, codec)
+				return dec
+			},
+		}
+	}
+
+	cc.decoder, cc.batch, cc.out = decoder, batch, out
+	defer s.sendCloseNotice(cc) // Runs before the writers above are closed
+
+	// Cancelled when the connection closes or the server shuts down so
+	// in-flight handlers stop
+	var cancel context.CancelFunc
+	cc.ctx, cancel = context.WithCancel(s.ctx)
+	defer cancel()
+	defer s.awaitOutbound(cc) // Before cancel stops the writer
+
+	if !s.addConnection(cc) {
+		return
+	}
+	s.metrics.connectionsAccepted.Add(1)
+	defer func() {
+		s.metrics.connDuration.Observe(cc.Age().Seconds())
+		if vc := s.versionCounters(cc); vc != nil && cc.version.Load() == nil {
+			vc.connections.Add(1)
+		}
+	}()
+	s.emit(ConnAccepted, cc)
+	if s.config.Authenticate == nil || cc.identity.Load() != nil {
+		s.startFirstMessageTimer(cc) // Otherwise started once auth succeeds
+	}
+	defer cc.clearFirstMessageTimer()
+	connID, remoteAddr := cc.id, cc.remoteAddr
+	s.logger.Printf("New connection %s from: %s", connID, remoteAddr)
+
+	if s.config.MaxConnLifetime > 0 {
+		lifetime := time.AfterFunc(s.config.MaxConnLifetime, func() {
+			cc.stop("max_lifetime", fmt.Sprintf("reached max lifetime %v", s.config.MaxConnLifetime))
+		})
+		defer lifetime.Stop()
+	}
+
+	if s.config.MaxPingOnlyDuration > 0 {
+		pingOnly := time.AfterFunc(s.config.MaxPingOnlyDuration, func() {
+			if !cc.workSeen.Load() {
+				s.metrics.pingOnlyClosed.Add(1)
+				cc.stop("ping_only", fmt.Sprintf("sent only pings for %v", s.config.MaxPingOnlyDuration))
+			}
+		})
+		defer pingOnly.Stop()
+	}
+
+	if s.config.FlowControlWindow > 0 {
+		if err := s.grantCredits(cc, s.config.FlowControlWindow); err != nil {
+			return
+		}
+	}
+
+	if s.config.MessagesPerSecond > 0 {
+		cc.msgLimiter = newTokenBucket(s.config.MessagesPerSecond, int(s.config.MessagesPerSecond))
+	}
+	if s.config.BytesPerSecond > 0 {
+		cc.byteLimiter = newTokenBucket(s.config.BytesPerSecond, int(s.config.BytesPerSecond))
+	}
+
+	ctx := cc.ctx
+	var preAuth []Message // Held under the "queue" PreAuthPolicy
+	for {
+		// Messages are handled one at a time, so every credit spent by now
+		// has been served. Return them once half the window is owed and the
+		// client's earlier input is consumed, so messages it sent before the
+		// grant still count against the old window. A client that has run
+		// out is owed the whole window and is never left waiting.
+		if cc.owedCredits > 0 && cc.owedCredits >= (s.config.FlowControlWindow+1)/2 && !hasBufferedInput(decoder) {
+			if err := s.grantCredits(cc, cc.owedCredits); err != nil {
+				return
+			}
+		}
+		if batch != nil && !hasBufferedInput(decoder) {
+			// Decode is about to block on the client, which may be waiting
+			// for a response still sitting in the batch: send it now
+			if err := batch.Flush(); err != nil {
+				s.logger.Printf("Error flushing responses to %s: %v", remoteAddr, err)
+				return
+			}
+		}
+
+		msg, err := decodeMessage(decoder, s.config.TimeFormat)
+		if err != nil {
+			if hijack := cc.hijackRequest(); hijack != nil {
+				hijack <- s.detach(cc)
+				return
+			}
+			if isUnknownFieldError(err) {
+				// The decoder has consumed the whole value, so the stream
+				// is still in sync: reject this message and carry on
+				s.logErrorf("Rejecting message from %s: %v", remoteAddr, err)
+				if err := cc.send(errorResponse(msg, "strict_decode_error", err.Error())); err != nil {
+					return
+				}
+				continue
+			}
+			if reason := cc.stopReason.Load(); reason != nil {
+				s.logger.Printf("Closing connection %s: %s", connID, reason.message)
+			} else if err.Error() != "EOF" {
+				s.logErrorf("Error decoding message from %s: %v", remoteAddr, err)
+			} else {
+				s.logger.Printf("Connection closed by client: %s", remoteAddr)
+			}
+			return
+		}
+
+		if pendingFirst {
+			pendingFirst = false
+			s.pendingFirst.Add(-1)
+		}
+		cc.lastActivity.Store(time.Now().UnixNano())
+		cc.messages.Add(1)
+		if msg.Type != "ping" {
+			cc.workSeen.Store(true)
+		}
+		s.metrics.messagesReceived.Add(1)
+		if vc := s.versionCounters(cc); vc != nil {
+			vc.messages.Add(1)
+		}
+		if s.overByteQuota(cc) {
+			return
+		}
+		if retryAfter, err := s.throttleInbound(ctx, cc); err != nil {
+			return
+		} else if retryAfter > 0 {
+			if err := cc.send(retryableErrorResponse(msg, "rate_limited", "rate limit exceeded", retryAfter)); err != nil {
+				return
+			}
+			continue
+		}
+
+		if msg.Compressed {
+			inflated, err := s.inflateMessage(msg)
+			if err != nil {
+				s.logErrorf("Bad compressed frame from %s: %v", remoteAddr, err)
+				if err := cc.send(errorResponse(msg, "bad_frame", err.Error())); err != nil {
+					return
+				}
+				continue
+			}
+			msg = inflated
+		}
+		if msg.TraceID == "" {
+			msg.TraceID = newTraceID()
+		}
+
+		if err := s.checkPayload(msg.Payload); err != nil {
+			s.logErrorf("Rejecting message %s from %s [trace %s]: %v", msg.ID, remoteAddr, msg.TraceID, err)
+			if err := cc.send(errorResponse(msg, "payload_limit", err.Error())); err != nil {
+				return
+			}
+			continue
+		}
+
+		if cc.deliverReply(msg) {
+			continue // Reply to a server-initiated Request, not a new message
+		}
+
+		if s.config.FlowControlWindow > 0 {
+			if cc.credits <= 0 {
+				if err := cc.send(errorResponse(msg, "flow_control", "no flow control credit; wait for a window_update")); err != nil {
+					return
+				}
+				continue
+			}
+			cc.credits--
+			cc.owedCredits++ // Returned at the top of the loop, once served
+		}
+
+		if cc.draining.Load() {
+			// The connection is being drained: refuse new work so the client
+			// retries it elsewhere
+			if err := cc.send(errorResponse(msg, "draining", "connection is draining")); err != nil {
+				return
+			}
+			continue
+		}
+
+		if cc.quarantined() {
+			retryAfter := time.Until(time.Unix(0, cc.quarantinedUntil.Load()))
+			if err := cc.send(retryableErrorResponse(msg, "quarantined", "connection is quarantined", retryAfter)); err != nil {
+				return
+			}
+			continue
+		}
+
+		if s.config.Authenticate != nil && cc.identity.Load() == nil {
+			if err := s.handlePreAuth(ctx, cc, msg, &preAuth); err != nil {
+				return
+			}
+			continue
+		}
+
+		if retryAfter, ok := s.chargeSource(msg.Source); !ok {
+			e := &Error{Code: CodeRateLimited, Reason: "quota_exceeded", Retryable: true, RetryAfter: retryAfter,
+				Message: fmt.Sprintf("source %q exceeded its quota of %d messages per %v", msg.Source, s.config.SourceQuota[msg.Source], s.config.SourceQuotaWindow)}
+			if err := cc.send(codedErrorResponse(msg, e)); err != nil {
+				return
+			}
+			continue
+		}
+
+		cc.clearFirstMessageTimer()
+		if err := s.serveFromLoop(ctx, cc, msg); err != nil {
+			return
+		}
+	}
+}
+
+// chargeSource counts a message from source against its SourceQuota. It
+// reports false, with the time left in the window, if the quota is spent.
+func (s *Server) chargeSource(source string) (time.Duration, bool) {
+	q, ok := s.sourceQuotas[source]
+	if !ok {
+		return 0, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Sub(q.windowStart) >= s.config.SourceQuotaWindow {
+		q.windowStart, q.inWindow = now, 0
+	}
+	q.total++
+	if q.inWindow >= q.limit {
+		return q.windowStart.Add(s.config.SourceQuotaWindow).Sub(now), false
+	}
+	q.inWindow++
+	return 0, true
+}
+
+// SourceCounts returns the messages received from each SourceQuota source
+// since the server started, including those refused over quota
+func (s *Server) SourceCounts() map[string]uint64 {
+	counts := make(map[string]uint64, len(s.sourceQuotas))
+	for source, q := range s.sourceQuotas {
+		q.mu.Lock()
+		counts[source] = q.total
+		q.mu.Unlock()
+	}
+	return counts
+}
+
+// throttleInbound charges the message just read to the connection's rate
+// limiters. Under the "throttle" policy it waits out any debt before the
+// read loop continues; under "reject" it returns how long the client should
+// wait instead, or zero if the message is admitted. The byte limiter is
+// charged everything read from the connection since the last message,
+// which is that message's size on the wire.
+func (s *Server) throttleInbound(ctx context.Context, cc *clientConn) (retryAfter time.Duration, err error) {
+	reject := s.config.RateLimitPolicy == "reject"
+	charge := func(b *tokenBucket, n float64) error {
+		if reject {
+			retryAfter = max(retryAfter, b.take(n))
+			return nil
+		}
+		return b.Wait(ctx, n)
+	}
+	if cc.msgLimiter != nil {
+		if err := charge(cc.msgLimiter, 1); err != nil {
+			return 0, err
+		}
+	}
+	if cc.byteLimiter != nil {
+		read := cc.counter.read.Load()
+		n := read - cc.bytesMetered
+		cc.bytesMetered = read
+		if err := charge(cc.byteLimiter, float64(n)); err != nil {
+			return 0, err
+		}
+	}
+	return retryAfter, nil
+}
+
+// grantCredits gives the client n more FlowControlWindow credits with a
+// window_update message
+func (s *Server) grantCredits(cc *clientConn, n int) error {
+	update := Message{
+		Type:    "window_update",
+		Time:    time.Now(),
+		Payload: map[string]interface{}{"credits": n},
+	}
+	if err := cc.send(update); err != nil {
+		s.logErrorf("Error sending window update to %s: %v", cc.remoteAddr, err)
+		return err
+	}
+	cc.credits += n
+	cc.owedCredits = max(cc.owedCredits-n, 0)
+	return nil
+}
+
+// serveFromLoop serves msg from the connection's read loop, marking the loop
+// parked so a Hijack from the handler can take the connection at once. It
+// returns ErrConnHijacked if that happened.
+func (s *Server) serveFromLoop(ctx context.Context, cc *clientConn, msg Message) error {
+	cc.hijackMutex.Lock()
+	cc.loopParked = true
+	cc.hijackMutex.Unlock()
+
+	err := s.serveMessage(ctx, cc, msg)
+
+	cc.hijackMutex.Lock()
+	cc.loopParked = false
+	cc.hijackMutex.Unlock()
+	if cc.hijacked.Load() {
+		return ErrConnHijacked
+	}
+	return err
+}
+
+// nextProtos returns the ALPN protocols to advertise: ALPNProtocol first,
+// then the ALPNHandlers protocols in order
+func (c Config) nextProtos() []string {
+	var protos []string
+	if c.ALPNProtocol != "" {
+		protos = append(protos, c.ALPNProtocol)
+	}
+	others := make([]string, 0, len(c.ALPNHandlers))
+	for proto := range c.ALPNHandlers {
+		others = append(others, proto)
+	}
+	sort.Strings(others)
+	return append(protos, others...)
+}
+
+// handshake runs the TLS handshake, waiting for a slot when
+// MaxConcurrentHandshakes is set. Only the handshake itself is bounded by
+// HandshakeTimeout.
+func (s *Server) handshake(conn *tls.Conn) error {
+	if s.hsSem != nil {
+		select {
+		case s.hsSem <- struct{}{}:
+			defer func() { <-s.hsSem }()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	timeout := s.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
+
+// Transaction groups the messages a client sends between begin and commit.
+// Their handlers run as the messages arrive, find the transaction with
+// TransactionFromContext, and stage side effects with OnCommit: commit runs
+// the staged effects in order, while rollback, a timeout, a failed message
+// or the connection closing discards them.
+type Transaction struct {
+	ID string
+
+	effects []func()
+	size    int
+	failed  bool        // A message in the transaction got an error response
+	timer   *time.Timer // Rolls back at TransactionTimeout
+}
+
+// OnCommit stages fn to run if the transaction commits
+func (t *Transaction) OnCommit(fn func()) {
+	t.effects = append(t.effects, fn)
+}
+
+type txContextKey struct{}
+
+// TransactionFromContext returns the transaction a handler's message is
+// part of, if any
+func TransactionFromContext(ctx context.Context) (*Transaction, bool) {
+	tx, ok := ctx.Value(txContextKey{}).(*Transaction)
+	return tx, ok
+}
+
+// negotiateVersion answers a hello message when one of the options it
+// negotiates is enabled, recording the protocol version, compression level,
+// message types and response mode agreed, and reports whether msg was one
+func (s *Server) negotiateVersion(cc *clientConn, msg Message) (Message, bool) {
+	if msg.Type != "hello" || !s.helloEnabled() {
+		return Message{}, false
+	}
+	payload := make(map[string]interface{})
+	if noResponse, _ := msg.Payload["no_response"].(bool); noResponse && s.config.AllowNoResponse {
+		cc.noResponse.Store(true)
+		s.logger.Printf("Connection %s is send-only; responses will not be written", cc.id)
+		payload["no_response"] = true
+	}
+	if raw, ok := msg.Payload["types"]; ok && s.config.EnableTypeDeclarations {
+		if cc.declared.Load() != nil {
+			return errorResponse(msg, "bad_request", "message types already declared"), true
+		}
+		declared, err := parseTypeDeclarations(raw)
+		if err != nil {
+			return errorResponse(msg, "bad_request", err.Error()), true
+		}
+		cc.declared.Store(&declared)
+		s.logger.Printf("Connection %s declared %d message types", cc.id, len(declared))
+		payload["types"] = len(declared)
+	}
+	if s.config.MaxCompressionLevel > 0 {
+		if requested, ok := msg.Payload["compression_level"]; ok {
+			level, ok := payloadInt(requested)
+			if !ok {
+				return errorResponse(msg, "bad_request", "payload.compression_level must be an integer"), true
+			}
+			level = min(max(level, s.config.MinCompressionLevel), s.config.MaxCompressionLevel)
+			if err := cc.setCompressionLevel(level, s.dict); err != nil {
+				return errorResponse(msg, "bad_request", err.Error()), true
+			}
+			s.logger.Printf("Connection %s using compression level %d", cc.id, level)
+			payload["compression_level"] = level
+		}
+	}
+	if len(s.config.ProtocolVersions) == 0 {
+		return Message{Type: "hello", ID: msg.ID, Time: time.Now(), TraceID: msg.TraceID, Payload: payload}, true
+	}
+
+	if cc.version.Load() != nil {
+		return errorResponse(msg, "version_negotiated", "protocol version already negotiated"), true
+	}
+	offered, _ := msg.Payload["versions"].([]interface{})
+	for _, v := range s.config.ProtocolVersions {
+		for _, o := range offered {
+			if o != v {
+				continue
+			}
+			version := v
+			cc.version.Store(&version)
+			s.metrics.byVersion[version].connections.Add(1)
+			s.logger.Printf("Connection %s negotiated protocol version %s", cc.id, version)
+			payload["version"] = version
+			return Message{Type: "hello", ID: msg.ID, Time: time.Now(), TraceID: msg.TraceID, Payload: payload}, true
+		}
+	}
+	detail := fmt.Sprintf("no common protocol version; server supports %s", strings.Join(s.config.ProtocolVersions, ", "))
+	return errorResponse(msg, "unsupported_version", detail), true
+}
+
+// helloEnabled reports whether any option negotiated by hello is enabled;
+// otherwise hello is an ordinary message type
+func (s *Server) helloEnabled() bool {
+	return len(s.config.ProtocolVersions) > 0 || s.config.MaxCompressionLevel > 0 ||
+		s.config.EnableTypeDeclarations || s.config.AllowNoResponse
+}
+
+// typeSchema is what a client declared about one message type; see
+// EnableTypeDeclarations
+type typeSchema struct {
+	required []string // Payload fields
+}
+
+// parseTypeDeclarations reads the types of a hello payload
+func parseTypeDeclarations(raw interface{}) (map[string]typeSchema, error) {
+	types, ok := raw.(map[string]interface{})
+	if !ok || len(types) == 0 {
+		return nil, errors.New("payload.types must map at least one message type to its schema")
+	}
+	declared := make(map[string]typeSchema, len(types))
+	for msgType, v := range types {
+		var schema typeSchema
+		if v != nil {
+			spec, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("schema of type %q must be an object", msgType)
+			}
+			fields, _ := spec["required"].([]interface{})
+			for _, f := range fields {
+				name, ok := f.(string)
+				if !ok {
+					return nil, fmt.Errorf("required fields of type %q must be strings", msgType)
+				}
+				schema.required = append(schema.required, name)
+			}
+		}
+		declared[msgType] = schema
+	}
+	return declared, nil
+}
+
+// checkDeclared rejects a message the connection's type declarations do not
+// allow, reporting whether it did
+func (s *Server) checkDeclared(cc *clientConn, msg Message) (Message, bool) {
+	declared := cc.declared.Load()
+	if declared == nil || msg.Type == "hello" {
+		return Message{}, false
+	}
+	schema, ok := (*declared)[msg.Type]
+	if !ok {
+		return errorResponse(msg, "undeclared_type", fmt.Sprintf("message type %q was not declared in hello", msg.Type)), true
+	}
+	for _, field := range schema.required {
+		if _, ok := msg.Payload[field]; !ok {
+			return errorResponse(msg, "schema_violation", fmt.Sprintf("message type %q requires payload.%s", msg.Type, field)), true
+		}
+	}
+	return Message{}, false
+}
+
+// subscriptionCommand handles subscribe and unsubscribe when
+// EnableSubscriptions is set, and reports whether msg was one
+func (s *Server) subscriptionCommand(cc *clientConn, msg Message) (Message, bool) {
+	if !s.config.EnableSubscriptions || (msg.Type != "subscribe" && msg.Type != "unsubscribe") {
+		return Message{}, false
+	}
+	topic, _ := msg.Payload["topic"].(string)
+	if topic == "" {
+		return errorResponse(msg, "bad_request", "payload.topic must be a non-empty string"), true
+	}
+
+	cc.topicMutex.Lock()
+	defer cc.topicMutex.Unlock()
+	if msg.Type == "unsubscribe" {
+		delete(cc.topics, topic)
+	} else if _, ok := cc.topics[topic]; !ok {
+		if limit := s.config.MaxTopicsPerConn; limit > 0 && len(cc.topics) >= limit {
+			detail := fmt.Sprintf("already subscribed to %d topics, the maximum", limit)
+			return errorResponse(msg, "too_many_subscriptions", detail), true
+		}
+		if cc.topics == nil {
+			cc.topics = make(map[string]struct{})
+		}
+		cc.topics[topic] = struct{}{}
+	}
+	return Message{Type: msg.Type, ID: msg.ID, Time: time.Now(), TraceID: msg.TraceID,
+		Payload: map[string]interface{}{"topic": topic, "topics": len(cc.topics)}}, true
+}
+
+// subscribed reports whether the connection is subscribed to topic
+func (c *clientConn) subscribed(topic string) bool {
+	c.topicMutex.Lock()
+	defer c.topicMutex.Unlock()
+	_, ok := c.topics[topic]
+	return ok
+}
+
+// transactionCommand handles begin, commit and rollback, enforces the size
+// limit on messages inside a transaction, and reports whether msg was
+// answered. The caller holds cc.serveMutex.
+func (s *Server) transactionCommand(cc *clientConn, msg Message) (Message, bool) {
+	if !s.config.EnableTransactions {
+		return Message{}, false
+	}
+	reply := func(tx *Transaction) Message {
+		return Message{Type: msg.Type, ID: msg.ID, Time: time.Now(), TraceID: msg.TraceID,
+			Payload: map[string]interface{}{"transaction_id": tx.ID, "messages": tx.size}}
+	}
+
+	tx := cc.tx
+	switch msg.Type {
+	case "begin":
+		if tx != nil {
+			return errorResponse(msg, "transaction_active", "a transaction is already open"), true
+		}
+		tx = &Transaction{ID: newTraceID()}
+		tx.timer = time.AfterFunc(s.config.TransactionTimeout, func() { s.expireTransaction(cc, tx) })
+		cc.tx = tx
+		return reply(tx), true
+	case "commit", "rollback":
+		if tx == nil {
+			return errorResponse(msg, "no_transaction", "no transaction is open"), true
+		}
+		tx.timer.Stop()
+		cc.tx = nil
+		if msg.Type == "commit" {
+			if tx.failed {
+				return errorResponse(msg, "transaction_failed", "a message in the transaction failed; rolled back"), true
+			}
+			for _, effect := range tx.effects {
+				effect()
+			}
+		}
+		return reply(tx), true
+	}
+
+	if tx == nil {
+		return Message{}, false
+	}
+	if tx.size >= s.config.MaxTransactionMessages {
+		tx.timer.Stop()
+		cc.tx = nil
+		detail := fmt.Sprintf("transaction exceeded %d messages; rolled back", s.config.MaxTransactionMessages)
+		return errorResponse(msg, "transaction_too_large", detail), true
+	}
+	tx.size++
+	return Message{}, false
+}
+
+// expireTransaction rolls back tx if it is still open at its timeout and
+// tells the client
+func (s *Server) expireTransaction(cc *clientConn, tx *Transaction) {
+	select {
+	case <-cc.done:
+		return // Closed: nothing was applied, so there is nothing to undo
+	default:
+	}
+	cc.serveMutex.Lock()
+	defer cc.serveMutex.Unlock()
+	if cc.tx != tx {
+		return // Already committed or rolled back
+	}
+	cc.tx = nil
+	detail := fmt.Sprintf("transaction %s not committed within %v; rolled back", tx.ID, s.config.TransactionTimeout)
+	if err := cc.send(errorResponse(Message{}, "transaction_timeout", detail)); err != nil {
+		s.logErrorf("Error sending transaction timeout to %s: %v", cc.remoteAddr, err)
+	}
+}
+
+// serveMessage logs, processes and answers a single message
+func (s *Server) serveMessage(ctx context.Context, cc *clientConn, msg Message) error {
+	cc.serveMutex.Lock()
+	defer cc.serveMutex.Unlock()
+
+	if msg.TraceID == "" {
+		msg.TraceID = newTraceID() // Injected without one
+	}
+	msg.ClientTime = msg.Time
+	if every := s.sampleEvery(); s.metrics.messageSeq.Add(1)%every == 0 {
+		started := time.Now()
+		defer func() { s.metrics.messageDuration.observeN(time.Since(started).Seconds(), every) }()
+	}
+
+	// Log received message details
+	s.logger.Printf("\nReceived message from %s:\n"+
+		"╔══════════════════════════════\n"+
+		"║ ID: %s\n"+
+		"║ Trace: %s\n"+
+		"║ Type: %s\n"+
+		"║ Source: %s\n"+
+		"║ Time: %s\n"+
+		"║ Payload:\n%s"+
+		"╚══════════════════════════════",
+		cc.remoteAddr,
+		msg.ID,
+		msg.TraceID,
+		msg.Type,
+		msg.Source,
+		msg.Time.Format(time.RFC3339Nano),
+		prettyPrintJSON(msg.Payload, "║   "))
+
+	// Process message, or replay the result of an earlier identical request
+	req := s.deltaBase(msg)
+	var resp Message
+	reply, processed := true, false
+	if filter := s.filter.Load(); filter != nil && !(*filter)(ConnContext{cc: cc, s: s}, msg) {
+		s.logger.Printf("Filtered message %s of type %q on %s [trace %s]", msg.ID, msg.Type, cc.id, msg.TraceID)
+		resp, reply = errorResponse(msg, "filtered", fmt.Sprintf("message type %q is not accepted", msg.Type)), s.config.ReplyFiltered
+	} else if skewed, ok := s.checkClockSkew(cc, msg); ok {
+		resp = skewed
+	} else if _, paused := s.pausedTypes.Load(msg.Type); paused {
+		resp = errorResponse(msg, "type_paused", fmt.Sprintf("message type %q is paused, retry later", msg.Type))
+	} else if helloResp, ok := s.negotiateVersion(cc, msg); ok {
+		resp = helloResp
+	} else if rejected, ok := s.checkDeclared(cc, msg); ok {
+		resp = rejected
+	} else if subResp, ok := s.subscriptionCommand(cc, msg); ok {
+		resp = subResp
+	} else if txResp, ok := s.transactionCommand(cc, msg); ok {
+		resp = txResp
+	} else if cached, ok := s.cachedResult(cc, msg); ok {
+		s.logger.Printf("Replaying cached response for idempotency key %q on %s [trace %s]", msg.IdempotencyKey, cc.id, msg.TraceID)
+		resp, reply = cached.resp, !cached.noReply
+		resp.TraceID = msg.TraceID
+	} else if open, ok := s.checkBreaker(ctx, cc, msg); ok {
+		resp = open
+	} else {
+		if cc.tx != nil {
+			ctx = context.WithValue(ctx, txContextKey{}, cc.tx)
+		}
+		resp, reply = s.processWithConn(ctx, cc, msg)
+		processed = !reply || resp.Type != "error"
+		if cc.tx != nil && reply && resp.Type == "error" {
+			cc.tx.failed = true // Commit will roll back instead
+		}
+		if resp.TraceID == "" {
+			resp.TraceID = msg.TraceID
+		}
+		s.cacheResult(cc, msg, resp, reply)
+	}
+
+	// Send response, unless the handler asked for none
+	s.recordTrace(cc, msg, resp, reply)
+	s.logDebugf("Handled message %s of type %q on %s (reply %t, response type %q) [trace %s]", msg.ID, msg.Type, cc.id, reply, resp.Type, msg.TraceID)
+	if reply {
+		if err := cc.send(s.wireResponse(req, resp)); err != nil {
+			if !errors.Is(err, ErrConnHijacked) {
+				s.logErrorf("Error sending response to %s [trace %s]: %v", cc.remoteAddr, msg.TraceID, err)
+			}
+			return err
+		}
+	}
+	if processed && s.config.Publisher != nil {
+		s.publish(ctx, msg)
+	}
+	if msg.CloseAfter {
+		s.logger.Printf("Closing connection %s after one-shot response to %s [trace %s]", cc.id, msg.ID, msg.TraceID)
+		return errCloseAfter
+	}
+	return nil
+}
+
+// circuitBreaker tracks consecutive handler failures for one message type
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // Zero while closed
+	trial    bool      // A half-open trial call is in progress
+}
+
+// breaker returns the circuit breaker for msgType
+func (s *Server) breaker(msgType string) *circuitBreaker {
+	if b, ok := s.breakers.Load(msgType); ok {
+		return b.(*circuitBreaker)
+	}
+	b, _ := s.breakers.LoadOrStore(msgType, &circuitBreaker{})
+	return b.(*circuitBreaker)
+}
+
+// breakerAllows reports whether msgType's breaker lets a call through. Only
+// handled types have breakers, created by their first call.
+func (s *Server) breakerAllows(msgType string) bool {
+	b, ok := s.breakers.Load(msgType)
+	return !ok || b.(*circuitBreaker).allow(s.config.BreakerCooldown)
+}
+
+// allow reports whether a call may go ahead: always while closed, and once
+// cooldown has passed since opening for a single trial call
+func (b *circuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the outcome of a handler call, opening the breaker after
+// threshold consecutive failures or a failed trial and closing it on success
+func (b *circuitBreaker) record(failed bool, threshold int, msgType string, logger *log.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if !b.openedAt.IsZero() {
+			logger.Printf("Circuit breaker for %q closed", msgType)
+		}
+		b.failures, b.openedAt, b.trial = 0, time.Time{}, false
+		return
+	}
+	b.failures++
+	if b.trial || (b.openedAt.IsZero() && b.failures >= threshold) {
+		b.openedAt, b.trial = time.Now(), false
+		logger.Printf("Circuit breaker for %q opened after %d consecutive failures", msgType, b.failures)
+	}
+}
+
+// checkBreaker first replays the messages the connection had rejected that
+// their breakers now let through, then answers msg with circuit_open if its
+// own breaker is open, reporting whether it did. Messages queued for replay
+// hold back later ones of the same type so they are handled in order. The
+// caller holds cc.serveMutex.
+func (s *Server) checkBreaker(ctx context.Context, cc *clientConn, msg Message) (Message, bool) {
+	if s.config.BreakerThreshold <= 0 {
+		return Message{}, false
+	}
+	s.replayRecovered(ctx, cc)
+	queued := false
+	for _, m := range cc.replay {
+		queued = queued || m.Type == msg.Type
+	}
+	if !queued && s.breakerAllows(msg.Type) {
+		return Message{}, false
+	}
+	detail := fmt.Sprintf("handler for %q is failing, retry later", msg.Type)
+	if s.config.ReplayOnRecovery {
+		if len(cc.replay) < s.config.ReplayBufferSize {
+			cc.replay = append(cc.replay, msg)
+			detail = fmt.Sprintf("handler for %q is failing; the message will be retried when it recovers", msg.Type)
+		} else {
+			s.logger.Printf("Replay buffer full on %s, not keeping message %s [trace %s]", cc.id, msg.ID, msg.TraceID)
+		}
+	}
+	return errorResponse(msg, "circuit_open", detail), true
+}
+
+// replayRecovered handles the connection's buffered messages, oldest first,
+// until one's breaker is still open. The caller holds cc.serveMutex.
+func (s *Server) replayRecovered(ctx context.Context, cc *clientConn) {
+	for len(cc.replay) > 0 {
+		msg := cc.replay[0]
+		if !s.breakerAllows(msg.Type) {
+			return
+		}
+		cc.replay = cc.replay[1:]
+		s.logger.Printf("Replaying message %s of type %q on %s after breaker recovery [trace %s]", msg.ID, msg.Type, cc.id, msg.TraceID)
+		req := s.deltaBase(msg)
+		resp, reply := s.processWithConn(ctx, cc, msg)
+		if resp.TraceID == "" {
+			resp.TraceID = msg.TraceID
+		}
+		if reply {
+			if err := cc.send(s.wireResponse(req, resp)); err != nil {
+				s.logErrorf("Error sending replayed response to %s [trace %s]: %v", cc.remoteAddr, msg.TraceID, err)
+				return
+			}
+		}
+	}
+}
+
+// TraceEntry is one request and its response in a connection's trace. The
+// response fields are empty when none was sent.
+type TraceEntry struct {
+	Time            time.Time              `json:"time"`
+	Type            string                 `json:"type"`
+	ID              string                 `json:"id"`
+	TraceID         string                 `json:"trace_id"`
+	ResponseType    string                 `json:"response_type,omitempty"`
+	ErrorReason     string                 `json:"error_reason,omitempty"`
+	Payload         map[string]interface{} `json:"payload,omitempty"`          // With TracePayloads
+	ResponsePayload map[string]interface{} `json:"response_payload,omitempty"` // With TracePayloads
+}
+
+// recordTrace adds msg and its response to the connection's trace ring
+func (s *Server) recordTrace(cc *clientConn, msg, resp Message, reply bool) {
+	if s.config.TraceBufferSize <= 0 {
+		return
+	}
+	entry := TraceEntry{Time: time.Now(), Type: msg.Type, ID: msg.ID, TraceID: msg.TraceID}
+	if reply {
+		entry.ResponseType = resp.Type
+		if resp.Type == "error" {
+			entry.ErrorReason, _ = resp.Payload["reason"].(string)
+		}
+	}
+	if s.config.TracePayloads {
+		entry.Payload = msg.Payload
+		if reply {
+			entry.ResponsePayload = resp.Payload
+		}
+	}
+	cc.traceMutex.Lock()
+	defer cc.traceMutex.Unlock()
+	if len(cc.trace) < s.config.TraceBufferSize {
+		cc.trace = append(cc.trace, entry)
+	} else {
+		cc.trace[cc.traceNext] = entry
+	}
+	cc.traceNext = (cc.traceNext + 1) % s.config.TraceBufferSize
+}
+
+// ConnTrace returns the last TraceBufferSize requests of a connection with
+// their responses, oldest first
+func (s *Server) ConnTrace(connID string) ([]TraceEntry, error) {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrConnNotFound, connID)
+	}
+	cc.traceMutex.Lock()
+	defer cc.traceMutex.Unlock()
+	entries := make([]TraceEntry, 0, len(cc.trace))
+	if len(cc.trace) == s.config.TraceBufferSize {
+		entries = append(entries, cc.trace[cc.traceNext:]...)
+		return append(entries, cc.trace[:cc.traceNext]...), nil
+	}
+	return append(entries, cc.trace...), nil
+}
+
+// sampleEvery returns n such that one message in n is timed for
+// MetricsSampleRate. A rate of zero or less times every message, as
+// WithDefaults would have it.
+func (s *Server) sampleEvery() uint64 {
+	rate := s.config.MetricsSampleRate
+	if rate <= 0 {
+		return 1
+	}
+	return uint64(max(math.Round(1/rate), 1))
+}
+
+// checkClockSkew logs and counts a message whose client time is more than
+// MaxClockSkew from the server's, and with RejectClockSkew answers it,
+// reporting whether it did
+func (s *Server) checkClockSkew(cc *clientConn, msg Message) (Message, bool) {
+	if s.config.MaxClockSkew <= 0 || msg.ClientTime.IsZero() {
+		return Message{}, false
+	}
+	now := time.Now()
+	skew := msg.ClientTime.Sub(now)
+	if skew <= s.config.MaxClockSkew && skew >= -s.config.MaxClockSkew {
+		return Message{}, false
+	}
+	s.metrics.clockSkewed.Add(1)
+	s.logger.Printf("Message %s on %s has client time %v off from the server's (max %v) [trace %s]",
+		msg.ID, cc.id, skew.Round(time.Millisecond), s.config.MaxClockSkew, msg.TraceID)
+	if !s.config.RejectClockSkew {
+		return Message{}, false
+	}
+	detail := fmt.Sprintf("client time %s is %v off from server time %s",
+		msg.ClientTime.Format(time.RFC3339Nano), skew.Round(time.Millisecond), now.Format(time.RFC3339Nano))
+	return errorResponse(msg, "clock_skew", detail), true
+}
+
+// publish mirrors msg to Config.Publisher
+func (s *Server) publish(ctx context.Context, msg Message) {
+	topic := s.config.PublishTopic
+	if topic == "" {
+		topic = msg.Type
+	}
+	if err := s.config.Publisher.Publish(ctx, topic, msg); err != nil {
+		s.logErrorf("Error publishing message %s to %q [trace %s]: %v", msg.ID, topic, msg.TraceID, err)
+	}
+}
+
+// idempotencyKey returns the cache key for msg, or "" if it is not cached
+func (s *Server) idempotencyKey(cc *clientConn, msg Message) string {
+	if s.config.IdempotencyTTL <= 0 || msg.IdempotencyKey == "" {
+		return ""
+	}
+	scope := cc.session
+	if scope == "" {
+		scope = "conn:" + cc.id
+	} else {
+		// Include the identity so one client cannot claim another's session
+		scope = "session:" + cc.identityName() + "\x00" + scope
+	}
+	return scope + "\x00" + msg.IdempotencyKey
+}
+
+// cachedResult returns the unexpired response cached for msg
+func (s *Server) cachedResult(cc *clientConn, msg Message) (idempotentResult, bool) {
+	key := s.idempotencyKey(cc, msg)
+	if key == "" {
+		return idempotentResult{}, false
+	}
+	s.idemMutex.Lock()
+	defer s.idemMutex.Unlock()
+	result, ok := s.idemCache[key]
+	if !ok || time.Now().After(result.expires) {
+		return idempotentResult{}, false
+	}
+	return result, true
+}
+
+// cacheResult stores a successful response for msg. Errors are not cached so
+// that a retry after a failure is processed again.
+func (s *Server) cacheResult(cc *clientConn, msg, resp Message, reply bool) {
+	key := s.idempotencyKey(cc, msg)
+	if key == "" || (reply && resp.Type == "error") {
+		return
+	}
+	s.idemMutex.Lock()
+	s.idemCache[key] = idempotentResult{resp: resp, noReply: !reply, expires: time.Now().Add(s.config.IdempotencyTTL)}
+	s.idemMutex.Unlock()
+}
+
+// sweepIdempotencyCache evicts expired entries every IdempotencyTTL
+func (s *Server) sweepIdempotencyCache() {
+	ticker := time.NewTicker(s.config.IdempotencyTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.idemMutex.Lock()
+			for key, result := range s.idemCache {
+				if now.After(result.expires) {
+					delete(s.idemCache, key)
+				}
+			}
+			s.idemMutex.Unlock()
+		}
+	}
+}
+
+// certIdentity returns the identity of a verified client certificate on conn
+// if it authenticates the connection under AuthPrecedence
+func (s *Server) certIdentity(conn *tls.Conn) (string, bool) {
+	if s.config.TLSClientCAFile == "" || (s.config.AuthPrecedence == "token" && s.config.Authenticate != nil) {
+		return "", false
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName, true
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0], true
+	}
+	return "", false
+}
+
+// handlePreAuth handles a message received before the connection has
+// authenticated. An auth message is verified and, on success, any queued
+// messages are processed in arrival order; other messages are rejected or
+// queued according to PreAuthPolicy.
+func (s *Server) handlePreAuth(ctx context.Context, cc *clientConn, msg Message, queue *[]Message) error {
+	if msg.Type != "auth" {
+		if s.config.PreAuthPolicy == "queue" {
+			if len(*queue) < s.config.PreAuthQueueSize {
+				*queue = append(*queue, msg)
+				return nil
+			}
+			return cc.send(errorResponse(msg, "pre_auth_queue_full", "too many messages sent before authenticating"))
+		}
+		return cc.send(errorResponse(msg, "unauthenticated", "authenticate before sending messages"))
+	}
+
+	token, _ := msg.Payload["token"].(string)
+	identity, err := s.config.Authenticate(token)
+	if err != nil {
+		s.logger.Printf("Authentication failed for %s: %v", cc.id, err)
+		if err := cc.send(errorResponse(msg, "unauthorized", "authentication failed")); err != nil {
+			return err
+		}
+		// Queued messages were sent on the assumption that auth would succeed
+		for _, queued := range *queue {
+			if err := cc.send(errorResponse(queued, "unauthenticated", "authentication failed")); err != nil {
+				return err
+			}
+		}
+		*queue = nil
+		return nil
+	}
+
+	cc.identity.Store(&identity)
+	cc.session, _ = msg.Payload["session"].(string)
+	s.logger.Printf("Connection %s authenticated as %q", cc.id, identity)
+	if err := cc.send(Message{
+		Type:    msg.Type,
+		ID:      msg.ID,
+		Time:    time.Now(),
+		Payload: map[string]interface{}{"identity": identity},
+	}); err != nil {
+		return err
+	}
+
+	queued := *queue
+	*queue = nil
+	if len(queued) == 0 {
+		s.startFirstMessageTimer(cc)
+	}
+	for _, m := range queued {
+		if err := s.serveFromLoop(ctx, cc, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasBufferedInput reports whether the decoder already holds the start of
+// another value, so the next Decode can progress without reading the
+// connection. Whitespace between values does not count.
+func hasBufferedInput(decoder messageDecoder) bool {
+	r, ok := decoder.Buffered().(io.ByteReader)
+	if !ok {
+		return false
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return true
+		}
+	}
+}
+
+// isUnknownFieldError reports whether err comes from DisallowUnknownFields;
+// encoding/json does not export a typed error for it
+func isUnknownFieldError(err error) bool {
+	return strings.HasPrefix(err.Error(), "json: unknown field ")
+}
+
+// processMessage dispatches a message to its handler, or echoes it back when
+// no handler is registered, and builds the response to send. reply is false
+// when the handler returned ErrNoResponse.
+func (s *Server) processMessage(ctx context.Context, connID string, msg Message) (resp Message, reply bool) {
+	if command, ok := adminCommands[msg.Type]; ok && s.config.EnableAdmin {
+		return command(s, msg), true
+	}
+
+	handler, ok := (*s.handlers.Load())[msg.Type]
+	if !ok && msg.Type == "version" {
+		// Built in unless a handler claims the type
+		return Message{Type: msg.Type, ID: msg.ID, Time: time.Now(), Payload: s.versionInfo()}, true
+	}
+	if !ok && msg.Type == "tls_info" {
+		return Message{Type: msg.Type, ID: msg.ID, Time: time.Now(), Payload: s.tlsInfo(connID)}, true
+	}
+	if !ok && msg.Type == "describe" {
+		return Message{Type: msg.Type, ID: msg.ID, Time: time.Now(),
+			Payload: map[string]interface{}{"handlers": s.Handlers()}}, true
+	}
+	if !ok {
+		msg.Time = time.Now()
+		if transform, ok := (*s.transforms.Load())[msg.Type]; ok {
+			payload := make(map[string]interface{}, len(msg.Payload))
+			for k, v := range msg.Payload {
+				payload[k] = v
+			}
+			msg.Payload = payload
+			transform(&msg)
+		}
+		return msg, true
+	}
+
+	callCtx, call := s.trackInflight(ctx, connID, msg)
+	defer s.untrackInflight(call)
+
+	started := time.Now()
+	resp, err := handler(callCtx, msg)
+	threshold := s.config.SlowHandlerThreshold
+	if threshold <= 0 {
+		threshold = defaultSlowHandlerThreshold
+	}
+	if took := time.Since(started); took > threshold {
+		s.logger.Printf("Warning: handler for %q on %s took %v (message %s) [trace %s]", msg.Type, connID, took, msg.ID, msg.TraceID)
+		s.metrics.slowHandlerCalls(msg.Type).Add(1)
+	}
+	if s.config.BreakerThreshold > 0 {
+		s.breaker(msg.Type).record(err != nil && !errors.Is(err, ErrNoResponse), s.config.BreakerThreshold, msg.Type, s.logger)
+	}
+	if errors.Is(err, ErrNoResponse) {
+		return Message{}, false
+	}
+	if err != nil {
+		s.logErrorf("Handler for %q failed on %s (message %s) [trace %s]: %v", msg.Type, connID, msg.ID, msg.TraceID, err)
+		return handlerErrorResponse(msg, err), true
+	}
+	resp.Time = time.Now()
+	return resp, true
+}
+
+// processWithConn is processMessage with a ConnContext for the handler. A
+// streamed response replaces the one returned, and is closed here if the
+// handler returns or panics without closing it, since the stream holds the
+// connection's writes.
+func (s *Server) processWithConn(ctx context.Context, cc *clientConn, msg Message) (resp Message, reply bool) {
+	c := &ConnContext{cc: cc, s: s}
+	defer func() {
+		if c.endStream(msg) {
+			resp, reply = Message{}, false
+		}
+	}()
+	return s.processMessage(context.WithValue(ctx, connContextKey{}, c), cc.id, msg)
+}
+
+// wireResponse returns the value to encode for resp. In AckOnly mode regular
+// responses are reduced to an ack, and in DeltaResponses mode to the fields
+// that changed; errors and admin replies are sent in full.
+func (s *Server) wireResponse(req, resp Message) interface{} {
+	if !(s.config.AckOnly || s.config.DeltaResponses) || resp.Type == "error" {
+		return resp
+	}
+	if _, ok := adminCommands[req.Type]; ok && s.config.EnableAdmin {
+		return resp
+	}
+	if s.config.DeltaResponses {
+		delta, err := messageDelta(req, resp, s.config.TimeFormat)
+		if err != nil {
+			return resp
+		}
+		return delta
+	}
+	return ack{Type: resp.Type, ID: resp.ID, Time: resp.Time, TraceID: resp.TraceID}
+}
+
+// deltaBase returns the request as received, for wireResponse to diff the
+// response against in DeltaResponses mode. The payload is copied because
+// handlers may modify msg.Payload in place and return it.
+func (s *Server) deltaBase(msg Message) Message {
+	if s.config.DeltaResponses {
+		msg.Payload, _ = copyJSONValue(msg.Payload).(map[string]interface{})
+	}
+	return msg
+}
+
+// copyJSONValue deep-copies a decoded JSON value
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyJSONValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyJSONValue(e)
+		}
+		return c
+	}
+	return v
+}
+
+// messageDelta returns the wire fields of resp that differ from req, with
+// fields resp dropped set to null. The id and trace ID are always kept so the
+// client can match the delta to its request, including trace IDs the server
+// generated after the request arrived.
+func messageDelta(req, resp Message, timeFormat string) (map[string]json.RawMessage, error) {
+	fields := func(m Message) (map[string]json.RawMessage, error) {
+		data, err := json.Marshal(toWire(m, timeFormat))
+		if err != nil {
+			return nil, err
+		}
+		var f map[string]json.RawMessage
+		return f, json.Unmarshal(data, &f)
+	}
+	before, err := fields(req)
+	if err != nil {
+		return nil, err
+	}
+	after, err := fields(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := map[string]json.RawMessage{"id": after["id"]}
+	if traceID, ok := after["trace_id"]; ok {
+		delta["trace_id"] = traceID
+	}
+	for k, v := range after {
+		if !bytes.Equal(before[k], v) {
+			delta[k] = v
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			delta[k] = json.RawMessage("null")
+		}
+	}
+	return delta, nil
+}
+
+// newTraceID returns a random 128-bit trace ID in hex, the size used by W3C
+// trace context
+func newTraceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ErrorCode classifies an error response for machine handling. The values
+// follow the nearest HTTP status.
+type ErrorCode int
+
+const (
+	CodeBadRequest      ErrorCode = 400
+	CodeUnauthorized    ErrorCode = 401
+	CodeTimeout         ErrorCode = 408
+	CodePayloadTooLarge ErrorCode = 413
+	CodeRateLimited     ErrorCode = 429
+	CodeInternal        ErrorCode = 500
+	CodeUnavailable     ErrorCode = 503
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeBadRequest:
+		return "bad_request"
+	case CodeUnauthorized:
+		return "unauthorized"
+	case CodeTimeout:
+		return "timeout"
+	case CodePayloadTooLarge:
+		return "payload_too_large"
+	case CodeRateLimited:
+		return "rate_limited"
+	case CodeInternal:
+		return "internal"
+	case CodeUnavailable:
+		return "unavailable"
+	}
+	return "ErrorCode(" + strconv.Itoa(int(c)) + ")"
+}
+
+// errorReasons maps each reason the server reports to its code and whether
+// the client may retry the same message, possibly on another connection
+var errorReasons = map[string]struct {
+	code      ErrorCode
+	retryable bool
+}{
+	"bad_request":             {CodeBadRequest, false},
+	"strict_decode_error":     {CodeBadRequest, false},
+	"bad_frame":               {CodeBadRequest, false},
+	"payload_limit":           {CodePayloadTooLarge, false},
+	"unauthenticated":         {CodeUnauthorized, false},
+	"unauthorized":            {CodeUnauthorized, false},
+	"pre_auth_queue_full":     {CodeRateLimited, true},
+	"quota_exceeded":          {CodeRateLimited, false},
+	"draining":                {CodeUnavailable, true},
+	"quarantined":             {CodeUnavailable, true},
+	"server_overloaded":       {CodeUnavailable, true},
+	"timeout":                 {CodeTimeout, true},
+	"cancelled":               {CodeUnavailable, true},
+	"handler_error":           {CodeInternal, false},
+	"transaction_active":      {CodeBadRequest, false},
+	"no_transaction":          {CodeBadRequest, false},
+	"transaction_too_large":   {CodePayloadTooLarge, false},
+	"transaction_failed":      {CodeBadRequest, false},
+	"transaction_timeout":     {CodeTimeout, true},
+	"flow_control":            {CodeRateLimited, true},
+	"persistence_unavailable": {CodeUnavailable, true},
+	"not_ready":               {CodeUnavailable, true},
+	"rate_limited":            {CodeRateLimited, true},
+	"version_negotiated":      {CodeBadRequest, false},
+	"unsupported_version":     {CodeBadRequest, false},
+	"too_many_subscriptions":  {CodeRateLimited, false},
+	"undeclared_type":         {CodeBadRequest, false},
+	"filtered":                {CodeBadRequest, false},
+	"type_paused":             {CodeUnavailable, true},
+	"clock_skew":              {CodeBadRequest, false},
+	"circuit_open":            {CodeUnavailable, true},
+	"schema_violation":        {CodeBadRequest, false},
+}
+
+// Error is an error a Handler can return to choose the code, reason and
+// retryability reported to the client; other handler errors are reported
+// as internal
+type Error struct {
+	Code       ErrorCode
+	Reason     string // Defaults to the code's name
+	Message    string
+	Retryable  bool
+	RetryAfter time.Duration // Sent as retry_after_ms when positive
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorResponse builds an error message replying to msg, with the code and
+// retryability registered for reason in errorReasons
+func errorResponse(msg Message, reason, detail string) Message {
+	return retryableErrorResponse(msg, reason, detail, 0)
+}
+
+// retryableErrorResponse is errorResponse with a hint that the client wait
+// retryAfter before resending, for transient rejections
+func retryableErrorResponse(msg Message, reason, detail string, retryAfter time.Duration) Message {
+	info, ok := errorReasons[reason]
+	if !ok {
+		info.code = CodeInternal
+	}
+	return codedErrorResponse(msg, &Error{Code: info.code, Reason: reason, Message: detail, Retryable: info.retryable, RetryAfter: retryAfter})
+}
+
+// codedErrorResponse builds the error message reporting e in reply to msg:
+// {"code": 503, "reason": "draining", "message": "...", "retryable": true},
+// plus "retry_after_ms" when e.RetryAfter is set
+func codedErrorResponse(msg Message, e *Error) Message {
+	reason := e.Reason
+	if reason == "" {
+		reason = e.Code.String()
+	}
+	payload := map[string]interface{}{
+		"code":      int(e.Code),
+		"reason":    reason,
+		"message":   e.Message,
+		"retryable": e.Retryable,
+	}
+	if e.RetryAfter > 0 {
+		// Round up so a client waiting the hint is never early
+		payload["retry_after_ms"] = (e.RetryAfter + time.Millisecond - 1).Milliseconds()
+	}
+	return Message{
+		Type:    "error",
+		ID:      msg.ID,
+		Time:    time.Now(),
+		TraceID: msg.TraceID,
+		Payload: payload,
+	}
+}
+
+// handlerErrorResponse reports a handler failure: as the handler's *Error if
+// it returned one, as a retryable timeout or cancellation if its context
+// ended, and otherwise as an internal error
+func handlerErrorResponse(msg Message, err error) Message {
+	var coded *Error
+	switch {
+	case errors.As(err, &coded):
+		return codedErrorResponse(msg, coded)
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorResponse(msg, "timeout", err.Error())
+	case errors.Is(err, context.Canceled):
+		return errorResponse(msg, "cancelled", err.Error())
+	}
+	return errorResponse(msg, "handler_error", err.Error())
+}
+
+// trackInflight registers a handler invocation and returns its cancellable context
+func (s *Server) trackInflight(ctx context.Context, connID string, msg Message) (context.Context, *InflightCall) {
+	callCtx, cancel := context.WithCancel(ctx)
+	call := &InflightCall{
+		ID:        "call-" + strconv.FormatUint(s.inflightSeq.Add(1), 10),
+		ConnID:    connID,
+		MessageID: msg.ID,
+		Type:      msg.Type,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+
+	s.inflightMutex.Lock()
+	s.inflight[call.ID] = call
+	s.inflightMutex.Unlock()
+	return callCtx, call
+}
+
+// untrackInflight removes a finished handler invocation from the registry
+func (s *Server) untrackInflight(call *InflightCall) {
+	s.inflightMutex.Lock()
+	delete(s.inflight, call.ID)
+	s.inflightMutex.Unlock()
+	call.cancel()
+}
+
+// InflightCalls returns the handler invocations currently running, oldest first
+func (s *Server) InflightCalls() []InflightCall {
+	s.inflightMutex.Lock()
+	calls := make([]InflightCall, 0, len(s.inflight))
+	for _, call := range s.inflight {
+		calls = append(calls, *call)
+	}
+	s.inflightMutex.Unlock()
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].StartedAt.Before(calls[j].StartedAt)
+	})
+	return calls
+}
+
+// CancelInflight cancels the context of a running handler invocation.
+// It reports whether an invocation with that ID was found.
+func (s *Server) CancelInflight(id string) bool {
+	s.inflightMutex.Lock()
+	call, ok := s.inflight[id]
+	s.inflightMutex.Unlock()
+	if !ok {
+		return false
+	}
+	s.logger.Printf("Cancelling in-flight %s (%s on %s)", call.ID, call.Type, call.ConnID)
+	call.cancel()
+	return true
+}
+
+// adminCommands maps the admin message types, accepted only when
+// EnableAdmin is set, to their implementations
+var adminCommands = map[string]func(*Server, Message) Message{
+	"list_inflight":    (*Server).adminListInflight,
+	"cancel_inflight":  (*Server).adminCancelInflight,
+	"list_connections": (*Server).adminListConnections,
+	"set_log_level":    (*Server).adminSetLogLevel,
+	"trace":            (*Server).adminTrace,
+}
+
+// buildVersion is the server's release version, set at build time with
+// -ldflags "-X main.buildVersion=v1.2.3"; otherwise the module version from
+// the build info is reported
+var buildVersion = ""
+
+// versionInfo describes the running build: version, Go version, start time
+// and, when the binary was built from a VCS checkout, the revision
+func (s *Server) versionInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"version":    buildVersion,
+		"go_version": runtime.Version(),
+		"started_at": s.startedAt,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if buildVersion == "" {
+			info["version"] = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["vcs_revision"] = setting.Value
+			case "vcs.time":
+				info["vcs_time"] = setting.Value
+			case "vcs.modified":
+				info["vcs_modified"] = setting.Value == "true"
+			}
+		}
+	}
+	if info["version"] == "" {
+		info["version"] = "(devel)"
+	}
+	return info
+}
+
+// tlsInfo describes the TLS session of a connection, for a client to check
+// what it negotiated
+func (s *Server) tlsInfo(connID string) map[string]interface{} {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return map[string]interface{}{"tls": false}
+	}
+	tlsConn, ok := cc.conn.(*tls.Conn)
+	if !ok {
+		return map[string]interface{}{"tls": false}
+	}
+	state := tlsConn.ConnectionState()
+	return map[string]interface{}{
+		"tls":          true,
+		"version":      tls.VersionName(state.Version),
+		"cipher_suite": tls.CipherSuiteName(state.CipherSuite),
+		"alpn":         state.NegotiatedProtocol,
+		"server_name":  state.ServerName,
+		"resumed":      state.DidResume,
+	}
+}
+
+// adminListConnections answers the list_connections admin command
+func (s *Server) adminListConnections(msg Message) Message {
+	return Message{
+		Type: msg.Type,
+		ID:   msg.ID,
+		Time: time.Now(),
+		Payload: map[string]interface{}{
+			"connections": s.Connections(),
+		},
+	}
+}
+
+// adminListInflight answers the list_inflight admin command
+func (s *Server) adminListInflight(msg Message) Message {
+	return Message{
+		Type: msg.Type,
+		ID:   msg.ID,
+		Time: time.Now(),
+		Payload: map[string]interface{}{
+			"inflight": s.InflightCalls(),
+		},
+	}
+}
+
+// adminCancelInflight answers the cancel_inflight admin command; the
+// invocation to cancel is given by the "id" payload field
+func (s *Server) adminCancelInflight(msg Message) Message {
+	id, _ := msg.Payload["id"].(string)
+	if id == "" {
+		return errorResponse(msg, "bad_request", "cancel_inflight requires a payload id")
+	}
+	return Message{
+		Type: msg.Type,
+		ID:   msg.ID,
+		Time: time.Now(),
+		Payload: map[string]interface{}{
+			"id":        id,
+			"cancelled": s.CancelInflight(id),
+		},
+	}
+}
+
+// adminTrace answers the trace admin command with the recent messages of
+// the connection given by the "conn_id" payload field
+func (s *Server) adminTrace(msg Message) Message {
+	connID, _ := msg.Payload["conn_id"].(string)
+	if connID == "" {
+		return errorResponse(msg, "bad_request", "trace requires a payload conn_id")
+	}
+	entries, err := s.ConnTrace(connID)
+	if err != nil {
+		return errorResponse(msg, "bad_request", err.Error())
+	}
+	return Message{
+		Type: msg.Type,
+		ID:   msg.ID,
+		Time: time.Now(),
+		Payload: map[string]interface{}{
+			"conn_id": connID,
+			"entries": entries,
+		},
+	}
+}
+
+// adminSetLogLevel changes the log level to payload.level
+func (s *Server) adminSetLogLevel(msg Message) Message {
+	level, _ := msg.Payload["level"].(string)
+	previous := s.LogLevel()
+	if err := s.SetLogLevel(level); err != nil || level == "" {
+		return errorResponse(msg, "bad_request", "set_log_level requires a payload level of \"info\" or \"debug\"")
+	}
+	return Message{
+		Type: msg.Type,
+		ID:   msg.ID,
+		Time: time.Now(),
+		Payload: map[string]interface{}{
+			"level":    s.LogLevel(),
+			"previous": previous,
+		},
+	}
+}
+
+// addConnection registers a new client connection. It reports false, and
+// leaves the registry unchanged, if the connection was already tracked.
+//
+// Registration also fails once Shutdown has started, which closes the race
+// where a connection accepted during shutdown misses Shutdown's close loop.
+func (s *Server) addConnection(cc *clientConn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.closing {
+		return false
+	}
+	if _, exists := s.conns[cc.conn]; exists {
+		s.logger.Printf("Connection %s (%s) registered twice; ignoring duplicate", cc.id, cc.remoteAddr)
+		return false
+	}
+	s.conns[cc.conn] = cc
+	s.connsByID[cc.id] = cc
+	s.liveIDs.Store(cc.id, struct{}{})
+	s.liveCount.Add(1)
+	return true
+}
+
+// removeConnection removes a client connection from tracking. It is safe to
+// call more than once and reports whether the connection was still tracked.
+func (s *Server) removeConnection(cc *clientConn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if tracked, exists := s.conns[cc.conn]; !exists || tracked != cc {
+		return false // Never tracked, already removed, or owned by another entry
+	}
+	delete(s.conns, cc.conn)
+	delete(s.connsByID, cc.id)
+	s.liveIDs.Delete(cc.id)
+	s.liveCount.Add(-1) // Only reached when the entry was deleted, so never below zero
+	return true
+}
+
+// DumpState writes a summary of the connection registry and in-flight
+// handlers followed by every goroutine's stack. Used for debugging a server
+// that appears hung without attaching a profiler.
+func (s *Server) DumpState(w io.Writer) error {
+	conns := s.Connections()
+	fmt.Fprintf(w, "=== Server state at %s ===\n", time.Now().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "Connections: %d\n", len(conns))
+	for _, c := range conns {
+		fmt.Fprintf(w, "  %s remote=%s age=%.1fs idle=%.1fs tls=%t identity=%q tags=%v\n",
+			c.ID, c.RemoteAddr, c.AgeSeconds, c.IdleSeconds, c.TLS, c.Identity, c.Tags)
+	}
+	calls := s.InflightCalls()
+	fmt.Fprintf(w, "In-flight handlers: %d\n", len(calls))
+	for _, call := range calls {
+		fmt.Fprintf(w, "  %s conn=%s message=%s type=%s running=%v\n",
+			call.ID, call.ConnID, call.MessageID, call.Type, time.Since(call.StartedAt).Round(time.Millisecond))
+	}
+	fmt.Fprintln(w, "=== Goroutines ===")
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// lookupConnection finds a tracked connection by ID
+func (s *Server) lookupConnection(connID string) (*clientConn, bool) {
+	s.connMutex.RLock()
+	defer s.connMutex.RUnlock()
+	cc, ok := s.connsByID[connID]
+	return cc, ok
+}
+
+// IsConnected reports whether connID names a registered connection. It reads
+// a concurrent mirror of the registry rather than taking connMutex, so a
+// dispatcher can call it on every send without contending with accepts.
+func (s *Server) IsConnected(connID string) bool {
+	_, ok := s.liveIDs.Load(connID)
+	return ok
+}
+
+// TagConnection attaches tags to a connection so it can be targeted as a
+// group, e.g. by DrainTag. It reports whether the connection was found.
+func (s *Server) TagConnection(connID string, tags ...string) bool {
+	cc, ok := s.lookupConnection(connID)
+	if ok {
+		cc.addTags(tags...)
+	}
+	return ok
+}
+
+// Errors returned by the connection-targeted APIs
+var (
+	ErrConnNotFound   = errors.New("connection not found")
+	ErrConnClosed     = errors.New("connection closed")
+	ErrRequestTimeout = errors.New("request timed out")
+	ErrConnHijacked   = errors.New("connection hijacked")
+	ErrSendOnly       = errors.New("connection is send-only")
+
+	// errCloseAfter ends the read loop after a close_after message is answered
+	errCloseAfter = errors.New("close requested by client")
+)
+
+// Request sends msg to a connected client and waits up to timeout for the
+// reply carrying the same correlation ID. Replies are matched in the
+// connection's read loop and are not dispatched as regular messages.
+func (s *Server) Request(connID string, msg Message, timeout time.Duration) (Message, error) {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return Message{}, fmt.Errorf("%w: %s", ErrConnNotFound, connID)
+	}
+	if cc.noResponse.Load() {
+		return Message{}, fmt.Errorf("%w: %s", ErrSendOnly, connID)
+	}
+
+	msg.CorrelationID = "req-" + strconv.FormatUint(s.requestSeq.Add(1), 10)
+	msg.Time = time.Now()
+	reply := make(chan Message, 1)
+	cc.pendingMutex.Lock()
+	if cc.pending == nil {
+		cc.pending = make(map[string]chan Message)
+	}
+	cc.pending[msg.CorrelationID] = reply
+	cc.pendingMutex.Unlock()
+	defer func() {
+		cc.pendingMutex.Lock()
+		delete(cc.pending, msg.CorrelationID)
+		cc.pendingMutex.Unlock()
+	}()
+
+	if err := cc.send(msg); err != nil {
+		return Message{}, fmt.Errorf("sending request to %s: %w", connID, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-reply:
+		return resp, nil
+	case <-timer.C:
+		return Message{}, fmt.Errorf("%w: no reply from %s after %v", ErrRequestTimeout, connID, timeout)
+	case <-cc.done:
+		return Message{}, fmt.Errorf("%w: %s", ErrConnClosed, connID)
+	}
+}
+
+// Inject feeds msg into a connection's processing pipeline as if the client
+// had sent it: it is dispatched to its handler and the response is sent to
+// the client. Injected messages are processed one at a time with the
+// client's own and bypass client-state checks such as authentication.
+func (s *Server) Inject(connID string, msg Message) error {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrConnNotFound, connID)
+	}
+	if err := s.serveMessage(cc.ctx, cc, msg); err != nil && !errors.Is(err, errCloseAfter) {
+		return fmt.Errorf("injecting into %s: %w", connID, err)
+	}
+	if msg.CloseAfter {
+		cc.stop("close_after", "close_after on injected message")
+	}
+	return nil
+}
+
+// Hijack takes a connection away from the server: its read loop stops, it
+// leaves the connection registry, and the raw net.Conn (after TLS, if any)
+// is returned to the caller, who becomes responsible for closing it. Input
+// the server had read but not yet decoded is replayed by the returned conn;
+// with the JSON codec it may start with the newline ending the last message.
+// Called from a handler for that connection, Hijack returns at once and the
+// handler's response is not sent; called elsewhere, it waits for the read
+// loop, which may first serve messages already received. Connections using
+// deflate or gzip stream compression cannot be hijacked.
+func (s *Server) Hijack(connID string) (net.Conn, error) {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrConnNotFound, connID)
+	}
+	if s.config.Compression == "deflate" || cc.gzipped.Load() {
+		return nil, fmt.Errorf("hijacking %s: not supported on a compressed stream", connID)
+	}
+
+	cc.hijackMutex.Lock()
+	if cc.hijackReq != nil || cc.hijacked.Load() {
+		cc.hijackMutex.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrConnHijacked, connID)
+	}
+	if cc.loopParked {
+		// The read loop is in a handler and will not touch the decoder again
+		// before checking hijacked
+		defer cc.hijackMutex.Unlock()
+		return s.detach(cc), nil
+	}
+	ch := make(chan net.Conn, 1)
+	cc.hijackReq = ch
+	cc.hijackMutex.Unlock()
+	cc.conn.SetReadDeadline(time.Now()) // Unblock a pending Decode
+
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-cc.done:
+		select {
+		case conn := <-ch:
+			return conn, nil
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrConnClosed, connID)
+		}
+	}
+}
+
+// hijackRequest returns the channel of a pending Hijack, or nil
+func (c *clientConn) hijackRequest() chan net.Conn {
+	c.hijackMutex.Lock()
+	defer c.hijackMutex.Unlock()
+	return c.hijackReq
+}
+
+// hijackedConn replays input the server had buffered before reading from
+// the underlying connection
+type hijackedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// detach ends the server's ownership of cc and returns its conn. The caller
+// must ensure the read loop is not using the decoder.
+func (s *Server) detach(cc *clientConn) net.Conn {
+	cc.writeMutex.Lock()
+	cc.hijacked.Store(true) // Later sends fail instead of writing to the conn
+	cc.writeMutex.Unlock()
+	if cc.batch != nil {
+		cc.batch.Flush() // Send responses owed before handing over
+	}
+	cc.conn.SetReadDeadline(time.Time{})
+	if s.removeConnection(cc) { // Before handing over, so Shutdown cannot close it
+		s.emit(ConnClosed, cc)
+	}
+
+	var conn net.Conn = cc.conn
+	if buffered, _ := io.ReadAll(cc.decoder.Buffered()); len(buffered) > 0 {
+		conn = &hijackedConn{Conn: cc.conn, r: io.MultiReader(bytes.NewReader(buffered), cc.conn)}
+	}
+	s.logger.Printf("Connection %s hijacked", cc.id)
+	return conn
+}
+
+// Broadcast queues msg for delivery to every ready connection: those not
+// draining and, when authentication is required, authenticated. Delivery is
+// asynchronous and paced per connection by BroadcastRate; a connection whose
+// queue is full misses the message. It returns the number of connections
+// the message was queued for.
+func (s *Server) Broadcast(msg Message) int {
+	return s.BroadcastUntil(msg, time.Time{})
+}
+
+// BroadcastUntil is Broadcast for a message that goes stale at expiresAt:
+// a connection whose writer reaches it after then drops it instead of
+// delivering it. A zero expiresAt never expires.
+func (s *Server) BroadcastUntil(msg Message, expiresAt time.Time) int {
+	return s.broadcast(msg, expiresAt, nil)
+}
+
+// BroadcastTopic is Broadcast limited to the connections subscribed to
+// topic; see EnableSubscriptions
+func (s *Server) BroadcastTopic(topic string, msg Message) int {
+	return s.broadcast(msg, time.Time{}, func(cc *clientConn) bool { return cc.subscribed(topic) })
+}
+
+// broadcast queues msg for the ready connections that match, or all of
+// them when match is nil
+func (s *Server) broadcast(msg Message, expiresAt time.Time, match func(*clientConn) bool) int {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	s.connMutex.RLock()
+	targets := make([]*clientConn, 0, len(s.conns))
+	for _, cc := range s.conns {
+		if cc.draining.Load() || cc.noResponse.Load() || (s.config.Authenticate != nil && cc.identity.Load() == nil) {
+			continue
+		}
+		if match != nil && !match(cc) {
+			continue
+		}
+		targets = append(targets, cc)
+	}
+	s.connMutex.RUnlock()
+
+	var size int64
+	if s.config.MaxBufferedBytes > 0 && len(targets) > 0 {
+		if data, err := json.Marshal(msg); err == nil {
+			size = int64(len(data))
+		}
+	}
+	queued := 0
+	for _, cc := range targets {
+		if s.enqueue(cc, outboundMessage{msg, expiresAt, size}) {
+			queued++
+		}
+	}
+	return queued
+}
+
+// outboundMessage is a queued broadcast and when it expires, if ever
+type outboundMessage struct {
+	msg       Message
+	expiresAt time.Time
+	size      int64 // Approximate encoded size, counted in Server.bufferedBytes
+}
+
+func (m outboundMessage) expired() bool {
+	return !m.expiresAt.IsZero() && !time.Now().Before(m.expiresAt)
+}
+
+// enqueue adds msg to the connection's outbound queue without blocking,
+// starting its writer on first use. It reports false if the queue is full.
+func (s *Server) enqueue(cc *clientConn, msg outboundMessage) bool {
+	cc.outboundOnce.Do(func() {
+		cc.outbound = make(chan outboundMessage, s.config.OutboundQueueSize)
+		if s.config.BroadcastRate > 0 {
+			cc.sendLimiter = newTokenBucket(s.config.BroadcastRate, s.config.BroadcastBurst)
+		}
+		go s.writeOutbound(cc)
+	})
+
+	if limit := s.config.MaxBufferedBytes; limit > 0 {
+		for s.bufferedBytes.Load()+msg.size > limit {
+			select {
+			case old := <-cc.outbound: // Oldest first
+				s.bufferedBytes.Add(-old.size)
+				cc.outboundLeft.Add(-1)
+				s.metrics.broadcastsShed.Add(1)
+				s.countBacklog(&s.backlog.dropped)
+			default:
+				s.metrics.broadcastsShed.Add(1) // Nothing of this connection's left to shed
+				s.countBacklog(&s.backlog.queued)
+				s.countBacklog(&s.backlog.dropped)
+				return false
+			}
+		}
+	}
+
+	select {
+	case cc.outbound <- msg:
+		s.bufferedBytes.Add(msg.size)
+		cc.outboundLeft.Add(1)
+		s.countBacklog(&s.backlog.queued)
+		if cc.ctx.Err() != nil {
+			s.releaseOutbound(cc) // The writer may have exited already
+		}
+		return true
+	default:
+		s.metrics.broadcastsDropped.Add(1)
+		s.countBacklog(&s.backlog.queued)
+		s.countBacklog(&s.backlog.dropped)
+		if n := cc.dropped.Add(1); n == 1 || n%1000 == 0 {
+			s.logger.Printf("Outbound queue full for %s; dropped %d messages so far", cc.id, n)
+		}
+		return false
+	}
+}
+
+// writeOutbound sends queued messages to the client, pacing them with the
+// connection's limiter, until the connection closes. Messages that expired
+// while queued are dropped without spending a token.
+func (s *Server) writeOutbound(cc *clientConn) {
+	defer s.releaseOutbound(cc)
+	for {
+		select {
+		case <-cc.ctx.Done():
+			return
+		case out := <-cc.outbound:
+			s.bufferedBytes.Add(-out.size)
+			if !s.sendOutbound(cc, out) {
+				return
+			}
+		}
+	}
 }
 
-// Message represents the JSON structure for client communication
-type Message struct {
-	Type    string                 `json:"type"`
-	Payload map[string]interface{} `json:"payload"`
-	Time    time.Time              `json:"time"`
-	ID      string                 `json:"id"`
-	Source  string                 `json:"source"`
+// sendOutbound delivers one dequeued message, paced by the connection's
+// limiter unless it has expired, and reports whether the writer should
+// carry on
+func (s *Server) sendOutbound(cc *clientConn, out outboundMessage) bool {
+	defer cc.outboundLeft.Add(-1)
+	if out.expired() {
+		s.metrics.broadcastsExpired.Add(1)
+		s.countBacklog(&s.backlog.dropped)
+		return true
+	}
+	if cc.sendLimiter != nil {
+		if err := cc.sendLimiter.Wait(cc.ctx, 1); err != nil {
+			s.countBacklog(&s.backlog.dropped)
+			return false
+		}
+		if out.expired() { // Went stale while paced
+			s.metrics.broadcastsExpired.Add(1)
+			s.countBacklog(&s.backlog.dropped)
+			return true
+		}
+	}
+	if err := cc.send(out.msg); err != nil {
+		s.logErrorf("Error sending queued message to %s: %v", cc.id, err)
+		s.countBacklog(&s.backlog.dropped)
+		return false
+	}
+	s.countBacklog(&s.backlog.delivered)
+	return !s.overByteQuota(cc)
 }
 
-// Server handles all client connections and message processing
-type Server struct {
-	config    Config
-	listener  net.Listener
-	connMutex sync.RWMutex
-	conns     map[net.Conn]struct{}
-	shutdown  chan struct{}
-	logger    *log.Logger
-	connSem   chan struct{} // Semaphore for connection limiting
+// releaseOutbound empties the queue of a connection whose writer has
+// stopped, returning its messages' bytes to the MaxBufferedBytes budget
+func (s *Server) releaseOutbound(cc *clientConn) {
+	for {
+		select {
+		case out := <-cc.outbound:
+			s.bufferedBytes.Add(-out.size)
+			cc.outboundLeft.Add(-1)
+			s.countBacklog(&s.backlog.dropped)
+		default:
+			return
+		}
+	}
 }
 
-// NewServer creates and initializes a new server instance
-func NewServer(config Config) *Server {
-	return &Server{
-		config:   config,
-		conns:    make(map[net.Conn]struct{}),
-		shutdown: make(chan struct{}),
-		logger:   log.New(os.Stdout, "[SERVER] ", log.LstdFlags|log.Lmicroseconds),
-		connSem:  make(chan struct{}, config.MaxConnections),
-	}
+// shutdownBacklog counts the broadcasts queued when Shutdown's drain began
+// and what became of them
+type shutdownBacklog struct {
+	counting           atomic.Bool // Set once the drain begins
+	queued             atomic.Uint64
+	delivered, dropped atomic.Uint64
 }
 
-// Start begins listening for connections
-func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", ":"+s.config.Port)
-	if err != nil {
-		return err
+// countBacklog adds one to c once Shutdown's drain has begun
+func (s *Server) countBacklog(c *atomic.Uint64) {
+	if s.backlog.counting.Load() {
+		c.Add(1)
 	}
-	s.listener = listener
-	s.logger.Printf("Server started on port %s", s.config.Port)
+}
 
-	go s.acceptConnections()
-	return nil
+// BacklogReport is how many broadcasts were queued across all connections
+// when Shutdown began draining, plus any broadcast to a connection since,
+// and how many of those were delivered or dropped (shed, expired, failed or
+// discarded) by the time it returned
+type BacklogReport struct {
+	Queued    uint64 `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
 }
 
-// acceptConnections handles incoming client connections
-func (s *Server) acceptConnections() {
-	for {
+// ShutdownBacklog reports what happened to the broadcasts queued at
+// shutdown; it is all zeros until Shutdown begins draining
+func (s *Server) ShutdownBacklog() BacklogReport {
+	return BacklogReport{
+		Queued:    s.backlog.queued.Load(),
+		Delivered: s.backlog.delivered.Load(),
+		Dropped:   s.backlog.dropped.Load(),
+	}
+}
+
+// awaitOutbound holds a connection closing during Shutdown open until its
+// queued broadcasts are delivered, or until the drain ends and the
+// connection's context is cancelled, with DrainBroadcasts
+func (s *Server) awaitOutbound(cc *clientConn) {
+	if !s.config.DrainBroadcasts || !s.backlog.counting.Load() {
+		return
+	}
+	ticker := time.NewTicker(outboundFlushPoll)
+	defer ticker.Stop()
+	for cc.outboundLeft.Load() > 0 {
 		select {
-		case <-s.shutdown:
+		case <-cc.ctx.Done():
 			return
-		case s.connSem <- struct{}{}: // Acquire semaphore slot
-			conn, err := s.listener.Accept()
-			if err != nil {
-				select {
-				case <-s.shutdown:
-					return
-				default:
-					s.logger.Printf("Error accepting connection: %v", err)
-					<-s.connSem // Release semaphore slot on error
-					continue
-				}
-			}
+		case <-ticker.C:
+		}
+	}
+}
 
-			go s.handleConnection(conn)
+// QuarantineConnection stops dispatching a connection's messages for d,
+// answering each with a quarantined error, without closing it; dispatch
+// resumes automatically afterwards. A non-positive d lifts the quarantine.
+func (s *Server) QuarantineConnection(connID string, d time.Duration) error {
+	cc, ok := s.lookupConnection(connID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrConnNotFound, connID)
+	}
+	if d <= 0 {
+		cc.quarantinedUntil.Store(0)
+		s.logger.Printf("Lifted quarantine on connection %s", connID)
+		return nil
+	}
+	cc.quarantinedUntil.Store(time.Now().Add(d).UnixNano())
+	s.logger.Printf("Quarantined connection %s for %v", connID, d)
+	return nil
+}
+
+// DrainTag gracefully closes every connection tagged with tag, leaving the
+// others untouched. Tagged connections stop accepting new messages, finish
+// and flush the response in progress, and are closed; any still open after
+// timeout are closed forcibly. It returns the number of connections drained.
+func (s *Server) DrainTag(tag string, timeout time.Duration) (int, error) {
+	s.connMutex.RLock()
+	var matched []*clientConn
+	for _, cc := range s.conns {
+		if cc.hasTag(tag) {
+			matched = append(matched, cc)
 		}
 	}
+	s.connMutex.RUnlock()
+
+	s.logger.Printf("Draining %d connections tagged %q", len(matched), tag)
+	if forced := s.drainConnections(matched, fmt.Sprintf("drained by tag %q", tag), timeout); forced > 0 {
+		return len(matched), fmt.Errorf("drain of tag %q timed out; %d connections closed forcibly", tag, forced)
+	}
+	return len(matched), nil
 }
 
-// prettyPrintJSON formats a map for logging using strings.Builder for efficiency
-func prettyPrintJSON(data map[string]interface{}, indent string) string {
-	var builder strings.Builder
-	for key, value := range data {
-		switch v := value.(type) {
-		case map[string]interface{}:
-			builder.WriteString(fmt.Sprintf("%s%s:\n%s", indent, key, prettyPrintJSON(v, indent+"  ")))
-		case []interface{}:
-			builder.WriteString(fmt.Sprintf("%s%s: [array of %d elements]\n", indent, key, len(v)))
+// DrainToCount gracefully closes connections until at most target remain,
+// choosing victims by DrainPolicy: the oldest connections first, or with
+// "idlest" those that have gone longest without a message. Connections still
+// open after timeout are closed forcibly. It returns the number drained.
+func (s *Server) DrainToCount(target int, timeout time.Duration) (int, error) {
+	s.connMutex.RLock()
+	candidates := make([]*clientConn, 0, len(s.conns))
+	for _, cc := range s.conns {
+		candidates = append(candidates, cc)
+	}
+	s.connMutex.RUnlock()
+
+	excess := len(candidates) - max(target, 0)
+	if excess <= 0 {
+		return 0, nil
+	}
+	if s.config.DrainPolicy == "idlest" {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].lastActivity.Load() < candidates[j].lastActivity.Load()
+		})
+	} else {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].connectedAt.Before(candidates[j].connectedAt)
+		})
+	}
+	victims := candidates[:excess]
+
+	s.logger.Printf("Draining %d connections (%s first) down to %d", len(victims), s.drainPolicy(), target)
+	if forced := s.drainConnections(victims, fmt.Sprintf("drained to %d connections", target), timeout); forced > 0 {
+		return len(victims), fmt.Errorf("drain to %d timed out; %d connections closed forcibly", target, forced)
+	}
+	return len(victims), nil
+}
+
+// drainPolicy returns the effective DrainPolicy
+func (s *Server) drainPolicy() string {
+	if s.config.DrainPolicy == "" {
+		return "oldest"
+	}
+	return s.config.DrainPolicy
+}
+
+// drainConnections stops the connections from taking new messages, lets each
+// finish and flush its current response, and waits for them to close. Any
+// still open after timeout are closed forcibly; their number is returned.
+func (s *Server) drainConnections(conns []*clientConn, reason string, timeout time.Duration) int {
+	for _, cc := range conns {
+		cc.draining.Store(true)
+		cc.stop("drained", reason)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	forced, expired := 0, false
+	for _, cc := range conns {
+		if !expired {
+			select {
+			case <-cc.done:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		// Past the deadline: force-close whatever has not finished
+		select {
+		case <-cc.done:
 		default:
-			builder.WriteString(fmt.Sprintf("%s%s: %v\n", indent, key, v))
+			cc.conn.Close()
+			forced++
 		}
 	}
-	return builder.String()
+	return forced
 }
 
-// handleConnection processes individual client connections
-func (s *Server) handleConnection(conn net.Conn) {
-	defer func() {
-		conn.Close()
-		<-s.connSem // Release semaphore slot
-		s.removeConnection(conn)
-	}()
+// Connections returns a description of every tracked connection, oldest first
+func (s *Server) Connections() []ConnInfo {
+	s.connMutex.RLock()
+	infos := make([]ConnInfo, 0, len(s.conns))
+	for conn, cc := range s.conns {
+		_, isTLS := conn.(*tls.Conn)
+		infos = append(infos, ConnInfo{
+			ID:           cc.id,
+			RemoteAddr:   cc.remoteAddr,
+			ConnectedAt:  cc.connectedAt,
+			AgeSeconds:   cc.Age().Seconds(),
+			IdleSeconds:  time.Since(time.Unix(0, cc.lastActivity.Load())).Seconds(),
+			TLS:          isTLS,
+			Tags:         cc.tagList(),
+			Identity:     cc.identityName(),
+			Messages:     cc.messages.Load(),
+			Version:      cc.protocolVersion(),
+			PingOnly:     !cc.workSeen.Load(),
+			BytesRead:    cc.counter.read.Load(),
+			BytesWritten: cc.counter.written.Load(),
+		})
+	}
+	s.connMutex.RUnlock()
 
-	s.addConnection(conn)
-	remoteAddr := conn.RemoteAddr().String()
-	s.logger.Printf("New connection from: %s", remoteAddr)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
 
-	decoder := json.NewDecoder(conn)
-	encoder := json.NewEncoder(conn)
+// connDurationBuckets are the connection_duration_seconds bucket bounds,
+// reaching a week so long-lived connections still land in a finite bucket
+var connDurationBuckets = []float64{1, 10, 60, 600, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
 
-	for {
-		var msg Message
-		if err := decoder.Decode(&msg); err != nil {
-			if err.Error() != "EOF" {
-				s.logger.Printf("Error decoding message from %s: %v", remoteAddr, err)
-			} else {
-				s.logger.Printf("Connection closed by client: %s", remoteAddr)
-			}
-			return
+// messageDurationBuckets are the message_duration_seconds bucket bounds,
+// from 100µs to 10s
+var messageDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// serverMetrics holds the server-wide metric series. None are labelled by
+// connection, so their number stays fixed however many clients connect.
+type serverMetrics struct {
+	connectionsAccepted atomic.Uint64
+	messagesReceived    atomic.Uint64
+	broadcastsDropped   atomic.Uint64
+	broadcastsExpired   atomic.Uint64
+	pingOnlyClosed      atomic.Uint64 // MaxPingOnlyDuration
+	broadcastsShed      atomic.Uint64 // MaxBufferedBytes
+	clockSkewed         atomic.Uint64 // MaxClockSkew
+	connDuration        *histogram    // Observed when a connection closes
+	messageDuration     *histogram    // Sampled per MetricsSampleRate
+	messageSeq          atomic.Uint64 // Picks the messages to sample
+
+	// By negotiated protocol version, plus "none"; fixed by NewServer so it
+	// is read without locking
+	byVersion map[string]*versionCounters
+
+	slowHandlers sync.Map // Message type to *atomic.Uint64; only handled types
+}
+
+// slowHandlerCalls returns the slow-call counter for msgType
+func (m *serverMetrics) slowHandlerCalls(msgType string) *atomic.Uint64 {
+	if c, ok := m.slowHandlers.Load(msgType); ok {
+		return c.(*atomic.Uint64)
+	}
+	c, _ := m.slowHandlers.LoadOrStore(msgType, new(atomic.Uint64))
+	return c.(*atomic.Uint64)
+}
+
+type versionCounters struct {
+	connections atomic.Uint64 // Counted on negotiation, or on close for "none"
+	messages    atomic.Uint64
+}
+
+// versionCounters returns the counters for cc's protocol version, or nil
+// when ProtocolVersions is unset
+func (s *Server) versionCounters(cc *clientConn) *versionCounters {
+	if v := cc.protocolVersion(); v != "" {
+		return s.metrics.byVersion[v]
+	}
+	return s.metrics.byVersion["none"]
+}
+
+// histogram is a fixed-bucket Prometheus histogram
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // Per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.observeN(v, 1)
+}
+
+// observeN records v as n observations, for sampled measurements
+func (h *histogram) observeN(v float64, n uint64) {
+	i := sort.SearchFloat64s(h.bounds, v) // First bound >= v
+	h.mu.Lock()
+	h.counts[i] += n
+	h.sum += v * float64(n)
+	h.count += n
+	h.mu.Unlock()
+}
+
+// write writes the histogram series in the Prometheus text format
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// WriteMetrics writes the server's metrics in the Prometheus text format.
+// Connection-scoped values are aggregated unless MetricsCardinalityMode is
+// "per_connection".
+func (s *Server) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	conns := s.Connections()
+	var oldest float64
+	for _, info := range conns {
+		oldest = max(oldest, info.AgeSeconds)
+	}
+
+	metric("server_connections_active", "gauge", "Open client connections.")
+	fmt.Fprintf(bw, "server_connections_active %d\n", s.activeConnections())
+	metric("server_connections_accepted_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(bw, "server_connections_accepted_total %d\n", s.metrics.connectionsAccepted.Load())
+	metric("server_connection_oldest_age_seconds", "gauge", "Age of the longest-open client connection.")
+	fmt.Fprintf(bw, "server_connection_oldest_age_seconds %s\n", strconv.FormatFloat(oldest, 'g', -1, 64))
+	metric("server_connection_duration_seconds", "histogram", "Lifetime of closed client connections.")
+	s.metrics.connDuration.write(bw, "server_connection_duration_seconds")
+	metric("server_message_duration_seconds", "histogram", "Time to process and answer a message, sampled per MetricsSampleRate.")
+	s.metrics.messageDuration.write(bw, "server_message_duration_seconds")
+	metric("server_messages_received_total", "counter", "Messages received from clients.")
+	fmt.Fprintf(bw, "server_messages_received_total %d\n", s.metrics.messagesReceived.Load())
+	metric("server_broadcasts_dropped_total", "counter", "Broadcast messages dropped because a connection's queue was full.")
+	fmt.Fprintf(bw, "server_broadcasts_dropped_total %d\n", s.metrics.broadcastsDropped.Load())
+	metric("server_broadcasts_expired_total", "counter", "Broadcast messages dropped because they expired before delivery.")
+	fmt.Fprintf(bw, "server_broadcasts_expired_total %d\n", s.metrics.broadcastsExpired.Load())
+	metric("server_broadcasts_shed_total", "counter", "Broadcast messages shed to keep queued bytes within MaxBufferedBytes.")
+	fmt.Fprintf(bw, "server_broadcasts_shed_total %d\n", s.metrics.broadcastsShed.Load())
+	metric("server_buffered_bytes", "gauge", "Approximate bytes of broadcast messages queued across connections.")
+	fmt.Fprintf(bw, "server_buffered_bytes %d\n", s.bufferedBytes.Load())
+	metric("server_clock_skewed_messages_total", "counter", "Messages whose client time was more than MaxClockSkew from the server's.")
+	fmt.Fprintf(bw, "server_clock_skewed_messages_total %d\n", s.metrics.clockSkewed.Load())
+	metric("server_ping_only_closed_total", "counter", "Connections closed for sending only pings for MaxPingOnlyDuration.")
+	fmt.Fprintf(bw, "server_ping_only_closed_total %d\n", s.metrics.pingOnlyClosed.Load())
+
+	if len(s.metrics.byVersion) > 0 {
+		versions := append(append([]string(nil), s.config.ProtocolVersions...), "none")
+		metric("server_connections_by_version_total", "counter", "Client connections, by negotiated protocol version.")
+		for _, v := range versions {
+			fmt.Fprintf(bw, "server_connections_by_version_total{version=%q} %d\n", v, s.metrics.byVersion[v].connections.Load())
+		}
+		metric("server_messages_received_by_version_total", "counter", "Messages received, by negotiated protocol version.")
+		for _, v := range versions {
+			fmt.Fprintf(bw, "server_messages_received_by_version_total{version=%q} %d\n", v, s.metrics.byVersion[v].messages.Load())
+		}
+	}
+
+	var slowTypes []string
+	s.metrics.slowHandlers.Range(func(k, _ interface{}) bool {
+		slowTypes = append(slowTypes, k.(string))
+		return true
+	})
+	if len(slowTypes) > 0 {
+		sort.Strings(slowTypes)
+		metric("server_slow_handler_calls_total", "counter", "Handler calls slower than SlowHandlerThreshold, by message type.")
+		for _, t := range slowTypes {
+			fmt.Fprintf(bw, "server_slow_handler_calls_total{type=%q} %d\n", t, s.metrics.slowHandlerCalls(t).Load())
 		}
+	}
 
-		// Log received message details
-		s.logger.Printf("\nReceived message from %s:\n"+
-			"╔══════════════════════════════\n"+
-			"║ ID: %s\n"+
-			"║ Type: %s\n"+
-			"║ Source: %s\n"+
-			"║ Time: %s\n"+
-			"║ Payload:\n%s"+
-			"╚══════════════════════════════",
-			remoteAddr,
-			msg.ID,
-			msg.Type,
-			msg.Source,
-			msg.Time.Format(time.RFC3339Nano),
-			prettyPrintJSON(msg.Payload, "║   "))
+	if s.config.MetricsCardinalityMode == "per_connection" {
+		metric("server_connection_messages_received_total", "counter", "Messages received, by connection.")
+		for _, info := range conns {
+			fmt.Fprintf(bw, "server_connection_messages_received_total{conn_id=%q} %d\n", info.ID, info.Messages)
+		}
+		metric("server_connection_age_seconds", "gauge", "Connection age, by connection.")
+		for _, info := range conns {
+			fmt.Fprintf(bw, "server_connection_age_seconds{conn_id=%q} %s\n", info.ID, strconv.FormatFloat(info.AgeSeconds, 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
 
-		// Process message
-		msg.Time = time.Now()
+// MetricsSnapshot is a point-in-time copy of the server-wide metrics, for
+// push-based reporting
+type MetricsSnapshot struct {
+	Time time.Time `json:"time"`
 
-		// Send response
-		if err := encoder.Encode(msg); err != nil {
-			s.logger.Printf("Error sending response to %s: %v", remoteAddr, err)
-			return
+	// Counters
+	ConnectionsAccepted  uint64            `json:"connections_accepted"`
+	MessagesReceived     uint64            `json:"messages_received"`
+	BroadcastsDropped    uint64            `json:"broadcasts_dropped"`
+	BroadcastsExpired    uint64            `json:"broadcasts_expired"`
+	PingOnlyClosed       uint64            `json:"ping_only_closed"`
+	BroadcastsShed       uint64            `json:"broadcasts_shed"`
+	ClockSkewedMessages  uint64            `json:"clock_skewed_messages"`
+	ConnectionsByVersion map[string]uint64 `json:"connections_by_version,omitempty"`
+	MessagesByVersion    map[string]uint64 `json:"messages_by_version,omitempty"`
+	SlowHandlerCalls     map[string]uint64 `json:"slow_handler_calls,omitempty"`
+
+	// Gauges
+	ConnectionsActive          int     `json:"connections_active"`
+	BufferedBytes              int64   `json:"buffered_bytes"`
+	ConnectionOldestAgeSeconds float64 `json:"connection_oldest_age_seconds"`
+
+	// Set in the final push of FlushMetricsOnShutdown
+	ShutdownBacklog *BacklogReport `json:"shutdown_backlog,omitempty"`
+}
+
+// SnapshotAndReset returns the current metrics and resets the counters to
+// zero, so a reporter pushing deltas sees only the activity since its
+// previous call. Each counter is read and zeroed in one atomic step, so no
+// increment is lost or counted twice across calls. Gauges are reported but
+// not reset. The counters served by WriteMetrics restart from zero too,
+// which Prometheus treats as a counter reset.
+func (s *Server) SnapshotAndReset() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		Time:                time.Now(),
+		ConnectionsAccepted: s.metrics.connectionsAccepted.Swap(0),
+		MessagesReceived:    s.metrics.messagesReceived.Swap(0),
+		BroadcastsDropped:   s.metrics.broadcastsDropped.Swap(0),
+		BroadcastsExpired:   s.metrics.broadcastsExpired.Swap(0),
+		PingOnlyClosed:      s.metrics.pingOnlyClosed.Swap(0),
+		BroadcastsShed:      s.metrics.broadcastsShed.Swap(0),
+		ClockSkewedMessages: s.metrics.clockSkewed.Swap(0),
+		ConnectionsActive:   s.activeConnections(),
+		BufferedBytes:       s.bufferedBytes.Load(),
+	}
+	if s.backlog.counting.Load() {
+		backlog := s.ShutdownBacklog()
+		snap.ShutdownBacklog = &backlog
+	}
+	if len(s.metrics.byVersion) > 0 {
+		snap.ConnectionsByVersion = make(map[string]uint64, len(s.metrics.byVersion))
+		snap.MessagesByVersion = make(map[string]uint64, len(s.metrics.byVersion))
+		for v, vc := range s.metrics.byVersion {
+			snap.ConnectionsByVersion[v] = vc.connections.Swap(0)
+			snap.MessagesByVersion[v] = vc.messages.Swap(0)
+		}
+	}
+	s.metrics.slowHandlers.Range(func(k, c interface{}) bool {
+		if snap.SlowHandlerCalls == nil {
+			snap.SlowHandlerCalls = make(map[string]uint64)
 		}
+		snap.SlowHandlerCalls[k.(string)] = c.(*atomic.Uint64).Swap(0)
+		return true
+	})
+	for _, info := range s.Connections() {
+		snap.ConnectionOldestAgeSeconds = max(snap.ConnectionOldestAgeSeconds, info.AgeSeconds)
 	}
+	return snap
 }
 
-// addConnection registers a new client connection
-func (s *Server) addConnection(conn net.Conn) {
-	s.connMutex.Lock()
-	defer s.connMutex.Unlock()
-	s.conns[conn] = struct{}{}
+// Component is a subsystem that starts and stops with the Server, such as
+// an extra listener or HTTP server, registered with AddComponent
+type Component interface {
+	Start() error
+	Shutdown(ctx context.Context) error
 }
 
-// removeConnection removes a client connection from tracking
-func (s *Server) removeConnection(conn net.Conn) {
-	s.connMutex.Lock()
-	defer s.connMutex.Unlock()
-	delete(s.conns, conn)
+type namedComponent struct {
+	name string
+	Component
+}
+
+// AddComponent registers c, under name for logs and errors, to be started by
+// Start once the TCP listener is open and shut down when Shutdown begins.
+// Components start in registration order, after the built-in metrics
+// listener, and shut down in reverse order. If one fails to start, or the
+// event log cannot be opened, those already started are shut down and Start
+// returns the error. Call it before Start.
+func (s *Server) AddComponent(name string, c Component) {
+	s.components = append(s.components, namedComponent{name, c})
+}
+
+// shutdownComponents shuts the components down in reverse order, returning
+// the first error
+func (s *Server) shutdownComponents(ctx context.Context) error {
+	var first error
+	for i := len(s.components) - 1; i >= 0; i-- {
+		c := s.components[i]
+		if err := c.Shutdown(ctx); err != nil {
+			s.logErrorf("Error shutting down %s: %v", c.name, err)
+			if first == nil {
+				first = fmt.Errorf("shutting down %s: %w", c.name, err)
+			}
+		}
+	}
+	return first
+}
+
+// metricsComponent runs the MetricsAddr HTTP server
+type metricsComponent struct{ s *Server }
+
+func (m metricsComponent) Start() error { return m.s.serveMetrics() }
+
+func (m metricsComponent) Shutdown(context.Context) error { return m.s.metricsServer.Close() }
+
+// serveMetrics starts the HTTP server for MetricsAddr; Shutdown closes it
+func (s *Server) serveMetrics() error {
+	ln, err := net.Listen("tcp", s.config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := s.WriteMetrics(w); err != nil {
+			s.logger.Printf("Error writing metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.versionInfo())
+	})
+	s.metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.metricsServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Printf("Metrics server error: %v", err)
+		}
+	}()
+	s.logger.Printf("Serving metrics on %s/metrics, readiness on %[1]s/readyz and build info on %[1]s/version", ln.Addr())
+	return nil
 }
 
-// Shutdown gracefully stops the server
+// Shutdown gracefully stops the server in four phases, each logged as it
+// begins:
+//
+//  1. stop-accept: close the listener, shut down the components and
+//     refuse late registrations
+//  2. notify-clients: send every client a "shutdown" message
+//  3. drain-handlers: stop reading new messages and wait for in-progress
+//     handlers to finish and flush their responses
+//  4. force-close: cancel remaining handlers, close every connection and wait
+//     for their goroutines to exit
+//
+// Phases 2 and 3 are bounded by ShutdownNotifyTimeout and
+// ShutdownDrainTimeout, or when those are unset by a share of the time left
+// on ctx; phase 4 has whatever remains of ctx. With no connections open
+// every phase completes at once, so Shutdown returns nil promptly even if
+// ctx is already done.
 func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Printf("Shutdown phase 1/4: stop-accept")
 	close(s.shutdown)
-
-	// Stop accepting new connections
 	if err := s.listener.Close(); err != nil {
 		s.logger.Printf("Error closing listener: %v", err)
 	}
-
-	// Close all existing connections
+	componentErr := s.shutdownComponents(ctx)
+	s.acceptLoops.Wait()
 	s.connMutex.Lock()
-	for conn := range s.conns {
-		if err := conn.Close(); err != nil {
-			s.logger.Printf("Error closing connection: %v", err)
-		}
+	s.closing = true
+	conns := make([]*clientConn, 0, len(s.conns))
+	for _, cc := range s.conns {
+		conns = append(conns, cc)
 	}
 	s.connMutex.Unlock()
 
-	// Wait for context timeout
+	budget := shutdownPhaseBudget(ctx, s.config.ShutdownNotifyTimeout, 0.1, defaultShutdownNotifyTimeout)
+	s.logger.Printf("Shutdown phase 2/4: notify-clients (%d connections, budget %v)", len(conns), budget)
+	s.notifyShutdown(ctx, conns, budget)
+
+	budget = shutdownPhaseBudget(ctx, s.config.ShutdownDrainTimeout, 0.8, 0)
+	s.logger.Printf("Shutdown phase 3/4: drain-handlers (budget %v)", budget)
+	s.emit(DrainStarted, nil)
+	s.backlog.counting.Store(true)
+	for _, cc := range conns {
+		cc.draining.Store(true)
+		s.backlog.queued.Add(uint64(max(cc.outboundLeft.Load(), 0)))
+	}
+	s.logger.Printf("%d broadcasts queued across %d connections at the start of drain", s.backlog.queued.Load(), len(conns))
+	for _, cc := range conns {
+		cc.stop("shutdown", "server shutting down")
+	}
+	drainCtx, cancelDrain := withOptionalTimeout(ctx, budget)
+	err := s.waitForDrain(drainCtx)
+	cancelDrain()
+
+	if err != nil {
+		s.logger.Printf("Shutdown phase 4/4: force-close (%d connections still open)", s.activeConnections())
+		s.cancel()
+		s.connMutex.RLock()
+		for conn := range s.conns {
+			if err := conn.Close(); err != nil {
+				s.logger.Printf("Error closing connection: %v", err)
+			}
+		}
+		s.connMutex.RUnlock()
+		err = s.waitForDrain(ctx)
+	}
+	if err == nil {
+		err = componentErr
+	}
+	backlog := s.ShutdownBacklog()
+	s.logger.Printf("Shutdown backlog: %d broadcasts queued, %d delivered, %d dropped", backlog.Queued, backlog.Delivered, backlog.Dropped)
+	if s.metricsPushDone != nil {
+		select {
+		case <-s.metricsPushDone: // A periodic push in progress has finished
+		case <-ctx.Done():
+		}
+		if s.config.FlushMetricsOnShutdown {
+			s.logger.Printf("Flushing metrics to the sink")
+			if flushErr := s.flushMetrics(ctx); flushErr != nil && err == nil {
+				err = fmt.Errorf("flushing metrics: %w", flushErr)
+			}
+		}
+	}
+	s.cancel()
+	s.logger.Printf("Shutdown complete")
+	s.emit(ShutdownComplete, nil)
+	if s.eventLog != nil {
+		// Let the final events reach the disk before the process exits
+		select {
+		case <-s.eventLog.closed:
+		case <-ctx.Done():
+		case <-time.After(eventLogFlushTimeout):
+		}
+	}
+	return err
+}
+
+// shutdownPhaseBudget returns how long a shutdown phase may run: configured
+// if set, otherwise share of the time left on ctx, or fallback when ctx has
+// no deadline. Zero means no limit beyond ctx itself.
+func shutdownPhaseBudget(ctx context.Context, configured time.Duration, share float64, fallback time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return max(configured, fallback)
+	}
+	remaining := max(time.Until(deadline), 0)
+	if configured > 0 {
+		return min(configured, remaining)
+	}
+	return time.Duration(float64(remaining) * share)
+}
+
+// withOptionalTimeout derives a context bounded by timeout, or only by ctx
+// when timeout is zero
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// notifyShutdown sends the shutdown notice to every connection concurrently,
+// waiting at most budget; a client too slow to take it is not waited for
+func (s *Server) notifyShutdown(ctx context.Context, conns []*clientConn, budget time.Duration) {
+	if len(conns) == 0 {
+		return
+	}
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, cc := range conns {
+		wg.Add(1)
+		go func(cc *clientConn) {
+			defer wg.Done()
+			payload := map[string]interface{}{"message": "server is shutting down"}
+			if target := s.redirectTarget(cc); target != "" {
+				payload["redirect"] = target
+			}
+			cc.send(Message{Type: "shutdown", Time: now, Payload: payload})
+		}(cc)
+	}
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+
+	notifyCtx, cancel := withOptionalTimeout(ctx, budget)
+	defer cancel()
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
-		return nil
+	case <-sent:
+	case <-notifyCtx.Done():
+		s.logger.Printf("Shutdown notice not delivered to every client within %v", budget)
+	}
+}
+
+// redirectTarget returns the address cc should reconnect to after
+// shutdown, or "" for none
+func (s *Server) redirectTarget(cc *clientConn) string {
+	if s.config.AffinityFunc != nil {
+		if target := s.config.AffinityFunc(ConnContext{cc: cc, s: s}); target != "" {
+			return target
+		}
+	}
+	return s.config.RedirectAddr
+}
+
+// activeConnections returns the number of tracked connections
+func (s *Server) activeConnections() int {
+	return int(s.liveCount.Load())
+}
+
+// waitForDrain blocks until every connection handler has exited, reporting
+// progress through OnDrainProgress on each tick
+func (s *Server) waitForDrain(ctx context.Context) error {
+	interval := s.config.DrainProgressInterval
+	if interval <= 0 {
+		interval = defaultDrainProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		remaining := s.activeConnections()
+		if s.config.OnDrainProgress != nil {
+			s.config.OnDrainProgress(remaining)
+		}
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
 func main() {
 	// Command line flags
-	port := flag.String("port", "8080", "Server port")
-	maxConns := flag.Int("max-connections", 1000000, "Maximum concurrent connections")
+	port := flag.String("port", defaultPort, "Server port")
+	maxConns := flag.Int("max-connections", defaultMaxConnections, "Maximum concurrent connections")
+	fdFraction := flag.Float64("max-conn-fd-fraction", 0, "Also cap connections at this fraction of the open file limit, e.g. 0.8 (0 disables)")
+	addrFamily := flag.String("address-family", defaultAddressFamily, "Listening address family: dual, ipv4 or ipv6")
+	acceptLoops := flag.Int("accept-loops", 1, "Goroutines accepting connections concurrently")
+	backlog := flag.Int("listen-backlog", 0, "Listen backlog size (0 uses the OS default)")
+	reusePort := flag.Bool("reuse-port", false, "Set SO_REUSEPORT so several instances can share the port (Linux only)")
+	deltaResponses := flag.Bool("delta-responses", false, "Respond with only the fields that differ from the request")
+	ackOnly := flag.Bool("ack-only", false, "Respond with an acknowledgment instead of echoing the full message")
+	writeBuf := flag.Int("write-buffer-size", 0, "Batch responses in a buffer of this many bytes (0 disables batching)")
+	drainBroadcasts := flag.Bool("drain-broadcasts", false, "Deliver queued broadcasts during the shutdown drain instead of dropping them")
+	flushLatency := flag.Duration("max-flush-latency", defaultMaxFlushLatency, "Longest a batched response may wait before being flushed")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM); enables TLS with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file (PEM) for verifying client certificates, which are then required")
+	certReload := flag.Duration("cert-reload-interval", 0, "Check the TLS certificate files for changes this often (0 disables)")
+	handshakeTimeout := flag.Duration("handshake-timeout", defaultHandshakeTimeout, "Close TLS connections whose handshake takes longer than this")
+	maxHandshakes := flag.Int("max-concurrent-handshakes", 0, "Maximum TLS handshakes in progress at once (0 is unlimited)")
+	sampleRate := flag.Float64("metrics-sample-rate", 1, "Fraction of messages timed for the message duration histogram")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Open a message type's circuit breaker after this many consecutive handler failures (0 disables)")
+	breakerCooldown := flag.Duration("breaker-cooldown", defaultBreakerCooldown, "How long an open circuit breaker rejects messages before a trial call")
+	replayOnRecovery := flag.Bool("replay-on-recovery", false, "Handle messages rejected by an open breaker again once it recovers")
+	slowHandler := flag.Duration("slow-handler-threshold", defaultSlowHandlerThreshold, "Log a warning for handler calls slower than this")
+	postHandshakeIdle := flag.Duration("post-handshake-idle-timeout", 0, "Close connections that send nothing this long after the handshake (0 disables)")
+	maxPendingFirst := flag.Int("max-pending-first-message", 0, "Reject new connections while this many have yet to send a message (0 disables)")
+	writeRetries := flag.Int("write-retries", 0, "Times to retry a write that times out before closing the connection")
+	maxGoroutines := flag.Int("max-goroutines", 0, "Reject new connections while this many goroutines are running (0 disables)")
+	maxPingOnly := flag.Duration("max-ping-only-duration", 0, "Close connections that send only pings for this long (0 disables)")
+	maxLifetime := flag.Duration("max-conn-lifetime", 0, "Close connections older than this so clients reconnect (0 disables)")
+	compression := flag.String("compression", "none", "Compression: none, deflate (whole stream) or message (per message)")
+	maxLevel := flag.Int("max-compression-level", 0, "Highest DEFLATE level a client may request in hello with message compression (0 disables)")
+	compressMin := flag.Int("compress-min-bytes", 0, "Smallest message compressed in message mode (0 uses the default)")
+	compressionDict := flag.String("compression-dict", "", "Preset dictionary file for deflate compression")
+	useNumber := flag.Bool("use-json-number", false, "Keep payload numbers exact (json.Number) instead of float64")
+	invalidUTF8 := flag.String("invalid-utf8", "", "Handle invalid UTF-8 in outgoing payloads: replace or base64 (default: the encoder's replacement)")
+	timeFormat := flag.String("time-format", TimeFormatRFC3339Nano, "Wire format of message times: rfc3339nano, rfc3339, unix or unix_millis")
+	strict := flag.Bool("strict-decoding", false, "Reject messages containing unknown fields")
+	warmup := flag.Duration("warmup-duration", 0, "Reject connections with not_ready for this long after starting (0 disables)")
+	eventLogFile := flag.String("event-log-file", "", "Append lifecycle events to this file; connections are rejected while it is unwritable")
+	rateLimitPolicy := flag.String("rate-limit-policy", "throttle", "What happens to messages over the rate limits: throttle or reject")
+	msgRate := flag.Float64("messages-per-second", 0, "Messages each connection may send per second (0 is unlimited)")
+	byteRate := flag.Float64("bytes-per-second", 0, "Bytes each connection may send per second (0 is unlimited)")
+	broadcastRate := flag.Float64("broadcast-rate", 0, "Broadcast messages sent per second to each connection (0 is unlimited)")
+	broadcastBurst := flag.Int("broadcast-burst", 0, "Broadcast messages a connection may receive in a burst above -broadcast-rate")
+	detectGzip := flag.Bool("detect-gzip", false, "Accept gzip-compressed connections, detected by their magic bytes")
+	connSummary := flag.Bool("connection-summary-log", false, "Log a JSON summary of each connection when it closes")
+	flowWindow := flag.Int("flow-control-window", 0, "Credits granted to each client for credit-based flow control; 0 disables")
+	maxSkew := flag.Duration("max-clock-skew", 0, "Log messages whose client time is further than this from the server's (0 disables)")
+	rejectSkew := flag.Bool("reject-clock-skew", false, "Answer messages beyond -max-clock-skew with clock_skew instead of only logging them")
+	allowNoResponse := flag.Bool("allow-no-response", false, "Let clients opt out of all responses with no_response in hello")
+	declareTypes := flag.Bool("enable-type-declarations", false, "Let clients declare their message types and required fields in hello")
+	subscriptions := flag.Bool("enable-subscriptions", false, "Accept subscribe and unsubscribe messages for topic broadcasts")
+	maxTopics := flag.Int("max-topics-per-conn", 0, "Distinct topics each connection may subscribe to (0 is unlimited)")
+	transactions := flag.Bool("enable-transactions", false, "Accept begin, commit and rollback messages grouping messages into transactions")
+	codec := flag.String("codec", "json", "Wire encoding: json or msgpack")
+	sniffCodec := flag.Bool("sniff-codec", false, "Pick each connection's codec from its first byte, falling back to -codec")
+	maxBuffered := flag.Int64("max-buffered-bytes", 0, "Approximate bytes of broadcasts queued across all connections before the oldest are shed (0 is unlimited)")
+	outboundQueue := flag.Int("outbound-queue-size", 0, "Broadcast messages queued per connection before new ones are dropped (0 uses the default)")
+	redirectAddr := flag.String("redirect-addr", "", "Address sent in the shutdown notice for clients to reconnect to (empty sends none)")
+	forceExit := flag.Duration("force-exit-after", 0, "Exit this long after a shutdown signal even if connections are still draining (0 waits)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (empty disables)")
+	versions := flag.String("protocol-versions", "", "Comma-separated protocol versions to negotiate through hello, most preferred first")
+	metricsMode := flag.String("metrics-cardinality", "aggregate", "Metric labelling: aggregate, or per_connection (small deployments only)")
+	maxConnBytes := flag.Int64("max-conn-bytes", 0, "Close connections after this many bytes read and written in total (0 is unlimited)")
+	maxKeys := flag.Int("max-payload-keys", 0, "Reject payloads with more object keys than this, at any depth (0 is unlimited)")
+	maxKeyLen := flag.Int("max-key-length", 0, "Reject payloads with a key longer than this many bytes (0 is unlimited)")
+	dumpFile := flag.String("state-dump-file", "", "File to write the SIGUSR2 state dump to (default: the log)")
+	enableAdmin := flag.Bool("enable-admin", false, "Accept admin commands (list_inflight, cancel_inflight, list_connections, set_log_level, trace)")
+	traceBuffer := flag.Int("trace-buffer-size", 0, "Keep each connection's last this many requests and responses for the trace admin command (0 disables)")
+	logLevel := flag.String("log-level", "info", "Log level: info or debug; SIGUSR1 toggles between them")
 	flag.Parse()
 
+	lastRemaining := -1 // Last count OnDrainProgress logged
 	config := Config{
-		Port:            *port,
-		ReadTimeout:     30 * time.Second,
-		WriteTimeout:    30 * time.Second,
-		MaxConnections:  *maxConns,
-		ShutdownTimeout: 30 * time.Second,
+		Port:                     *port,
+		MaxConnections:           *maxConns,
+		MaxConnFDFraction:        *fdFraction,
+		ForceExitAfter:           *forceExit,
+		RedirectAddr:             *redirectAddr,
+		MetricsAddr:              *metricsAddr,
+		MaxPayloadKeys:           *maxKeys,
+		MaxConnBytes:             *maxConnBytes,
+		MaxKeyLength:             *maxKeyLen,
+		MetricsCardinalityMode:   *metricsMode,
+		EnableAdmin:              *enableAdmin,
+		LogLevel:                 *logLevel,
+		TraceBufferSize:          *traceBuffer,
+		AddressFamily:            *addrFamily,
+		ListenBacklog:            *backlog,
+		AcceptLoops:              *acceptLoops,
+		ReusePort:                *reusePort,
+		AckOnly:                  *ackOnly,
+		DeltaResponses:           *deltaResponses,
+		WriteBufferSize:          *writeBuf,
+		MaxFlushLatency:          *flushLatency,
+		DrainBroadcasts:          *drainBroadcasts,
+		TLSCertFile:              *tlsCert,
+		TLSKeyFile:               *tlsKey,
+		TLSClientCAFile:          *tlsClientCA,
+		CertReloadInterval:       *certReload,
+		MaxConnLifetime:          *maxLifetime,
+		MaxPingOnlyDuration:      *maxPingOnly,
+		MaxConcurrentHandshakes:  *maxHandshakes,
+		HandshakeTimeout:         *handshakeTimeout,
+		MaxGoroutines:            *maxGoroutines,
+		WriteRetries:             *writeRetries,
+		MaxPendingFirstMessage:   *maxPendingFirst,
+		PostHandshakeIdleTimeout: *postHandshakeIdle,
+		SlowHandlerThreshold:     *slowHandler,
+		BreakerThreshold:         *breakerThreshold,
+		BreakerCooldown:          *breakerCooldown,
+		ReplayOnRecovery:         *replayOnRecovery,
+		MetricsSampleRate:        *sampleRate,
+		StrictDecoding:           *strict,
+		TimeFormat:               *timeFormat,
+		InvalidUTF8:              *invalidUTF8,
+		UseJSONNumber:            *useNumber,
+		Compression:              *compression,
+		CompressionDict:          *compressionDict,
+		CompressMinBytes:         *compressMin,
+		MaxCompressionLevel:      *maxLevel,
+		DetectGzip:               *detectGzip,
+		ConnectionSummaryLog:     *connSummary,
+		EnableTransactions:       *transactions,
+		EnableSubscriptions:      *subscriptions,
+		EnableTypeDeclarations:   *declareTypes,
+		AllowNoResponse:          *allowNoResponse,
+		MaxClockSkew:             *maxSkew,
+		RejectClockSkew:          *rejectSkew,
+		MaxTopicsPerConn:         *maxTopics,
+		FlowControlWindow:        *flowWindow,
+		Codec:                    *codec,
+		SniffCodec:               *sniffCodec,
+		OutboundQueueSize:        *outboundQueue,
+		MaxBufferedBytes:         *maxBuffered,
+		BroadcastRate:            *broadcastRate,
+		MessagesPerSecond:        *msgRate,
+		EventLogFile:             *eventLogFile,
+		WarmupDuration:           *warmup,
+		BytesPerSecond:           *byteRate,
+		RateLimitPolicy:          *rateLimitPolicy,
+		BroadcastBurst:           *broadcastBurst,
+		OnDrainProgress: func(remaining int) {
+			// Called on every drain tick; log only changes in the count
+			if remaining != lastRemaining {
+				lastRemaining = remaining
+				log.Printf("Draining: %d connections remaining", remaining)
+			}
+		},
+	}.WithDefaults()
+	if *versions != "" {
+		config.ProtocolVersions = strings.Split(*versions, ",")
 	}
 
 	server := NewServer(config)
@@ -222,15 +6519,87 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 
+	// Dump goroutines and connection state on SIGUSR2
+	dumpChan := make(chan os.Signal, 1)
+	notifyDumpSignal(dumpChan)
+	go func() {
+		for range dumpChan {
+			dumpState(server, *dumpFile)
+		}
+	}()
+
+	// Toggle debug logging on SIGUSR1
+	levelChan := make(chan os.Signal, 1)
+	notifyLogLevelSignal(levelChan)
+	go func() {
+		for range levelChan {
+			if server.LogLevel() == "debug" {
+				server.SetLogLevel("info")
+			} else {
+				server.SetLogLevel("debug")
+			}
+		}
+	}()
+
 	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
+	sigChan := make(chan os.Signal, 2)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	awaitShutdown(server, sigChan, config.ShutdownTimeout, config.ForceExitAfter, os.Exit)
+}
+
+// awaitShutdown blocks until the first signal on sigs, then shuts server down
+// gracefully within timeout. A second signal, or forceExitAfter elapsing
+// first when it is positive, calls exit(1) without waiting for the drain.
+func awaitShutdown(server *Server, sigs <-chan os.Signal, timeout, forceExitAfter time.Duration, exit func(int)) {
+	sig := <-sigs
+	log.Printf("Received %v, shutting down; signal again to exit immediately", sig)
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	var force <-chan time.Time
+	if forceExitAfter > 0 {
+		timer := time.NewTimer(forceExitAfter)
+		defer timer.Stop()
+		force = timer.C
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
+		return
+	case sig := <-sigs:
+		log.Printf("Received %v during shutdown; forcing exit", sig)
+	case <-force:
+		log.Printf("Shutdown still running after %v; forcing exit", forceExitAfter)
+	}
+	exit(1)
+}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Error during shutdown: %v", err)
+// dumpState writes the server state dump to path, or to the log if empty
+func dumpState(server *Server, path string) {
+	if path == "" {
+		var buf strings.Builder
+		server.DumpState(&buf)
+		log.Printf("State dump requested:\n%s", buf.String())
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Error creating state dump: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := server.DumpState(f); err != nil {
+		log.Printf("Error writing state dump: %v", err)
+		return
 	}
+	log.Printf("State dump written to %s", path)
 }
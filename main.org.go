@@ -1,4 +1,7 @@
 // main.go
+
+//go:build ignore
+
 package main
 
 import (
@@ -0,0 +1,3906 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"high-performance-server/client"
+)
+
+// testReadTimeout bounds each read a test client makes
+const testReadTimeout = 2 * time.Second
+
+// startServer starts a server for config on a free port with its log
+// discarded, and shuts it down when the test ends
+func startServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	s := newTestServer(t, config)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { stopServer(s) })
+	return s
+}
+
+// newTestServer returns a server for config, with defaults applied, a free
+// port and a short drain poll unless set, whose log is discarded
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	if config.Port == "" {
+		config.Port = "0"
+	}
+	if config.DrainProgressInterval == 0 {
+		config.DrainProgressInterval = 10 * time.Millisecond // Shut down without waiting a full default tick
+	}
+	s := NewServer(config.WithDefaults())
+	s.logger = log.New(io.Discard, "", 0)
+	return s
+}
+
+// stopServer shuts s down if it is still running
+func stopServer(s *Server) {
+	select {
+	case <-s.shutdown:
+		return
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+// captureLog sends s's log to a buffer the test can inspect
+func captureLog(s *Server) *syncBuffer {
+	buf := &syncBuffer{}
+	s.logger = log.New(buf, "", 0)
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer safe for the server's concurrent logging
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// serverAddr returns the loopback address s is listening on
+func serverAddr(s *Server) string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// testClient is a connection to a test server speaking line-delimited JSON
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialServer connects to s, closing the connection when the test ends
+func dialServer(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", serverAddr(s))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestClient(t, conn)
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// sendLine writes one raw line
+func (c *testClient) sendLine(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// send writes msg as JSON
+func (c *testClient) send(msg map[string]interface{}) {
+	c.t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatalf("marshal: %v", err)
+	}
+	c.sendLine(string(data))
+}
+
+// readLine returns the next line, failing the test on timeout
+func (c *testClient) readLine() string {
+	c.t.Helper()
+	line, err := c.tryReadLine(testReadTimeout)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return line
+}
+
+// tryReadLine returns the next line or the error that prevented it
+func (c *testClient) tryReadLine(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := c.r.ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// read decodes the next line into a generic message
+func (c *testClient) read() map[string]interface{} {
+	c.t.Helper()
+	line := c.readLine()
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		c.t.Fatalf("decoding %q: %v", line, err)
+	}
+	return msg
+}
+
+// request sends msg and returns the next message received
+func (c *testClient) request(msg map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.send(msg)
+	return c.read()
+}
+
+// expectClosed fails the test unless the server closes the connection
+// within timeout, returning the lines received before it did
+func (c *testClient) expectClosed(timeout time.Duration) []string {
+	c.t.Helper()
+	var lines []string
+	deadline := time.Now().Add(timeout)
+	for {
+		line, err := c.tryReadLine(time.Until(deadline))
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			return lines
+		}
+		if err != nil {
+			c.t.Fatalf("connection not closed within %v: %v", timeout, err)
+		}
+	}
+}
+
+// payload returns msg's payload object
+func payload(msg map[string]interface{}) map[string]interface{} {
+	p, _ := msg["payload"].(map[string]interface{})
+	return p
+}
+
+// errorReason returns the reason of an error message, or "" for others
+func errorReason(msg map[string]interface{}) string {
+	if msg["type"] != "error" {
+		return ""
+	}
+	reason, _ := payload(msg)["reason"].(string)
+	return reason
+}
+
+// errorMessage returns the human-readable message of an error message
+func errorMessage(msg map[string]interface{}) string {
+	text, _ := payload(msg)["message"].(string)
+	return text
+}
+
+// waitFor polls cond until it holds, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCancelInflightStopsHandler(t *testing.T) {
+	s := newTestServer(t, Config{EnableAdmin: true})
+	stopped := make(chan error, 1)
+	s.Handle("slow", func(ctx context.Context, msg Message) (Message, error) {
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return Message{}, ctx.Err()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	client := dialServer(t, s)
+	client.send(map[string]interface{}{"type": "slow", "id": "m1"})
+	waitFor(t, time.Second, "the handler to be in flight", func() bool { return len(s.InflightCalls()) == 1 })
+
+	admin := dialServer(t, s)
+	listed := payload(admin.request(map[string]interface{}{"type": "list_inflight", "id": "a1"}))["inflight"].([]interface{})
+	if len(listed) != 1 {
+		t.Fatalf("list_inflight returned %d calls, want 1", len(listed))
+	}
+	call := listed[0].(map[string]interface{})
+	if call["message_id"] != "m1" || call["type"] != "slow" || call["conn_id"] == "" || call["started_at"] == "" {
+		t.Fatalf("unexpected call %v", call)
+	}
+
+	resp := payload(admin.request(map[string]interface{}{"type": "cancel_inflight", "id": "a2", "payload": map[string]interface{}{"id": call["id"]}}))
+	if resp["cancelled"] != true {
+		t.Fatalf("cancel_inflight = %v, want cancelled", resp)
+	}
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("handler context error = %v, want Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not stop after cancel_inflight")
+	}
+	if reason := errorReason(client.read()); reason != "cancelled" {
+		t.Fatalf("client got reason %q, want cancelled", reason)
+	}
+	if calls := s.InflightCalls(); len(calls) != 0 {
+		t.Fatalf("InflightCalls = %v after cancel, want none", calls)
+	}
+}
+
+// listenPort returns the port s is listening on
+func listenPort(s *Server) string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+// haveIPv6 reports whether the IPv6 loopback can be bound
+func haveIPv6() bool {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+func TestAddressFamilyIPv4Only(t *testing.T) {
+	if !haveIPv6() {
+		t.Skip("IPv6 loopback unavailable")
+	}
+	s := startServer(t, Config{AddressFamily: "ipv4"})
+	port := listenPort(s)
+
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		t.Fatalf("IPv4 dial: %v", err)
+	}
+	conn.Close()
+	if conn, err := net.DialTimeout("tcp6", net.JoinHostPort("::1", port), time.Second); err == nil {
+		conn.Close()
+		t.Fatal("IPv6 dial succeeded against an IPv4-only listener")
+	}
+}
+
+func TestAddressFamilyRejectsUnknown(t *testing.T) {
+	err := Config{Port: "0", AddressFamily: "ipx"}.WithDefaults().Validate()
+	if err == nil || !strings.Contains(err.Error(), "AddressFamily") {
+		t.Fatalf("Validate = %v, want an AddressFamily error", err)
+	}
+}
+
+func TestDrainProgressReportsDecreasingCounts(t *testing.T) {
+	var mu sync.Mutex
+	var reports []int
+	s := newTestServer(t, Config{
+		DrainProgressInterval: 5 * time.Millisecond,
+		ShutdownDrainTimeout:  5 * time.Second,
+		OnDrainProgress: func(remaining int) {
+			mu.Lock()
+			reports = append(reports, remaining)
+			mu.Unlock()
+		},
+	})
+	release := make(chan struct{})
+	s.Handle("hold", func(ctx context.Context, msg Message) (Message, error) {
+		<-release
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		dialServer(t, s).send(map[string]interface{}{"type": "hold", "id": "h"})
+	}
+	waitFor(t, time.Second, "three handlers in flight", func() bool { return len(s.InflightCalls()) == 3 })
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 || reports[0] != 3 || reports[len(reports)-1] != 0 {
+		t.Fatalf("reports = %v, want them to run from 3 down to 0", reports)
+	}
+	seen := map[int]bool{}
+	for i, n := range reports {
+		if i > 0 && n > reports[i-1] {
+			t.Fatalf("reports = %v, count went up", reports)
+		}
+		seen[n] = true
+	}
+	if !seen[2] || !seen[1] {
+		t.Fatalf("reports = %v, want the intermediate counts 2 and 1", reports)
+	}
+}
+
+func TestListenBacklogServesConnections(t *testing.T) {
+	s := startServer(t, Config{ListenBacklog: 16})
+	client := dialServer(t, s)
+	resp := client.request(map[string]interface{}{"type": "echo", "id": "e1", "payload": map[string]interface{}{"n": 1}})
+	if resp["id"] != "e1" || payload(resp)["n"] != float64(1) {
+		t.Fatalf("echo = %v", resp)
+	}
+}
+
+func TestReusePortSharesPort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ReusePort is Linux only")
+	}
+	first := startServer(t, Config{ReusePort: true})
+	second := startServer(t, Config{ReusePort: true, Port: listenPort(first)})
+	if listenPort(second) != listenPort(first) {
+		t.Fatalf("second listener on port %s, want %s", listenPort(second), listenPort(first))
+	}
+
+	plain := newTestServer(t, Config{Port: listenPort(first)})
+	if err := plain.Start(); err == nil {
+		stopServer(plain)
+		t.Fatal("a listener without ReusePort bound the shared port")
+	}
+
+	// Stopping one listener must leave the port served by the other
+	stopServer(first)
+	client := dialServer(t, second)
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+		t.Fatalf("echo = %v", resp)
+	}
+}
+
+func TestValidateNamesEveryInvalidField(t *testing.T) {
+	config := Config{}.WithDefaults()
+	config.Port = "not-a-port"
+	config.ReadTimeout = -time.Second
+	config.MaxConnections = -5
+	config.WriteRetries = -1
+	err := NewServer(config).Start()
+	if err == nil {
+		t.Fatal("Start accepted an invalid config")
+	}
+	for _, field := range []string{"Port", "ReadTimeout", "MaxConnections", "WriteRetries"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("error %q does not name %s", err, field)
+		}
+	}
+	if err := (Config{Port: "0"}).WithDefaults().Validate(); err != nil {
+		t.Fatalf("default config invalid: %v", err)
+	}
+}
+
+func TestAckOnlyOmitsPayload(t *testing.T) {
+	msg := map[string]interface{}{"type": "echo", "id": "a1", "payload": map[string]interface{}{"big": "data"}}
+
+	resp := dialServer(t, startServer(t, Config{AckOnly: true})).request(msg)
+	if _, ok := resp["payload"]; ok {
+		t.Fatalf("ack-only response %v carries the payload", resp)
+	}
+	if resp["type"] != "echo" || resp["id"] != "a1" || resp["time"] == nil {
+		t.Fatalf("ack-only response %v, want type, id and time", resp)
+	}
+
+	if full := dialServer(t, startServer(t, Config{})).request(msg); payload(full)["big"] != "data" {
+		t.Fatalf("default response %v does not echo the payload", full)
+	}
+}
+
+func TestConnectionRegistryToleratesDuplicates(t *testing.T) {
+	s := newTestServer(t, Config{})
+	logs := captureLog(s)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	cc := &clientConn{id: "conn-1", conn: conn, done: make(chan struct{})}
+
+	if !s.addConnection(cc) {
+		t.Fatal("first addConnection failed")
+	}
+	if s.addConnection(cc) {
+		t.Fatal("second addConnection reported success")
+	}
+	if !strings.Contains(logs.String(), "registered twice") {
+		t.Errorf("duplicate registration not logged: %q", logs.String())
+	}
+	if n := s.liveCount.Load(); n != 1 || len(s.conns) != 1 {
+		t.Fatalf("after double add: liveCount=%d conns=%d, want 1", n, len(s.conns))
+	}
+
+	if !s.removeConnection(cc) {
+		t.Fatal("first removeConnection failed")
+	}
+	if s.removeConnection(cc) {
+		t.Fatal("second removeConnection reported success")
+	}
+	if n := s.liveCount.Load(); n != 0 || len(s.conns) != 0 || len(s.connsByID) != 0 {
+		t.Fatalf("after double remove: liveCount=%d conns=%d byID=%d, want 0", n, len(s.conns), len(s.connsByID))
+	}
+}
+
+// notifyWriter reports each write on a channel
+type notifyWriter chan []byte
+
+func (w notifyWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestBatchWriterFlushesWithinMaxLatency(t *testing.T) {
+	const maxLatency = 20 * time.Millisecond
+	out := make(notifyWriter, 1)
+	b := newBatchWriter(out, 64*1024, maxLatency)
+	defer b.Close()
+
+	start := time.Now()
+	if _, err := b.Write([]byte("one message\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-out:
+		if string(p) != "one message\n" {
+			t.Fatalf("flushed %q", p)
+		}
+		if took := time.Since(start); took < maxLatency/2 {
+			t.Fatalf("flushed after %v, before the batch window", took)
+		}
+	case <-time.After(maxLatency + 200*time.Millisecond):
+		t.Fatalf("partial batch not flushed within %v", maxLatency)
+	}
+}
+
+func TestBatchedResponseArrivesWithinMaxFlushLatency(t *testing.T) {
+	s := startServer(t, Config{WriteBufferSize: 64 * 1024, MaxFlushLatency: 20 * time.Millisecond})
+	client := dialServer(t, s)
+	client.send(map[string]interface{}{"type": "echo", "id": "b1"})
+	if _, err := client.tryReadLine(250 * time.Millisecond); err != nil {
+		t.Fatalf("single batched response not flushed: %v", err)
+	}
+}
+
+// versionHandler answers with a fixed version in the payload
+func versionHandler(version string) Handler {
+	return func(ctx context.Context, msg Message) (Message, error) {
+		msg.Payload = map[string]interface{}{"version": version}
+		return msg, nil
+	}
+}
+
+func TestSetHandlersSwapsWhileServing(t *testing.T) {
+	s := startServer(t, Config{})
+	tableA := map[string]Handler{"v": versionHandler("a")}
+	tableB := map[string]Handler{"v": versionHandler("b")}
+	s.SetHandlers(tableA)
+
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				s.SetHandlers(tableB)
+			} else {
+				s.SetHandlers(tableA)
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		client := dialServer(t, s)
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("%d-%d", c, i)
+				client.send(map[string]interface{}{"type": "v", "id": id})
+				line, err := client.tryReadLine(testReadTimeout)
+				if err != nil {
+					t.Errorf("read %s: %v", id, err)
+					return
+				}
+				var resp Message
+				if err := json.Unmarshal([]byte(line), &resp); err != nil || resp.ID != id {
+					t.Errorf("response %q to %s", line, id)
+					return
+				}
+				if v := resp.Payload["version"]; v != "a" && v != "b" {
+					t.Errorf("response %q dispatched outside either table", line)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(stop)
+	<-swapped
+}
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	t        *testing.T
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	pool     *x509.CertPool
+	serial   int64
+}
+
+// newTestCA creates a self-signed CA whose certificate is written to a
+// temporary file
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, serial: 1}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ca.cert, ca.key, ca.certFile, _ = ca.write(template, nil, nil, "ca")
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	return ca
+}
+
+// issue returns certificate and key files for cn, valid for localhost and
+// 127.0.0.1 as a server and for client authentication
+func (ca *testCA) issue(cn string) (certFile, keyFile string) {
+	ca.t.Helper()
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	_, _, certFile, keyFile = ca.write(template, ca.cert, ca.key, cn)
+	return certFile, keyFile
+}
+
+// write signs template with parent's key, or self-signs it, and stores the
+// certificate and a new key as PEM files
+func (ca *testCA) write(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	dir := ca.t.TempDir()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+// startTLSServer starts a server for config serving a certificate from ca
+func startTLSServer(t *testing.T, ca *testCA, config Config) *Server {
+	t.Helper()
+	config.TLSCertFile, config.TLSKeyFile = ca.issue("localhost")
+	return startServer(t, config)
+}
+
+// dialTLS connects to s over TLS, trusting ca, closing the connection when
+// the test ends
+func dialTLS(t *testing.T, s *Server, ca *testCA, config *tls.Config) (*testClient, error) {
+	t.Helper()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.RootCAs = ca.pool
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: testReadTimeout}, "tcp", serverAddr(s), config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestClient(t, conn), nil
+}
+
+func TestMaxConnLifetimeCyclesTLSConnections(t *testing.T) {
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, Config{MaxConnLifetime: 200 * time.Millisecond})
+	client, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "t1"}); resp["id"] != "t1" {
+		t.Fatalf("echo = %v", resp)
+	}
+	conns := s.Connections()
+	if len(conns) != 1 || !conns[0].TLS || conns[0].AgeSeconds <= 0 {
+		t.Fatalf("Connections = %+v, want one TLS connection with its age", conns)
+	}
+
+	lines := client.expectClosed(time.Second)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"max_lifetime"`) {
+		t.Fatalf("lines before close = %q, want a max_lifetime close notice", lines)
+	}
+	second, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	if resp := second.request(map[string]interface{}{"type": "echo", "id": "t2"}); resp["id"] != "t2" {
+		t.Fatalf("echo after reconnect = %v", resp)
+	}
+}
+
+// dialWithID connects to s and returns the client with the server's ID for
+// the connection. Connections must not be opened concurrently with it.
+func dialWithID(t *testing.T, s *Server) (*testClient, string) {
+	t.Helper()
+	known := map[string]bool{}
+	for _, c := range s.Connections() {
+		known[c.ID] = true
+	}
+	client := dialServer(t, s)
+	client.request(map[string]interface{}{"type": "echo", "id": "hello"}) // Registered once it answers
+	for _, c := range s.Connections() {
+		if !known[c.ID] {
+			return client, c.ID
+		}
+	}
+	t.Fatal("new connection not registered")
+	return nil, ""
+}
+
+func TestDrainTagClosesOnlyTaggedConnections(t *testing.T) {
+	s := startServer(t, Config{})
+	tagged1, id1 := dialWithID(t, s)
+	tagged2, id2 := dialWithID(t, s)
+	untagged, _ := dialWithID(t, s)
+	if !s.TagConnection(id1, "maint") || !s.TagConnection(id2, "maint", "other") {
+		t.Fatal("TagConnection did not find the connections")
+	}
+
+	n, err := s.DrainTag("maint", time.Second)
+	if err != nil || n != 2 {
+		t.Fatalf("DrainTag = %d, %v; want 2, nil", n, err)
+	}
+	tagged1.expectClosed(time.Second)
+	tagged2.expectClosed(time.Second)
+	if resp := untagged.request(map[string]interface{}{"type": "echo", "id": "u1"}); resp["id"] != "u1" {
+		t.Fatalf("untagged connection answered %v", resp)
+	}
+	if conns := s.Connections(); len(conns) != 1 {
+		t.Fatalf("%d connections left, want the untagged one", len(conns))
+	}
+}
+
+func TestStrictDecodingRejectsUnknownFields(t *testing.T) {
+	const line = `{"type":"echo","id":"s1","payload":{},"surprise":true}`
+
+	strict := dialServer(t, startServer(t, Config{StrictDecoding: true}))
+	strict.sendLine(line)
+	if resp := strict.read(); errorReason(resp) != "strict_decode_error" {
+		t.Fatalf("strict mode answered %v, want strict_decode_error", resp)
+	}
+
+	lenient := dialServer(t, startServer(t, Config{}))
+	lenient.sendLine(line)
+	if resp := lenient.read(); resp["type"] != "echo" || resp["id"] != "s1" {
+		t.Fatalf("lenient mode answered %v, want the echo", resp)
+	}
+}
+
+func TestRequestAwaitsClientReply(t *testing.T) {
+	s := startServer(t, Config{})
+	client, id := dialWithID(t, s)
+	type result struct {
+		reply Message
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := s.Request(id, Message{Type: "query", ID: "q1", Payload: map[string]interface{}{"question": "status"}}, time.Second)
+		done <- result{reply, err}
+	}()
+
+	req := client.read()
+	client.send(map[string]interface{}{
+		"type":           "answer",
+		"id":             req["id"],
+		"correlation_id": req["correlation_id"],
+		"payload":        map[string]interface{}{"echoed": payload(req)["question"]},
+	})
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Request: %v", res.err)
+	}
+	if res.reply.Type != "answer" || res.reply.Payload["echoed"] != "status" {
+		t.Fatalf("Request returned %+v", res.reply)
+	}
+
+	if _, err := s.Request(id, Message{Type: "query", ID: "q2"}, 50*time.Millisecond); !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("unanswered Request error = %v, want ErrRequestTimeout", err)
+	}
+	if _, err := s.Request("conn-missing", Message{Type: "query"}, time.Second); !errors.Is(err, ErrConnNotFound) {
+		t.Fatalf("Request to unknown connection error = %v, want ErrConnNotFound", err)
+	}
+}
+
+func TestWithDefaultsMergesPartialConfig(t *testing.T) {
+	var partial Config
+	if err := json.Unmarshal([]byte(`{"Port":"9100","MaxConnections":5,"WriteTimeout":2000000000}`), &partial); err != nil {
+		t.Fatal(err)
+	}
+	c := partial.WithDefaults()
+
+	if c.Port != "9100" || c.MaxConnections != 5 || c.WriteTimeout != 2*time.Second {
+		t.Fatalf("WithDefaults overwrote set fields: port=%q max=%d write=%v", c.Port, c.MaxConnections, c.WriteTimeout)
+	}
+	if c.ReadTimeout != defaultReadTimeout || c.ShutdownTimeout != defaultShutdownTimeout || c.HandshakeTimeout != defaultHandshakeTimeout {
+		t.Fatalf("unset fields not defaulted: read=%v shutdown=%v handshake=%v", c.ReadTimeout, c.ShutdownTimeout, c.HandshakeTimeout)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("merged config invalid: %v", err)
+	}
+}
+
+// acceptToken authenticates the token "secret" as alice
+func acceptToken(token string) (string, error) {
+	if token != "secret" {
+		return "", errors.New("bad token")
+	}
+	return "alice", nil
+}
+
+func TestPreAuthPolicy(t *testing.T) {
+	const pipelined = `{"type":"echo","id":"d1"}` + "\n" + `{"type":"auth","id":"a1","payload":{"token":"secret"}}`
+
+	rejecting := dialServer(t, startServer(t, Config{Authenticate: acceptToken}))
+	rejecting.sendLine(pipelined)
+	if resp := rejecting.read(); resp["id"] != "d1" || errorReason(resp) != "unauthenticated" {
+		t.Fatalf("reject policy answered %v first, want d1 unauthenticated", resp)
+	}
+	if resp := rejecting.read(); resp["id"] != "a1" || payload(resp)["identity"] != "alice" {
+		t.Fatalf("reject policy answered %v, want the auth success", resp)
+	}
+
+	queueing := dialServer(t, startServer(t, Config{Authenticate: acceptToken, PreAuthPolicy: "queue", PreAuthQueueSize: 1}))
+	queueing.sendLine(`{"type":"echo","id":"d0"}` + "\n" + pipelined)
+	if resp := queueing.read(); resp["id"] != "d1" || errorReason(resp) != "pre_auth_queue_full" {
+		t.Fatalf("queue policy answered %v first, want d1 rejected by the queue bound", resp)
+	}
+	if resp := queueing.read(); resp["id"] != "a1" || payload(resp)["identity"] != "alice" {
+		t.Fatalf("queue policy answered %v, want the auth success", resp)
+	}
+	if resp := queueing.read(); resp["id"] != "d0" || resp["type"] != "echo" {
+		t.Fatalf("queue policy answered %v, want the queued message processed", resp)
+	}
+}
+
+func TestMaxConcurrentHandshakesThrottles(t *testing.T) {
+	const handshakeTimeout = 300 * time.Millisecond
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, Config{MaxConcurrentHandshakes: 1, HandshakeTimeout: handshakeTimeout})
+
+	// A client that never sends its hello holds the only handshake slot
+	stalled, err := net.Dial("tcp", serverAddr(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	waitFor(t, time.Second, "the stalled handshake to take the slot", func() bool { return len(s.hsSem) == 1 })
+
+	start := time.Now()
+	client, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	if waited := time.Since(start); waited < handshakeTimeout/2 {
+		t.Fatalf("second handshake finished after %v without waiting for the slot", waited)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "h1"}); resp["id"] != "h1" {
+		t.Fatalf("echo = %v", resp)
+	}
+}
+
+func TestCloseAfterClosesAfterResponse(t *testing.T) {
+	client := dialServer(t, startServer(t, Config{}))
+	client.send(map[string]interface{}{"type": "echo", "id": "c1", "close_after": true})
+	lines := client.expectClosed(time.Second)
+	if len(lines) == 0 || !strings.Contains(lines[0], `"id":"c1"`) {
+		t.Fatalf("lines before close = %q, want the c1 response first", lines)
+	}
+	if len(lines) > 1 && !strings.Contains(lines[1], `"close_after"`) {
+		t.Fatalf("lines before close = %q, want at most a close_after notice after the response", lines)
+	}
+}
+
+// compressedEcho sends msg to a server in "message" compression mode with
+// the dictionary in dictFile, if any, and returns the compressed response,
+// checking it inflates back to the response
+func compressedEcho(t *testing.T, dictFile string, dict []byte, msg map[string]interface{}) []byte {
+	t.Helper()
+	client := dialServer(t, startServer(t, Config{Compression: "message", CompressMinBytes: 1, CompressionDict: dictFile}))
+	client.send(msg)
+	var frame compressedFrame
+	if err := json.Unmarshal([]byte(client.readLine()), &frame); err != nil || !frame.Compressed {
+		t.Fatalf("response is not a compressed frame: %v", err)
+	}
+	inflated, err := io.ReadAll(flate.NewReaderDict(bytes.NewReader(frame.Data), dict))
+	if err != nil || !strings.Contains(string(inflated), `"id":"`+msg["id"].(string)+`"`) {
+		t.Fatalf("inflating frame: %q, %v", inflated, err)
+	}
+	return frame.Data
+}
+
+func TestCompressionDictShrinksSmallMessages(t *testing.T) {
+	dict := []byte(`{"type":"price_update","payload":{"symbol":"","bid":,"ask":,"venue":"primary"},"time":"","id":"","source":""}`)
+	dictFile := filepath.Join(t.TempDir(), "dict")
+	if err := os.WriteFile(dictFile, dict, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	msg := map[string]interface{}{
+		"type":    "price_update",
+		"id":      "p1",
+		"payload": map[string]interface{}{"symbol": "ACME", "bid": 10.5, "ask": 10.6, "venue": "primary"},
+	}
+
+	plain := compressedEcho(t, "", nil, msg)
+	withDict := compressedEcho(t, dictFile, dict, msg)
+	if len(withDict) >= len(plain) {
+		t.Fatalf("dictionary frame is %d bytes, not smaller than %d without", len(withDict), len(plain))
+	}
+}
+
+func TestShutdownWhileDialingHandlesNoLateConnections(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := newTestServer(t, Config{MaxConnections: 8})
+		var mu sync.Mutex
+		var events []EventType
+		complete := make(chan struct{})
+		s.Subscribe(func(ev Event) {
+			mu.Lock()
+			events = append(events, ev.Type)
+			mu.Unlock()
+			if ev.Type == ShutdownComplete {
+				close(complete)
+			}
+		})
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		addr := serverAddr(s)
+
+		stop := make(chan struct{})
+		var dialers sync.WaitGroup
+		for d := 0; d < 4; d++ {
+			dialers.Add(1)
+			go func() {
+				defer dialers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+						conn.Close()
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+		stopServer(s)
+		close(stop)
+		dialers.Wait()
+
+		select {
+		case <-complete:
+		case <-time.After(time.Second):
+			t.Fatal("ShutdownComplete not delivered")
+		}
+		mu.Lock()
+		draining := false
+		for _, ev := range events {
+			if ev == DrainStarted {
+				draining = true
+			}
+			if ev == ConnAccepted && draining {
+				t.Fatalf("iteration %d: connection accepted after shutdown began: %v", i, events)
+			}
+		}
+		mu.Unlock()
+		if n := len(s.connSem); n != 0 {
+			t.Fatalf("iteration %d: %d connection slots leaked", i, n)
+		}
+		if n := s.pendingFirst.Load(); n != 0 {
+			t.Fatalf("iteration %d: pendingFirst = %d after shutdown", i, n)
+		}
+	}
+}
+
+func TestCompressMinBytesCompressesOnlyLargeMessages(t *testing.T) {
+	client := dialServer(t, startServer(t, Config{Compression: "message", CompressMinBytes: 256}))
+
+	small := client.request(map[string]interface{}{"type": "echo", "id": "small"})
+	if small["compressed"] != nil || small["id"] != "small" {
+		t.Fatalf("small response %v was compressed", small)
+	}
+
+	big := client.request(map[string]interface{}{"type": "echo", "id": "big", "payload": map[string]interface{}{"text": strings.Repeat("abc ", 200)}})
+	if big["compressed"] != true || big["data"] == nil || big["id"] != nil {
+		t.Fatalf("large response %v was not sent as a compressed frame", big)
+	}
+}
+
+func TestSubscribeDeliversLifecycleEvents(t *testing.T) {
+	s := newTestServer(t, Config{})
+	events := make(chan Event, 16)
+	s.Subscribe(func(ev Event) { events <- ev })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	client, id := dialWithID(t, s)
+	client.conn.Close()
+	waitFor(t, time.Second, "the connection to close", func() bool { return len(s.Connections()) == 0 })
+	stopServer(s)
+
+	want := []EventType{ServerStarted, ConnAccepted, ConnClosed, DrainStarted, ShutdownComplete}
+	for _, typ := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != typ {
+				t.Fatalf("got event %v, want %v", ev.Type, typ)
+			}
+			if (typ == ConnAccepted || typ == ConnClosed) && ev.ConnID != id {
+				t.Fatalf("%v for connection %q, want %q", typ, ev.ConnID, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %v not delivered", typ)
+		}
+	}
+}
+
+func TestMaxGoroutinesRejectsConnections(t *testing.T) {
+	roomy := dialServer(t, startServer(t, Config{MaxGoroutines: 100000}))
+	if resp := roomy.request(map[string]interface{}{"type": "echo", "id": "g1"}); resp["id"] != "g1" {
+		t.Fatalf("echo under a high limit = %v", resp)
+	}
+
+	// Any running test binary has more goroutines than this
+	overloaded := dialServer(t, startServer(t, Config{MaxGoroutines: 2}))
+	if resp := overloaded.read(); errorReason(resp) != "server_overloaded" {
+		t.Fatalf("got %v, want server_overloaded", resp)
+	}
+	overloaded.expectClosed(time.Second)
+}
+
+func TestPostHandshakeIdleTimeoutClosesSilentConnections(t *testing.T) {
+	const grace = 150 * time.Millisecond
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, Config{PostHandshakeIdleTimeout: grace})
+
+	silent, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	active, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	if resp := active.request(map[string]interface{}{"type": "echo", "id": "a1"}); resp["id"] != "a1" {
+		t.Fatalf("echo = %v", resp)
+	}
+
+	start := time.Now()
+	lines := silent.expectClosed(time.Second)
+	if time.Since(start) < grace/2 {
+		t.Fatal("silent connection closed before the grace period")
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], `"idle_timeout"`) {
+		t.Fatalf("lines before close = %q, want an idle_timeout notice", lines)
+	}
+
+	time.Sleep(grace)
+	if resp := active.request(map[string]interface{}{"type": "echo", "id": "a2"}); resp["id"] != "a2" {
+		t.Fatalf("active connection closed by the grace period: %v", resp)
+	}
+}
+
+// installCert copies a certificate, followed by the CA certificate as a
+// chain bundle, and its key to certFile and keyFile, marking them modified
+// at modTime
+func installCert(t *testing.T, ca *testCA, fromCert, fromKey, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	leaf, err := os.ReadFile(fromCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(fromKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, append(leaf, caPEM...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedCert returns the leaf certificate s presents and the chain length
+func servedCert(t *testing.T, s *Server, ca *testCA) (*x509.Certificate, int) {
+	t.Helper()
+	client, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	defer client.conn.Close()
+	chain := client.conn.(*tls.Conn).ConnectionState().PeerCertificates
+	return chain[0], len(chain)
+}
+
+func TestCertReloadServesRenewedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	oldCert, oldKey := ca.issue("localhost")
+	installCert(t, ca, oldCert, oldKey, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	s := startServer(t, Config{TLSCertFile: certFile, TLSKeyFile: keyFile, CertReloadInterval: 20 * time.Millisecond})
+	first, chainLen := servedCert(t, s, ca)
+	if chainLen != 2 {
+		t.Fatalf("served a chain of %d certificates, want the leaf and CA from the bundle", chainLen)
+	}
+
+	newCert, newKey := ca.issue("localhost")
+	installCert(t, ca, newCert, newKey, certFile, keyFile, time.Now())
+	waitFor(t, 2*time.Second, "the renewed certificate to be served", func() bool {
+		cert, _ := servedCert(t, s, ca)
+		return cert.SerialNumber.Cmp(first.SerialNumber) != 0
+	})
+}
+
+func TestQuarantineConnectionPausesDispatch(t *testing.T) {
+	const d = 150 * time.Millisecond
+	s := startServer(t, Config{})
+	client, id := dialWithID(t, s)
+	other, _ := dialWithID(t, s)
+
+	if err := s.QuarantineConnection(id, d); err != nil {
+		t.Fatalf("QuarantineConnection: %v", err)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "q1"}); errorReason(resp) != "quarantined" || resp["id"] != "q1" {
+		t.Fatalf("quarantined connection answered %v, want quarantined", resp)
+	}
+	if resp := other.request(map[string]interface{}{"type": "echo", "id": "o1"}); resp["type"] != "echo" {
+		t.Fatalf("other connection answered %v", resp)
+	}
+
+	time.Sleep(d)
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "q2"}); resp["type"] != "echo" || resp["id"] != "q2" {
+		t.Fatalf("after the quarantine the connection answered %v, want the echo", resp)
+	}
+	if err := s.QuarantineConnection("conn-missing", d); !errors.Is(err, ErrConnNotFound) {
+		t.Fatalf("quarantining an unknown connection: %v", err)
+	}
+}
+
+func TestTimeFormatRoundTrips(t *testing.T) {
+	at := time.Date(2024, 3, 9, 14, 5, 6, 123456789, time.UTC)
+	tests := []struct {
+		format    string
+		precision time.Duration
+		wire      string
+	}{
+		{"", time.Nanosecond, `"2024-03-09T14:05:06.123456789Z"`},
+		{TimeFormatRFC3339Nano, time.Nanosecond, `"2024-03-09T14:05:06.123456789Z"`},
+		{TimeFormatRFC3339, time.Second, `"2024-03-09T14:05:06Z"`},
+		{TimeFormatUnix, time.Second, "1709993106"},
+		{TimeFormatUnixMillis, time.Millisecond, "1709993106123"},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(toWire(Message{Type: "echo", Time: at}, tt.format))
+		if err != nil {
+			t.Fatalf("%q: marshal: %v", tt.format, err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(fields["time"]); got != tt.wire {
+			t.Errorf("%q: time encoded as %s, want %s", tt.format, got, tt.wire)
+		}
+		decoded := wireTime{format: tt.format}
+		if err := json.Unmarshal(fields["time"], &decoded); err != nil {
+			t.Fatalf("%q: unmarshal: %v", tt.format, err)
+		}
+		if want := at.Truncate(tt.precision); !decoded.t.Equal(want) {
+			t.Errorf("%q: round trip gave %v, want %v", tt.format, decoded.t, want)
+		}
+	}
+}
+
+func TestTimeFormatOnTheWire(t *testing.T) {
+	client := dialServer(t, startServer(t, Config{TimeFormat: TimeFormatUnixMillis}))
+	resp := client.request(map[string]interface{}{"type": "echo", "id": "t1", "time": 1709993106123})
+	if ms, ok := resp["time"].(float64); !ok || ms < 1e12 {
+		t.Fatalf("time = %v, want unix milliseconds", resp["time"])
+	}
+}
+
+func TestIdempotencySurvivesReconnect(t *testing.T) {
+	s := newTestServer(t, Config{Authenticate: acceptToken, IdempotencyTTL: time.Minute})
+	var runs atomic.Int32
+	s.Handle("charge", func(ctx context.Context, msg Message) (Message, error) {
+		n := runs.Add(1)
+		msg.Payload = map[string]interface{}{"run": n}
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	charge := map[string]interface{}{"type": "charge", "id": "c1", "idempotency_key": "order-42"}
+	auth := map[string]interface{}{"type": "auth", "id": "a", "payload": map[string]interface{}{"token": "secret", "session": "s-1"}}
+	var responses []map[string]interface{}
+	for attempt := 0; attempt < 2; attempt++ {
+		client := dialServer(t, s)
+		client.request(auth)
+		responses = append(responses, client.request(charge))
+		client.conn.Close()
+	}
+
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("handler ran %d times across the reconnect, want once", n)
+	}
+	if payload(responses[1])["run"] != payload(responses[0])["run"] {
+		t.Fatalf("resend got %v, want the first result %v", responses[1], responses[0])
+	}
+}
+
+func TestBufferedResponseFlushedBeforeBlockingRead(t *testing.T) {
+	// The batch timer would hold the response for a minute; only the flush
+	// before the next read can deliver it
+	s := startServer(t, Config{WriteBufferSize: 64 * 1024, MaxFlushLatency: time.Minute})
+	client := dialServer(t, s)
+	client.send(map[string]interface{}{"type": "echo", "id": "r1"})
+	if _, err := client.tryReadLine(500 * time.Millisecond); err != nil {
+		t.Fatalf("response to a lone request still buffered: %v", err)
+	}
+}
+
+func TestDrainToCountClosesByPolicy(t *testing.T) {
+	for _, policy := range []string{"oldest", "idlest"} {
+		t.Run(policy, func(t *testing.T) {
+			s := startServer(t, Config{DrainPolicy: policy})
+			var clients []*testClient
+			for i := 0; i < 4; i++ {
+				client, _ := dialWithID(t, s)
+				clients = append(clients, client)
+				time.Sleep(2 * time.Millisecond) // Distinct connect times
+			}
+			// The two oldest connections become the most recently active
+			for _, client := range clients[:2] {
+				client.request(map[string]interface{}{"type": "echo", "id": "busy"})
+			}
+
+			n, err := s.DrainToCount(2, time.Second)
+			if err != nil || n != 2 {
+				t.Fatalf("DrainToCount = %d, %v; want 2, nil", n, err)
+			}
+			closed, kept := clients[:2], clients[2:]
+			if policy == "idlest" {
+				closed, kept = kept, closed
+			}
+			for _, client := range closed {
+				client.expectClosed(time.Second)
+			}
+			for _, client := range kept {
+				if resp := client.request(map[string]interface{}{"type": "echo", "id": "k"}); resp["id"] != "k" {
+					t.Fatalf("kept connection answered %v", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpStateListsConnections(t *testing.T) {
+	s := startServer(t, Config{})
+	_, id := dialWithID(t, s)
+	if !s.TagConnection(id, "canary") {
+		t.Fatal("TagConnection failed")
+	}
+
+	path := filepath.Join(t.TempDir(), "state.txt")
+	dumpState(s, path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading dump: %v", err)
+	}
+	dump := string(data)
+	for _, want := range []string{"Connections: 1", id, "canary", "=== Goroutines ===", "acceptConnections"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump does not contain %q", want)
+		}
+	}
+}
+
+func TestInjectSendsResponseToClient(t *testing.T) {
+	s := newTestServer(t, Config{})
+	s.Handle("greet", func(ctx context.Context, msg Message) (Message, error) {
+		msg.Payload = map[string]interface{}{"greeting": "hello " + msg.Payload["name"].(string)}
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client, id := dialWithID(t, s)
+
+	if err := s.Inject(id, Message{Type: "greet", ID: "i1", Payload: map[string]interface{}{"name": "bob"}}); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	resp := client.read()
+	if resp["id"] != "i1" || payload(resp)["greeting"] != "hello bob" {
+		t.Fatalf("client received %v, want the greet response", resp)
+	}
+	if err := s.Inject("conn-missing", Message{Type: "greet"}); !errors.Is(err, ErrConnNotFound) {
+		t.Fatalf("Inject into an unknown connection: %v", err)
+	}
+}
+
+func TestUseJSONNumberPreservesLargeIntegers(t *testing.T) {
+	const big = "9007199254740993" // 2^53 + 1, not representable as a float64
+	for _, useNumber := range []bool{false, true} {
+		s := newTestServer(t, Config{UseJSONNumber: useNumber})
+		got := make(chan interface{}, 1)
+		s.Handle("id", func(ctx context.Context, msg Message) (Message, error) {
+			got <- msg.Payload["n"]
+			return msg, nil
+		})
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		dialServer(t, s).sendLine(`{"type":"id","id":"n1","payload":{"n":` + big + `}}`)
+
+		n := <-got
+		num, isNumber := n.(json.Number)
+		if useNumber && (!isNumber || num.String() != big) {
+			t.Errorf("UseJSONNumber: handler got %#v, want json.Number %s", n, big)
+		}
+		if !useNumber {
+			if f, ok := n.(float64); !ok || f != 9007199254740992 {
+				t.Errorf("default decoding: handler got %#v, want the float64 rounding", n)
+			}
+		}
+		stopServer(s)
+	}
+}
+
+func TestBroadcastRatePacesWithoutDropping(t *testing.T) {
+	s := startServer(t, Config{BroadcastRate: 20, BroadcastBurst: 1, OutboundQueueSize: 16})
+	client, _ := dialWithID(t, s)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if n := s.Broadcast(Message{Type: "tick", ID: fmt.Sprint(i)}); n != 1 {
+			t.Fatalf("broadcast %d queued for %d connections, want 1", i, n)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if msg := client.read(); msg["type"] != "tick" || msg["id"] != fmt.Sprint(i) {
+			t.Fatalf("message %d = %v", i, msg)
+		}
+	}
+	// One token up front, then one every 50ms
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Fatalf("6 broadcasts delivered in %v, faster than 20 per second", took)
+	}
+	if dropped := s.metrics.broadcastsDropped.Load(); dropped != 0 {
+		t.Fatalf("%d broadcasts dropped, want none", dropped)
+	}
+}
+
+func TestSniffCodec(t *testing.T) {
+	tests := []struct {
+		first byte
+		want  string
+	}{
+		{'{', "json"},
+		{'[', "json"},
+		{0x83, "msgpack"}, // fixmap of 3
+		{0x92, "msgpack"}, // fixarray of 2
+		{0xde, "msgpack"}, // map16
+		{' ', "fallback"},
+		{0x01, "fallback"},
+	}
+	for _, tt := range tests {
+		if got := sniffCodec(tt.first, "fallback"); got != tt.want {
+			t.Errorf("sniffCodec(%#x) = %q, want %q", tt.first, got, tt.want)
+		}
+	}
+}
+
+func TestSniffCodecServesBothCodecsOnOnePort(t *testing.T) {
+	s := startServer(t, Config{SniffCodec: true})
+
+	jsonClient := dialServer(t, s)
+	if resp := jsonClient.request(map[string]interface{}{"type": "echo", "id": "j1"}); resp["id"] != "j1" {
+		t.Fatalf("JSON client got %v", resp)
+	}
+
+	mp := dialServer(t, s)
+	msg := appendMsgpack(nil, map[string]interface{}{"type": "echo", "id": "m1", "payload": map[string]interface{}{"k": "v"}})
+	if _, err := mp.conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	mp.conn.SetReadDeadline(time.Now().Add(testReadTimeout))
+	first, err := mp.r.ReadByte()
+	if err != nil {
+		t.Fatalf("reading msgpack response: %v", err)
+	}
+	if sniffCodec(first, "") != "msgpack" {
+		t.Fatalf("response opens with %#x, not a msgpack map", first)
+	}
+	v, err := readMsgpack(mp.r, first, 0)
+	if err != nil {
+		t.Fatalf("decoding msgpack response: %v", err)
+	}
+	resp, _ := v.(map[string]interface{})
+	if resp["id"] != "m1" || payload(resp)["k"] != "v" {
+		t.Fatalf("msgpack client got %v", v)
+	}
+}
+
+// holdConnection starts a handler that blocks until release is closed and
+// keeps one call to it in flight, so Shutdown has something to drain
+func holdConnection(t *testing.T, s *Server, release <-chan struct{}) {
+	t.Helper()
+	s.Handle("hold", func(ctx context.Context, msg Message) (Message, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dialServer(t, s).send(map[string]interface{}{"type": "hold", "id": "h"})
+	waitFor(t, time.Second, "the held call", func() bool { return len(s.InflightCalls()) == 1 })
+}
+
+func TestAwaitShutdownSecondSignalForcesExit(t *testing.T) {
+	s := newTestServer(t, Config{ShutdownDrainTimeout: time.Minute})
+	release := make(chan struct{})
+	defer close(release)
+	holdConnection(t, s, release)
+
+	sigs := make(chan os.Signal, 2)
+	exited := make(chan int, 1)
+	returned := make(chan struct{})
+	go func() {
+		awaitShutdown(s, sigs, time.Minute, 0, func(code int) { exited <- code })
+		close(returned)
+	}()
+
+	sigs <- os.Interrupt
+	select {
+	case <-exited:
+		t.Fatal("first signal exited instead of draining")
+	case <-returned:
+		t.Fatal("shutdown finished while a handler was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	sigs <- os.Interrupt
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Fatalf("forced exit code %d, want 1", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second signal did not force an exit")
+	}
+}
+
+func TestAwaitShutdownForceExitAfter(t *testing.T) {
+	s := newTestServer(t, Config{ShutdownDrainTimeout: time.Minute})
+	release := make(chan struct{})
+	defer close(release)
+	holdConnection(t, s, release)
+
+	sigs := make(chan os.Signal, 1)
+	exited := make(chan int, 1)
+	start := time.Now()
+	sigs <- os.Interrupt
+	go awaitShutdown(s, sigs, time.Minute, 100*time.Millisecond, func(code int) { exited <- code })
+	select {
+	case <-exited:
+		if took := time.Since(start); took < 100*time.Millisecond {
+			t.Fatalf("exited after %v, before ForceExitAfter", took)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ForceExitAfter did not force an exit")
+	}
+}
+
+// scrape returns s's Prometheus metrics
+func scrape(t *testing.T, s *Server) string {
+	t.Helper()
+	var buf strings.Builder
+	if err := s.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics: %v", err)
+	}
+	return buf.String()
+}
+
+func TestMetricsCardinalityMode(t *testing.T) {
+	aggregate := startServer(t, Config{})
+	_, id := dialWithID(t, aggregate)
+	if out := scrape(t, aggregate); strings.Contains(out, "conn_id=") || strings.Contains(out, id) {
+		t.Fatalf("aggregate metrics leak per-connection labels:\n%s", out)
+	}
+
+	perConn := startServer(t, Config{MetricsCardinalityMode: "per_connection"})
+	_, id = dialWithID(t, perConn)
+	if out := scrape(t, perConn); !strings.Contains(out, fmt.Sprintf("server_connection_messages_received_total{conn_id=%q} 1", id)) {
+		t.Fatalf("per_connection metrics missing %s:\n%s", id, out)
+	}
+}
+
+func TestPayloadKeyLimits(t *testing.T) {
+	client := dialServer(t, startServer(t, Config{MaxPayloadKeys: 4, MaxKeyLength: 16}))
+
+	manyKeys := map[string]interface{}{"a": 1, "b": 2, "nested": map[string]interface{}{"c": 3, "d": 4}}
+	resp := client.request(map[string]interface{}{"type": "echo", "id": "k1", "payload": manyKeys})
+	if errorReason(resp) != "payload_limit" || !strings.Contains(errorMessage(resp), "more than 4 keys") {
+		t.Fatalf("payload with 5 keys answered %v, want a key-count payload_limit", resp)
+	}
+
+	longKey := map[string]interface{}{strings.Repeat("k", 17): true}
+	resp = client.request(map[string]interface{}{"type": "echo", "id": "k2", "payload": longKey})
+	if errorReason(resp) != "payload_limit" || !strings.Contains(errorMessage(resp), "17 bytes") {
+		t.Fatalf("payload with a 17-byte key answered %v, want a key-length payload_limit", resp)
+	}
+
+	ok := map[string]interface{}{"a": 1, "nested": map[string]interface{}{"b": 2}}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "k3", "payload": ok}); resp["type"] != "echo" {
+		t.Fatalf("payload within the limits answered %v", resp)
+	}
+}
+
+func TestHijackHandsOverRawConnection(t *testing.T) {
+	s := startServer(t, Config{})
+	client, id := dialWithID(t, s)
+
+	raw, err := s.Hijack(id)
+	if err != nil {
+		t.Fatalf("Hijack: %v", err)
+	}
+	defer raw.Close()
+	if conns := s.Connections(); len(conns) != 0 {
+		t.Fatalf("hijacked connection still tracked: %+v", conns)
+	}
+
+	binary := []byte{0x00, 0xff, 'r', 'a', 'w', '\n', 0x01}
+	if _, err := client.conn.Write(binary); err != nil {
+		t.Fatal(err)
+	}
+	raw.SetReadDeadline(time.Now().Add(testReadTimeout))
+	r := bufio.NewReader(raw)
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		r.ReadByte() // The terminator of the echo sent by dialWithID
+	}
+	got := make([]byte, len(binary))
+	if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, binary) {
+		t.Fatalf("read %q, %v from the hijacked conn; want %q", got, err, binary)
+	}
+
+	if _, err := raw.Write([]byte("pong\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line := client.readLine(); line != "pong" {
+		t.Fatalf("client read %q after the handoff, want the raw write", line)
+	}
+	if _, err := s.Hijack(id); !errors.Is(err, ErrConnNotFound) {
+		t.Fatalf("second Hijack: %v, want ErrConnNotFound", err)
+	}
+}
+
+func TestNoResponseHandlerSendsNothing(t *testing.T) {
+	s := newTestServer(t, Config{})
+	got := make(chan string, 1)
+	s.Handle("fire", func(ctx context.Context, msg Message) (Message, error) {
+		got <- msg.ID
+		return Message{}, ErrNoResponse
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	client.send(map[string]interface{}{"type": "fire", "id": "f1"})
+	if id := <-got; id != "f1" {
+		t.Fatalf("handler got %q", id)
+	}
+	if line, err := client.tryReadLine(100 * time.Millisecond); err == nil {
+		t.Fatalf("fire-and-forget message answered with %q", line)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+		t.Fatalf("connection unusable after a no-response message: %v", resp)
+	}
+}
+
+func TestTraceIDRoundTripsAndIsLogged(t *testing.T) {
+	s := newTestServer(t, Config{})
+	logs := captureLog(s)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	generated := dialServer(t, s).request(map[string]interface{}{"type": "echo", "id": "g1"})
+	if id, _ := generated["trace_id"].(string); id == "" {
+		t.Fatalf("response %v has no generated trace ID", generated)
+	}
+
+	client := dialServer(t, s)
+	resp := client.request(map[string]interface{}{"type": "echo", "id": "c1", "trace_id": "trace-abc", "close_after": true})
+	if resp["trace_id"] != "trace-abc" {
+		t.Fatalf("response trace ID = %v, want the client's", resp["trace_id"])
+	}
+	client.expectClosed(time.Second)
+	waitFor(t, time.Second, "the trace ID in the log", func() bool {
+		return strings.Contains(logs.String(), "[trace trace-abc]")
+	})
+}
+
+func TestShutdownPhasesRunInOrder(t *testing.T) {
+	s := newTestServer(t, Config{ShutdownNotifyTimeout: 50 * time.Millisecond, ShutdownDrainTimeout: 100 * time.Millisecond})
+	logs := captureLog(s)
+	cancelled := make(chan struct{})
+	s.Handle("stuck", func(ctx context.Context, msg Message) (Message, error) {
+		<-ctx.Done() // Only the force-close phase ends it
+		close(cancelled)
+		return Message{}, ctx.Err()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dialServer(t, s).send(map[string]interface{}{"type": "stuck", "id": "s1"})
+	waitFor(t, time.Second, "the stuck handler", func() bool { return len(s.InflightCalls()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("stuck handler was not cancelled")
+	}
+
+	out := logs.String()
+	last := -1
+	for _, phase := range []string{"phase 1/4: stop-accept", "phase 2/4: notify-clients", "phase 3/4: drain-handlers", "phase 4/4: force-close (1 connections still open)", "Shutdown complete"} {
+		i := strings.Index(out, phase)
+		if i < 0 {
+			t.Fatalf("log has no %q:\n%s", phase, out)
+		}
+		if i < last {
+			t.Fatalf("%q logged out of order:\n%s", phase, out)
+		}
+		last = i
+	}
+}
+
+func TestMaxConnBytesClosesWithQuotaMessage(t *testing.T) {
+	client := dialServer(t, startServer(t, Config{MaxConnBytes: 2048}))
+	big := strings.Repeat("x", 400)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		client.send(map[string]interface{}{"type": "echo", "id": fmt.Sprint(i), "payload": map[string]interface{}{"data": big}})
+		line, err := client.tryReadLine(testReadTimeout)
+		if err != nil {
+			break
+		}
+		lines = append(lines, line)
+		if strings.Contains(line, `"quota_exceeded"`) {
+			lines = append(lines, client.expectClosed(time.Second)...)
+			break
+		}
+	}
+	if len(lines) < 2 || len(lines) > 6 {
+		t.Fatalf("got %d lines before the quota tripped, want it to trip after roughly 2KB: %q", len(lines), lines)
+	}
+	found := false
+	for _, line := range lines {
+		found = found || strings.Contains(line, `"quota_exceeded"`)
+	}
+	if !found {
+		t.Fatalf("no quota_exceeded message before close: %q", lines)
+	}
+}
+
+func TestPauseAcceptHoldsNewConnections(t *testing.T) {
+	s := startServer(t, Config{})
+	existing, _ := dialWithID(t, s)
+
+	s.PauseAccept()
+	queued := dialServer(t, s) // Completes in the listen backlog
+	queued.send(map[string]interface{}{"type": "echo", "id": "q1"})
+	if line, err := queued.tryReadLine(150 * time.Millisecond); err == nil {
+		t.Fatalf("connection dialled while paused was served: %q", line)
+	}
+	if resp := existing.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+		t.Fatalf("existing connection answered %v while paused", resp)
+	}
+
+	s.ResumeAccept()
+	if resp := queued.read(); resp["id"] != "q1" {
+		t.Fatalf("queued connection answered %v after resume", resp)
+	}
+}
+
+func TestErrorResponsesCarryCodes(t *testing.T) {
+	s := newTestServer(t, Config{MaxPayloadKeys: 1})
+	s.Handle("fail", func(ctx context.Context, msg Message) (Message, error) {
+		return Message{}, errors.New("boom")
+	})
+	s.Handle("late", func(ctx context.Context, msg Message) (Message, error) {
+		return Message{}, fmt.Errorf("backend: %w", context.DeadlineExceeded)
+	})
+	s.Handle("busy", func(ctx context.Context, msg Message) (Message, error) {
+		return Message{}, &Error{Code: CodeRateLimited, Reason: "backend_busy", Message: "try later", Retryable: true, RetryAfter: time.Second}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	tests := []struct {
+		msg       map[string]interface{}
+		reason    string
+		code      float64
+		retryable bool
+	}{
+		{map[string]interface{}{"type": "fail"}, "handler_error", 500, false},
+		{map[string]interface{}{"type": "late"}, "timeout", 408, true},
+		{map[string]interface{}{"type": "busy"}, "backend_busy", 429, true},
+		{map[string]interface{}{"type": "echo", "payload": map[string]interface{}{"a": 1, "b": 2}}, "payload_limit", 413, false},
+	}
+	for _, tt := range tests {
+		resp := client.request(tt.msg)
+		p := payload(resp)
+		if resp["type"] != "error" || p["reason"] != tt.reason || p["code"] != tt.code || p["retryable"] != tt.retryable {
+			t.Errorf("%v answered %v, want reason %s code %v retryable %t", tt.msg["type"], p, tt.reason, tt.code, tt.retryable)
+		}
+	}
+	if resp := client.request(map[string]interface{}{"type": "busy"}); payload(resp)["retry_after_ms"] != float64(1000) {
+		t.Errorf("RetryAfter not reported: %v", payload(resp))
+	}
+
+	for reason, info := range errorReasons {
+		if info.code.String() == "ErrorCode("+strconv.Itoa(int(info.code))+")" {
+			t.Errorf("reason %q maps to unnamed code %d", reason, info.code)
+		}
+	}
+}
+
+func TestRepeatedErrorLinesAreCollapsed(t *testing.T) {
+	s := newTestServer(t, Config{})
+	logs := captureLog(s)
+	for i := 0; i < 100; i++ {
+		s.logErrorf("Error decoding message from %s [trace %d]: %v", "10.0.0.1:5000", i, "invalid character")
+	}
+	s.logErrorf("Error decoding message from %s: %v", "10.0.0.2:5000", "unexpected EOF")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != logRepeatBurst+1 {
+		t.Fatalf("logged %d lines, want %d repeats and the distinct line:\n%s", len(lines), logRepeatBurst, logs.String())
+	}
+	summaries := s.errorLog.summarize()
+	want := fmt.Sprintf("%d more occurrences of: Error decoding message from 10.0.0.1:5000: invalid character", 100-logRepeatBurst)
+	if len(summaries) != 1 || summaries[0] != want {
+		t.Fatalf("summaries = %q, want [%q]", summaries, want)
+	}
+}
+
+func TestDetectGzipRoundTrips(t *testing.T) {
+	s := startServer(t, Config{DetectGzip: true})
+	conn, err := net.Dial("tcp", serverAddr(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	zw := gzip.NewWriter(conn)
+	if _, err := io.WriteString(zw, `{"type":"echo","id":"z1","payload":{"k":"v"}}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testReadTimeout))
+	zr, err := gzip.NewReader(conn)
+	if err != nil {
+		t.Fatalf("response is not gzip: %v", err)
+	}
+	line, err := bufio.NewReader(zr).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading gzip response: %v", err)
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &resp); err != nil || resp["id"] != "z1" || payload(resp)["k"] != "v" {
+		t.Fatalf("response %q, %v", line, err)
+	}
+
+	plain := dialServer(t, s)
+	if resp := plain.request(map[string]interface{}{"type": "echo", "id": "p1"}); resp["id"] != "p1" {
+		t.Fatalf("plaintext client answered %v", resp)
+	}
+}
+
+func TestConnectionSummaryLogCountsLifetime(t *testing.T) {
+	s := newTestServer(t, Config{ConnectionSummaryLog: true, MaxPayloadKeys: 1})
+	logs := captureLog(s)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	client, id := dialWithID(t, s) // One message
+	s.TagConnection(id, "billing")
+	client.request(map[string]interface{}{"type": "echo", "id": "e1"})
+	client.request(map[string]interface{}{"type": "echo", "id": "e2"})
+	client.request(map[string]interface{}{"type": "echo", "id": "bad", "payload": map[string]interface{}{"a": 1, "b": 2}})
+	client.conn.Close()
+
+	var summary connSummary
+	waitFor(t, time.Second, "the connection summary", func() bool {
+		_, line, ok := strings.Cut(logs.String(), "Connection summary: ")
+		if !ok {
+			return false
+		}
+		line, _, _ = strings.Cut(line, "\n")
+		return json.Unmarshal([]byte(line), &summary) == nil
+	})
+	if summary.ID != id || summary.Messages != 4 || summary.Errors != 1 || summary.BytesRead == 0 || summary.BytesWritten == 0 {
+		t.Fatalf("summary = %+v, want 4 messages and 1 error on %s with bytes both ways", summary, id)
+	}
+	if len(summary.Tags) != 1 || summary.Tags[0] != "billing" {
+		t.Fatalf("summary tags = %v, want [billing]", summary.Tags)
+	}
+}
+
+func TestTransactionCommitAndRollback(t *testing.T) {
+	s := newTestServer(t, Config{EnableTransactions: true, MaxTransactionMessages: 2})
+	var mu sync.Mutex
+	var applied []string
+	s.Handle("set", func(ctx context.Context, msg Message) (Message, error) {
+		tx, ok := TransactionFromContext(ctx)
+		if !ok {
+			return Message{}, errors.New("set outside a transaction")
+		}
+		key := msg.Payload["key"].(string)
+		tx.OnCommit(func() {
+			mu.Lock()
+			applied = append(applied, key)
+			mu.Unlock()
+		})
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+	set := func(key string) map[string]interface{} {
+		return map[string]interface{}{"type": "set", "id": key, "payload": map[string]interface{}{"key": key}}
+	}
+	appliedKeys := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(applied, ",")
+	}
+
+	client.request(map[string]interface{}{"type": "begin", "id": "b1"})
+	client.request(set("a"))
+	client.request(set("b"))
+	if got := appliedKeys(); got != "" {
+		t.Fatalf("effects %q applied before commit", got)
+	}
+	if resp := client.request(map[string]interface{}{"type": "commit", "id": "c1"}); payload(resp)["messages"] != float64(2) {
+		t.Fatalf("commit answered %v", resp)
+	}
+	if got := appliedKeys(); got != "a,b" {
+		t.Fatalf("after commit applied %q, want a,b", got)
+	}
+
+	client.request(map[string]interface{}{"type": "begin", "id": "b2"})
+	client.request(set("c"))
+	client.request(set("d"))
+	client.request(map[string]interface{}{"type": "rollback", "id": "r1"})
+	if got := appliedKeys(); got != "a,b" {
+		t.Fatalf("after rollback applied %q, want only a,b", got)
+	}
+
+	client.request(map[string]interface{}{"type": "begin", "id": "b3"})
+	client.request(set("e"))
+	client.request(set("f"))
+	if resp := client.request(set("g")); errorReason(resp) != "transaction_too_large" {
+		t.Fatalf("third message answered %v, want transaction_too_large", resp)
+	}
+}
+
+func BenchmarkAcceptLoops(b *testing.B) {
+	for _, loops := range []int{1, 4} {
+		b.Run(fmt.Sprintf("loops=%d", loops), func(b *testing.B) {
+			s := NewServer(Config{Port: "0", AcceptLoops: loops}.WithDefaults())
+			s.logger = log.New(io.Discard, "", 0)
+			if err := s.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer stopServer(s)
+			addr := serverAddr(s)
+			line := []byte(`{"type":"echo","id":"b"}` + "\n")
+
+			b.SetParallelism(8) // Enough dialers to keep every accept loop busy
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 4096)
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					// The echo only arrives once the connection was accepted
+					if _, err := conn.Write(line); err == nil {
+						_, err = conn.Read(buf)
+					}
+					conn.Close()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestShutdownStopsEveryAcceptLoop(t *testing.T) {
+	s := newTestServer(t, Config{AcceptLoops: 4})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		dialWithID(t, s)
+	}
+	done := make(chan struct{})
+	go func() {
+		stopServer(s)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return; an accept loop is still running")
+	}
+	if _, err := net.DialTimeout("tcp", serverAddr(s), 100*time.Millisecond); err == nil {
+		t.Fatal("listener still accepting after Shutdown")
+	}
+}
+
+func TestIsConnectedTracksLifetime(t *testing.T) {
+	s := startServer(t, Config{})
+	client, id := dialWithID(t, s)
+	if !s.IsConnected(id) {
+		t.Fatalf("IsConnected(%s) = false for an open connection", id)
+	}
+	client.conn.Close()
+	waitFor(t, time.Second, "IsConnected to turn false", func() bool { return !s.IsConnected(id) })
+	if s.IsConnected("conn-missing") {
+		t.Fatal("IsConnected true for an unknown ID")
+	}
+}
+
+func TestFlowControlWindowUpdates(t *testing.T) {
+	const window, total = 4, 40
+	s := startServer(t, Config{FlowControlWindow: window})
+
+	// A client that spends only the credit it holds is never throttled
+	polite := dialServer(t, s)
+	credits := 0
+	echoes, rejected := 0, 0
+	handle := func(msg map[string]interface{}) {
+		switch {
+		case msg["type"] == "window_update":
+			n, _ := payloadInt(payload(msg)["credits"])
+			credits += n
+		case errorReason(msg) == "flow_control":
+			rejected++
+		case msg["type"] == "echo":
+			echoes++
+		}
+	}
+	for sent := 0; sent < total; {
+		for credits == 0 {
+			handle(polite.read())
+		}
+		polite.send(map[string]interface{}{"type": "echo", "id": fmt.Sprint(sent)})
+		credits--
+		sent++
+	}
+	for echoes+rejected < total {
+		handle(polite.read())
+	}
+	if rejected != 0 {
+		t.Fatalf("client respecting window updates had %d of %d messages rejected", rejected, total)
+	}
+
+	// A client that ignores its window is backpressured
+	rude := dialServer(t, s)
+	if msg := rude.read(); msg["type"] != "window_update" {
+		t.Fatalf("first message %v, want the initial window_update", msg)
+	}
+	var burst strings.Builder
+	for i := 0; i < total; i++ {
+		fmt.Fprintf(&burst, `{"type":"echo","id":"r%d"}`+"\n", i)
+	}
+	rude.sendLine(strings.TrimSuffix(burst.String(), "\n"))
+	echoes, rejected = 0, 0
+	for echoes+rejected < total {
+		handle(rude.read())
+	}
+	if rejected == 0 {
+		t.Fatalf("client ignoring its window sent %d messages with none rejected", total)
+	}
+}
+
+func TestHandshakeTimeoutClosesStalledClients(t *testing.T) {
+	const timeout = 150 * time.Millisecond
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, Config{HandshakeTimeout: timeout})
+
+	// Connects but never sends a ClientHello
+	stalled, err := net.Dial("tcp", serverAddr(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	start := time.Now()
+	stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err == nil {
+		t.Fatal("server sent data to a client that never started the handshake")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("stalled handshake not closed within 2s")
+	}
+	if took := time.Since(start); took < timeout/2 {
+		t.Fatalf("closed after %v, before HandshakeTimeout", took)
+	}
+}
+
+func TestZeroHandshakeTimeoutUsesDefault(t *testing.T) {
+	ca := newTestCA(t)
+	var config Config
+	config.TLSCertFile, config.TLSKeyFile = ca.issue("localhost")
+	s := newTestServer(t, config)
+	s.config.HandshakeTimeout = 0 // A config built without WithDefaults
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client, err := dialTLS(t, s, ca, nil)
+	if err != nil {
+		t.Fatalf("handshake with a zero HandshakeTimeout: %v", err)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "h1"}); resp["id"] != "h1" {
+		t.Fatalf("echo = %v", resp)
+	}
+}
+
+func TestDeltaResponsesCarryOnlyChangedFields(t *testing.T) {
+	s := newTestServer(t, Config{DeltaResponses: true})
+	s.Handle("stamp", func(ctx context.Context, msg Message) (Message, error) {
+		msg.Payload["stamped"] = true
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	resp := client.request(map[string]interface{}{"type": "stamp", "id": "d1", "source": "app", "payload": map[string]interface{}{"big": strings.Repeat("x", 100)}})
+	if resp["id"] != "d1" || resp["time"] == nil || resp["trace_id"] == nil {
+		t.Fatalf("delta %v, want the id, server time and trace ID", resp)
+	}
+	if _, ok := resp["type"]; ok {
+		t.Fatalf("delta %v repeats the unchanged type", resp)
+	}
+	if _, ok := resp["source"]; ok {
+		t.Fatalf("delta %v repeats the unchanged source", resp)
+	}
+	if p := payload(resp); p["stamped"] != true {
+		t.Fatalf("delta payload %v, want the server's change", p)
+	}
+}
+
+func TestBytesPerSecondLimitsLargeMessages(t *testing.T) {
+	s := newTestServer(t, Config{MessagesPerSecond: 100, BytesPerSecond: 4000, RateLimitPolicy: "reject"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	large := strings.Repeat("x", 3000)
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "l1", "payload": map[string]interface{}{"data": large}}); resp["type"] == "error" {
+		t.Fatalf("first large message rejected within the burst: %v", resp)
+	}
+	resp := client.request(map[string]interface{}{"type": "echo", "id": "l2", "payload": map[string]interface{}{"data": large}})
+	if errorReason(resp) != "rate_limited" {
+		t.Fatalf("second large message answered with %v, want rate_limited", resp)
+	}
+	if ms, _ := payload(resp)["retry_after_ms"].(float64); ms <= 0 {
+		t.Fatalf("rate_limited error %v has no retry_after_ms", resp)
+	}
+}
+
+func TestBytesPerSecondThrottlesReads(t *testing.T) {
+	s := newTestServer(t, Config{BytesPerSecond: 10000})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	// A one-second burst, then 5000 bytes more at 10000 bytes a second
+	large := strings.Repeat("x", 5000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("l%d", i)
+		if resp := client.request(map[string]interface{}{"type": "echo", "id": id, "payload": map[string]interface{}{"data": large}}); resp["id"] != id {
+			t.Fatalf("message %s answered with %v", id, resp)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("3 messages of 5000 bytes took %v at 10000 bytes/s, want throttling", elapsed)
+	}
+}
+
+func TestEventLogUnavailableTurnsReadinessUnhealthy(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "events")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{EventLogFile: filepath.Join(dir, "events.log"), EventLogCheckInterval: 10 * time.Millisecond})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	if err := s.Ready(); err != nil {
+		t.Fatalf("Ready with a writable event log: %v", err)
+	}
+
+	// Removing the directory fails the probe even for root, which a
+	// permission change would not
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, "readiness to go unhealthy", func() bool { return s.Ready() != nil })
+	if resp := dialServer(t, s).read(); errorReason(resp) != "persistence_unavailable" {
+		t.Fatalf("new connection got %v, want persistence_unavailable", resp)
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, "readiness to recover", func() bool { return s.Ready() == nil })
+}
+
+func TestBroadcastUntilDropsExpiredMessages(t *testing.T) {
+	s := startServer(t, Config{BroadcastRate: 20, BroadcastBurst: 1, OutboundQueueSize: 16})
+	client, _ := dialWithID(t, s)
+
+	s.Broadcast(Message{Type: "tick", ID: "first"}) // Spends the only token
+	s.BroadcastUntil(Message{Type: "tick", ID: "expired"}, time.Now().Add(-time.Second))
+	s.BroadcastUntil(Message{Type: "tick", ID: "paced"}, time.Now().Add(10*time.Millisecond)) // Stale before the next token
+	s.Broadcast(Message{Type: "tick", ID: "fresh"})
+
+	for _, want := range []string{"first", "fresh"} {
+		if msg := client.read(); msg["id"] != want {
+			t.Fatalf("read %v, want broadcast %q", msg, want)
+		}
+	}
+	if n := s.metrics.broadcastsExpired.Load(); n != 2 {
+		t.Fatalf("%d broadcasts counted as expired, want 2", n)
+	}
+}
+
+func TestLiveCountMatchesRegistryUnderChurn(t *testing.T) {
+	s := startServer(t, Config{})
+	for i := 0; i < 5; i++ {
+		dialWithID(t, s) // Held open through the churn
+	}
+
+	stop := make(chan struct{})
+	negative := make(chan int64, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := s.liveCount.Load(); n < 0 {
+				negative <- n
+				return
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				conn, err := net.Dial("tcp", serverAddr(s))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if i%2 == 0 { // Half go through a full exchange, half close at once
+					fmt.Fprintf(conn, "{\"type\":\"echo\",\"id\":\"c%d\"}\n", i)
+					bufio.NewReader(conn).ReadString('\n')
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("dial: %v", err)
+	}
+
+	waitFor(t, 5*time.Second, "churned connections to be removed", func() bool { return s.liveCount.Load() == 5 })
+	close(stop)
+	select {
+	case n := <-negative:
+		t.Fatalf("liveCount went negative (%d) during churn", n)
+	default:
+	}
+	s.connMutex.RLock()
+	conns, byID := len(s.conns), len(s.connsByID)
+	s.connMutex.RUnlock()
+	if conns != 5 || byID != 5 || s.activeConnections() != 5 {
+		t.Fatalf("at quiescence: conns=%d byID=%d activeConnections=%d, want 5", conns, byID, s.activeConnections())
+	}
+}
+
+func TestMaxPendingFirstMessageShedsIdleConnects(t *testing.T) {
+	s := startServer(t, Config{MaxPendingFirstMessage: 3})
+	established, _ := dialWithID(t, s)
+
+	idle := make([]*testClient, 3)
+	for i := range idle {
+		idle[i] = dialServer(t, s)
+	}
+	waitFor(t, time.Second, "idle connections to be counted", func() bool { return s.pendingFirst.Load() == 3 })
+	for i := 0; i < 5; i++ {
+		if resp := dialServer(t, s).read(); errorReason(resp) != "server_overloaded" {
+			t.Fatalf("connect %d over the limit got %v, want server_overloaded", i, resp)
+		}
+	}
+	if resp := established.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+		t.Fatalf("established client got %v while shedding", resp)
+	}
+
+	// A first message frees a slot
+	if resp := idle[0].request(map[string]interface{}{"type": "echo", "id": "i1"}); resp["id"] != "i1" {
+		t.Fatalf("idle client got %v", resp)
+	}
+	waitFor(t, time.Second, "the slot to be released", func() bool { return s.pendingFirst.Load() == 2 })
+	if resp := dialServer(t, s).request(map[string]interface{}{"type": "echo", "id": "n1"}); resp["id"] != "n1" {
+		t.Fatalf("connect under the limit got %v", resp)
+	}
+}
+
+// fakePublisher records what the server publishes
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []string // topic/id
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic string, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, topic+"/"+msg.ID)
+	return nil
+}
+
+func (p *fakePublisher) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+func TestPublisherMirrorsProcessedMessages(t *testing.T) {
+	pub := &fakePublisher{}
+	s := newTestServer(t, Config{Publisher: pub})
+	s.Handle("fail", func(ctx context.Context, msg Message) (Message, error) {
+		return Message{}, errors.New("boom")
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	client.request(map[string]interface{}{"type": "echo", "id": "m1"})
+	if resp := client.request(map[string]interface{}{"type": "fail", "id": "m2"}); resp["type"] != "error" {
+		t.Fatalf("failing handler answered with %v", resp)
+	}
+	client.request(map[string]interface{}{"type": "note", "id": "m3"})
+
+	want := []string{"echo/m1", "note/m3"}
+	waitFor(t, time.Second, "messages to be published", func() bool { return len(pub.list()) >= len(want) })
+	if got := pub.list(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("published %v, want %v (errors are not published)", got, want)
+	}
+}
+
+func TestRateLimitedResponseCarriesRetryAfter(t *testing.T) {
+	s := startServer(t, Config{MessagesPerSecond: 4, RateLimitPolicy: "reject"})
+	client := dialServer(t, s)
+
+	var resp map[string]interface{}
+	for i := 0; i < 10 && errorReason(resp) != "rate_limited"; i++ {
+		resp = client.request(map[string]interface{}{"type": "echo", "id": fmt.Sprint(i)})
+	}
+	if errorReason(resp) != "rate_limited" {
+		t.Fatalf("burst of 10 at 4 msg/s never rate limited: %v", resp)
+	}
+	p := payload(resp)
+	ms, _ := p["retry_after_ms"].(float64)
+	if ms <= 0 || ms > 250 || p["retryable"] != true {
+		t.Fatalf("rate_limited payload %v, want retryable with retry_after_ms in (0, 250]", p)
+	}
+
+	// A client that waits the hint is admitted
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "after"}); resp["id"] != "after" || resp["type"] == "error" {
+		t.Fatalf("message after waiting %vms answered with %v", ms, resp)
+	}
+}
+
+// pipeListener is an in-memory net.Listener whose connections are net.Pipes
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// dial returns the client end of a new connection accepted by the listener
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestInMemoryListenerRoundTripsMessages(t *testing.T) {
+	l := newPipeListener()
+	s := newTestServer(t, Config{Listener: l})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := l.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := newTestClient(t, conn)
+		for j := 0; j < 3; j++ {
+			id := fmt.Sprintf("c%d-%d", i, j)
+			resp := client.request(map[string]interface{}{"type": "echo", "id": id, "payload": map[string]interface{}{"n": j}})
+			if resp["id"] != id || payload(resp)["n"] != float64(j) {
+				t.Fatalf("echo %s over a pipe answered with %v", id, resp)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with an in-memory listener: %v", err)
+	}
+	if _, err := l.dial(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("dial after Shutdown: %v, want the listener closed", err)
+	}
+}
+
+func TestHandlerReadDeadlineGovernsNextRead(t *testing.T) {
+	s := newTestServer(t, Config{})
+	deadlineIn := func(d time.Duration) Handler {
+		return func(ctx context.Context, msg Message) (Message, error) {
+			conn, ok := ConnContextFrom(ctx)
+			if !ok {
+				return Message{}, errors.New("no ConnContext")
+			}
+			return msg, conn.SetReadDeadline(time.Now().Add(d))
+		}
+	}
+	s.Handle("tighten", deadlineIn(100*time.Millisecond))
+	s.Handle("extend", deadlineIn(2*time.Second))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	extended := dialServer(t, s)
+	extended.request(map[string]interface{}{"type": "tighten", "id": "t1"})
+	extended.request(map[string]interface{}{"type": "extend", "id": "x1"})
+	time.Sleep(300 * time.Millisecond)
+	if resp := extended.request(map[string]interface{}{"type": "echo", "id": "slow"}); resp["id"] != "slow" {
+		t.Fatalf("slow message after extending the deadline answered with %v", resp)
+	}
+
+	tightened := dialServer(t, s)
+	tightened.request(map[string]interface{}{"type": "tighten", "id": "t2"})
+	tightened.expectClosed(time.Second)
+}
+
+func TestShutdownWithNoConnectionsReturnsPromptly(t *testing.T) {
+	for _, name := range []string{"live context", "cancelled context"} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, Config{ShutdownTimeout: time.Minute, DrainProgressInterval: time.Minute})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if name == "cancelled context" {
+				cancel()
+			}
+			defer cancel()
+
+			start := time.Now()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown: %v, want nil", err)
+			}
+			if took := time.Since(start); took > 100*time.Millisecond {
+				t.Fatalf("Shutdown with no connections took %v", took)
+			}
+		})
+	}
+}
+
+func TestProtocolVersionCounters(t *testing.T) {
+	s := startServer(t, Config{ProtocolVersions: []string{"2", "1"}})
+	negotiate := func(offer []interface{}, want string, messages int) {
+		t.Helper()
+		client := dialServer(t, s)
+		if resp := client.request(map[string]interface{}{"type": "hello", "payload": map[string]interface{}{"versions": offer}}); payload(resp)["version"] != want {
+			t.Fatalf("hello offering %v answered with %v, want version %s", offer, resp, want)
+		}
+		for i := 0; i < messages; i++ {
+			client.request(map[string]interface{}{"type": "echo", "id": fmt.Sprint(i)})
+		}
+	}
+	negotiate([]interface{}{"1"}, "1", 2)
+	negotiate([]interface{}{"1", "2"}, "2", 3)
+	legacy := dialServer(t, s)
+	legacy.request(map[string]interface{}{"type": "echo", "id": "old"})
+	legacy.conn.Close()
+	waitFor(t, time.Second, "the unversioned connection to close", func() bool { return s.activeConnections() == 2 })
+
+	// Hellos are counted before they negotiate, so under "none"
+	out := scrape(t, s)
+	for _, want := range []string{
+		`server_connections_by_version_total{version="1"} 1`,
+		`server_connections_by_version_total{version="2"} 1`,
+		`server_connections_by_version_total{version="none"} 1`,
+		`server_messages_received_by_version_total{version="1"} 2`,
+		`server_messages_received_by_version_total{version="2"} 3`,
+		`server_messages_received_by_version_total{version="none"} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestRegisterTransformAppliesOnlyToMatchingTypes(t *testing.T) {
+	s := newTestServer(t, Config{})
+	s.RegisterTransform("shout", func(msg *Message) {
+		if text, ok := msg.Payload["text"].(string); ok {
+			msg.Payload["text"] = strings.ToUpper(text)
+		}
+	})
+	s.RegisterTransform("handled", func(msg *Message) { msg.Payload["transformed"] = true })
+	s.Handle("handled", func(ctx context.Context, msg Message) (Message, error) { return msg, nil })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	tests := []struct {
+		msgType, want string
+	}{
+		{"shout", "HELLO"},
+		{"echo", "hello"},
+		{"handled", "hello"},
+	}
+	for _, tt := range tests {
+		resp := client.request(map[string]interface{}{"type": tt.msgType, "payload": map[string]interface{}{"text": "hello"}})
+		if p := payload(resp); p["text"] != tt.want || p["transformed"] != nil {
+			t.Errorf("%s answered with payload %v, want text %q and no transformed field", tt.msgType, p, tt.want)
+		}
+	}
+
+	s.RegisterTransform("shout", nil)
+	if resp := client.request(map[string]interface{}{"type": "shout", "payload": map[string]interface{}{"text": "hello"}}); payload(resp)["text"] != "hello" {
+		t.Fatalf("removed transform still applied: %v", resp)
+	}
+}
+
+func TestSourceQuotaIsolatesSources(t *testing.T) {
+	s := startServer(t, Config{SourceQuota: map[string]int{"a": 2, "b": 5}})
+	first, second := dialServer(t, s), dialServer(t, s)
+	send := func(client *testClient, source, id string) map[string]interface{} {
+		return client.request(map[string]interface{}{"type": "echo", "id": id, "source": source})
+	}
+
+	// a's quota is shared across its connections
+	send(first, "a", "a1")
+	send(second, "a", "a2")
+	resp := send(first, "a", "a3")
+	if errorReason(resp) != "quota_exceeded" {
+		t.Fatalf("a's third message answered with %v, want quota_exceeded", resp)
+	}
+	if ms, _ := payload(resp)["retry_after_ms"].(float64); ms <= 0 || ms > float64(time.Minute/time.Millisecond) {
+		t.Fatalf("quota_exceeded payload %v, want retry_after_ms within the window", payload(resp))
+	}
+
+	// b, on the same connections, and unlisted c are unaffected
+	for i := 0; i < 5; i++ {
+		for _, tt := range []struct {
+			client *testClient
+			source string
+		}{{first, "b"}, {second, "c"}} {
+			id := fmt.Sprintf("%s%d", tt.source, i)
+			if resp := send(tt.client, tt.source, id); resp["type"] == "error" {
+				t.Fatalf("%s's message %d answered with %v", tt.source, i, resp)
+			}
+		}
+	}
+
+	want := map[string]uint64{"a": 3, "b": 5}
+	if got := s.SourceCounts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("SourceCounts = %v, want %v", got, want)
+	}
+}
+
+// flakyConn fails its first write with a timeout after writing only a few
+// bytes, like a momentarily stalled client
+type flakyConn struct {
+	net.Conn
+	failed atomic.Bool
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if len(p) > 3 && c.failed.CompareAndSwap(false, true) {
+		n, _ := c.Conn.Write(p[:3])
+		return n, os.ErrDeadlineExceeded
+	}
+	return c.Conn.Write(p)
+}
+
+// flakyListener hands out flakyConns
+type flakyListener struct{ *pipeListener }
+
+func (l flakyListener) Accept() (net.Conn, error) {
+	conn, err := l.pipeListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &flakyConn{Conn: conn}, nil
+}
+
+func TestWriteRetriesRecoverTransientTimeouts(t *testing.T) {
+	for _, retries := range []int{0, 2} {
+		t.Run(fmt.Sprintf("retries=%d", retries), func(t *testing.T) {
+			l := newPipeListener()
+			s := newTestServer(t, Config{Listener: flakyListener{l}, WriteRetries: retries})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer stopServer(s)
+			conn, err := l.dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			client := newTestClient(t, conn)
+
+			client.send(map[string]interface{}{"type": "echo", "id": "w1", "payload": map[string]interface{}{"text": "intact"}})
+			if retries == 0 {
+				client.expectClosed(time.Second)
+				return
+			}
+			if resp := client.read(); resp["id"] != "w1" || payload(resp)["text"] != "intact" {
+				t.Fatalf("response after a retried write: %v", resp)
+			}
+			if resp := client.request(map[string]interface{}{"type": "echo", "id": "w2"}); resp["id"] != "w2" {
+				t.Fatalf("connection unusable after the retry: %v", resp)
+			}
+		})
+	}
+}
+
+func TestWriteRetriesOutlastStalledReader(t *testing.T) {
+	const writeTimeout = 50 * time.Millisecond
+	l := newPipeListener()
+	s := newTestServer(t, Config{Listener: l, WriteTimeout: writeTimeout, WriteRetries: 3})
+	logs := captureLog(s)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := newTestClient(t, conn)
+
+	// A pipe write blocks until the reader reads, so not reading for longer
+	// than WriteTimeout makes the response's first attempts time out
+	client.send(map[string]interface{}{"type": "echo", "id": "s1", "payload": map[string]interface{}{"text": "intact"}})
+	time.Sleep(2*writeTimeout + writeTimeout/2)
+	if resp := client.read(); resp["id"] != "s1" || payload(resp)["text"] != "intact" {
+		t.Fatalf("response after a stalled read: %v", resp)
+	}
+	if !strings.Contains(logs.String(), "timed out") {
+		t.Fatalf("no retried write logged:\n%s", logs)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "s2"}); resp["id"] != "s2" {
+		t.Fatalf("connection unusable after the retries: %v", resp)
+	}
+}
+
+func TestVersionReportsBuildInfo(t *testing.T) {
+	defer func(v string) { buildVersion = v }(buildVersion)
+	buildVersion = "v1.2.3-test"
+
+	// A free port for the metrics server, which does not report its address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsAddr := ln.Addr().String()
+	ln.Close()
+	s := startServer(t, Config{MetricsAddr: metricsAddr})
+
+	resp := dialServer(t, s).request(map[string]interface{}{"type": "version", "id": "v1"})
+	check := func(from string, info map[string]interface{}) {
+		t.Helper()
+		if info["version"] != "v1.2.3-test" || info["go_version"] != runtime.Version() {
+			t.Errorf("%s reported %v, want the ldflags version and %s", from, info, runtime.Version())
+		}
+		if started, err := time.Parse(time.RFC3339Nano, fmt.Sprint(info["started_at"])); err != nil || !started.Equal(s.startedAt) {
+			t.Errorf("%s reported started_at %v, want %v", from, info["started_at"], s.startedAt)
+		}
+	}
+	check("version message", payload(resp))
+
+	var httpResp *http.Response
+	waitFor(t, time.Second, "the metrics server", func() bool {
+		httpResp, err = http.Get("http://" + metricsAddr + "/version")
+		return err == nil
+	})
+	defer httpResp.Body.Close()
+	var info map[string]interface{}
+	if err := json.NewDecoder(httpResp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	check("/version", info)
+}
+
+func TestMaxPingOnlyDurationClosesIdlePingers(t *testing.T) {
+	s := startServer(t, Config{MaxPingOnlyDuration: 150 * time.Millisecond})
+	pinger, worker := dialServer(t, s), dialServer(t, s)
+	worker.request(map[string]interface{}{"type": "echo", "id": "work"})
+
+	closed := false
+	for start := time.Now(); time.Since(start) < 600*time.Millisecond; time.Sleep(30 * time.Millisecond) {
+		if resp := worker.request(map[string]interface{}{"type": "ping"}); resp["type"] == "error" {
+			t.Fatalf("working client's ping answered with %v", resp)
+		}
+		if closed {
+			continue
+		}
+		pinger.send(map[string]interface{}{"type": "ping"})
+		if line, err := pinger.tryReadLine(time.Second); err != nil || strings.Contains(line, "ping_only") {
+			if time.Since(start) < 100*time.Millisecond { // Some slack: the timer started at dial
+				t.Fatalf("ping-only connection closed after %v: %q, %v", time.Since(start), line, err)
+			}
+			closed = true
+		}
+	}
+	if !closed {
+		t.Fatal("ping-only connection still open after 600ms")
+	}
+	if n := s.metrics.pingOnlyClosed.Load(); n != 1 {
+		t.Fatalf("server_ping_only_closed_total = %d, want 1", n)
+	}
+}
+
+func TestSnapshotAndResetReportsDeltas(t *testing.T) {
+	s := startServer(t, Config{})
+	held := dialServer(t, s)
+	for i := 0; i < 3; i++ {
+		held.request(map[string]interface{}{"type": "echo", "id": fmt.Sprint(i)})
+	}
+
+	first := s.SnapshotAndReset()
+	if first.ConnectionsAccepted != 1 || first.MessagesReceived != 3 || first.ConnectionsActive != 1 {
+		t.Fatalf("first snapshot %+v, want 1 accepted, 3 received, 1 active", first)
+	}
+
+	other := dialServer(t, s)
+	other.request(map[string]interface{}{"type": "echo", "id": "x"})
+	held.request(map[string]interface{}{"type": "echo", "id": "y"})
+
+	second := s.SnapshotAndReset()
+	if second.ConnectionsAccepted != 1 || second.MessagesReceived != 2 {
+		t.Fatalf("second snapshot counters %+v, want only the 1 connection and 2 messages since the first", second)
+	}
+	if second.ConnectionsActive != 2 {
+		t.Fatalf("second snapshot gauge connections_active = %d, want 2 (gauges are not reset)", second.ConnectionsActive)
+	}
+	if third := s.SnapshotAndReset(); third.MessagesReceived != 0 || third.ConnectionsAccepted != 0 {
+		t.Fatalf("idle interval snapshot %+v, want zero counters", third)
+	}
+}
+
+func TestMaxTopicsPerConnRejectsUntilUnsubscribe(t *testing.T) {
+	s := startServer(t, Config{EnableSubscriptions: true, MaxTopicsPerConn: 2})
+	client := dialServer(t, s)
+	command := func(msgType, topic string) map[string]interface{} {
+		return client.request(map[string]interface{}{"type": msgType, "payload": map[string]interface{}{"topic": topic}})
+	}
+
+	for _, topic := range []string{"a", "b", "b"} { // Resubscribing takes no new slot
+		if resp := command("subscribe", topic); resp["type"] != "subscribe" {
+			t.Fatalf("subscribe %s answered with %v", topic, resp)
+		}
+	}
+	if resp := command("subscribe", "c"); errorReason(resp) != "too_many_subscriptions" {
+		t.Fatalf("third topic answered with %v, want too_many_subscriptions", resp)
+	}
+
+	command("unsubscribe", "a")
+	if resp := command("subscribe", "c"); resp["type"] != "subscribe" || payload(resp)["topics"] != float64(2) {
+		t.Fatalf("subscribe after unsubscribing answered with %v", resp)
+	}
+	if n := s.BroadcastTopic("a", Message{Type: "news"}); n != 0 {
+		t.Fatalf("broadcast to the rotated-out topic reached %d connections", n)
+	}
+	if n := s.BroadcastTopic("c", Message{Type: "news", ID: "n1"}); n != 1 {
+		t.Fatalf("broadcast to the new topic reached %d connections, want 1", n)
+	}
+	if msg := client.read(); msg["id"] != "n1" {
+		t.Fatalf("read %v, want the topic broadcast", msg)
+	}
+}
+
+func TestAffinityFuncRedirectsPerConnection(t *testing.T) {
+	var mu sync.Mutex
+	successors := map[string]string{}
+	s := startServer(t, Config{
+		RedirectAddr: "fallback:9000",
+		AffinityFunc: func(c ConnContext) string {
+			mu.Lock()
+			defer mu.Unlock()
+			return successors[c.ID()]
+		},
+	})
+	clients := make([]*testClient, 3)
+	want := []string{"node-a:9000", "node-b:9000", "fallback:9000"}
+	for i := range clients {
+		var id string
+		clients[i], id = dialWithID(t, s)
+		if i < 2 { // The last has no affinity and falls back to RedirectAddr
+			mu.Lock()
+			successors[id] = want[i]
+			mu.Unlock()
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	for i, client := range clients {
+		msg := client.read()
+		if msg["type"] != "shutdown" || payload(msg)["redirect"] != want[i] {
+			t.Errorf("client %d got notice %v, want redirect %s", i, msg, want[i])
+		}
+		client.conn.Close()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+// streamItems streams n integers as the response to msg, closing the
+// stream unless leaveOpen is set
+func streamItems(ctx context.Context, msg Message, n int, leaveOpen bool) error {
+	conn, _ := ConnContextFrom(ctx)
+	stream, err := conn.StreamArray(msg)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Append(i); err != nil {
+			return err
+		}
+	}
+	if leaveOpen {
+		return nil
+	}
+	return stream.Close()
+}
+
+func TestArrayStreamReleasedWhenHandlerLeavesItOpen(t *testing.T) {
+	s := newTestServer(t, Config{})
+	s.Handle("leak", func(ctx context.Context, msg Message) (Message, error) {
+		return msg, streamItems(ctx, msg, 3, true) // Returns a response too, which must not be sent
+	})
+	s.Handle("twice", func(ctx context.Context, msg Message) (Message, error) {
+		conn, _ := ConnContextFrom(ctx)
+		if _, err := conn.StreamArray(msg); err != nil {
+			return Message{}, err
+		}
+		_, err := conn.StreamArray(msg)
+		return Message{}, err
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	resp := client.request(map[string]interface{}{"type": "leak", "id": "l1"})
+	if items, _ := payload(resp)["items"].([]interface{}); resp["id"] != "l1" || len(items) != 3 {
+		t.Fatalf("leaked stream arrived as %v, want a complete 3-item response", resp)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+		t.Fatalf("connection unusable after a leaked stream: %v", resp)
+	}
+
+	// The second StreamArray fails instead of deadlocking on the first
+	if resp := client.request(map[string]interface{}{"type": "twice", "id": "t1"}); resp["id"] != "t1" || resp["type"] != "twice" {
+		t.Fatalf("handler opening two streams answered with %v, want the first stream", resp)
+	}
+	if resp := client.request(map[string]interface{}{"type": "echo", "id": "e2"}); resp["id"] != "e2" {
+		t.Fatalf("connection unusable after a double stream: %v", resp)
+	}
+}
+
+func TestArrayStreamReleasedWhenHandlerPanics(t *testing.T) {
+	s := newTestServer(t, Config{StreamFlushElements: 1})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	cc := &clientConn{id: "conn-1", conn: conn, encoder: json.NewEncoder(conn), out: conn, done: make(chan struct{})}
+	s.Handle("crash", func(ctx context.Context, msg Message) (Message, error) {
+		streamItems(ctx, msg, 2, true)
+		panic("handler bug")
+	})
+
+	func() {
+		defer func() { recover() }()
+		s.processWithConn(context.Background(), cc, Message{Type: "crash", ID: "c1"})
+	}()
+	if !cc.writeMutex.TryLock() {
+		t.Fatal("connection writes still held after the handler panicked mid-stream")
+	}
+	cc.writeMutex.Unlock()
+}
+
+func TestArrayStreamAllocationsStayBounded(t *testing.T) {
+	const elements = 10000
+	s := newTestServer(t, Config{})
+	cc := &clientConn{id: "conn-1", encoder: json.NewEncoder(io.Discard), out: io.Discard}
+	msg := Message{Type: "list", ID: "big"}
+
+	allocs := testing.AllocsPerRun(5, func() {
+		c := &ConnContext{cc: cc, s: s}
+		stream, err := c.StreamArray(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < elements; i++ {
+			stream.Append(i % 256) // Small ints box without allocating
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Encoding an element reuses the stream's buffers; what is left is one
+	// small allocation inside encoding/json, and nothing sized by the array
+	if perElement := allocs / elements; perElement > 2 {
+		t.Fatalf("streaming %d elements made %.0f allocations (%.2f each), want a small constant per element", elements, allocs, perElement)
+	}
+}
+
+func TestAwaitMarkReadyRejectsUntilReady(t *testing.T) {
+	s := startServer(t, Config{AwaitMarkReady: true})
+	if err := s.Ready(); err == nil {
+		t.Fatal("Ready before MarkReady reported ready")
+	}
+	resp := dialServer(t, s).read()
+	if errorReason(resp) != "not_ready" || payload(resp)["retryable"] != true {
+		t.Fatalf("connection during warmup got %v, want a retryable not_ready", resp)
+	}
+
+	s.MarkReady()
+	if err := s.Ready(); err != nil {
+		t.Fatalf("Ready after MarkReady: %v", err)
+	}
+	if resp := dialServer(t, s).request(map[string]interface{}{"type": "echo", "id": "r1"}); resp["id"] != "r1" {
+		t.Fatalf("connection after MarkReady got %v", resp)
+	}
+}
+
+func TestWarmupDurationEndsOnItsOwn(t *testing.T) {
+	s := startServer(t, Config{WarmupDuration: 50 * time.Millisecond})
+	if errorReason(dialServer(t, s).read()) != "not_ready" {
+		t.Fatal("connection during WarmupDuration was not rejected")
+	}
+	waitFor(t, time.Second, "the warmup to end", func() bool { return s.Ready() == nil })
+	if resp := dialServer(t, s).request(map[string]interface{}{"type": "echo", "id": "w1"}); resp["id"] != "w1" {
+		t.Fatalf("connection after the warmup got %v", resp)
+	}
+}
+
+// readFrame reads a "message"-compressed response and inflates it
+func readFrame(t *testing.T, client *testClient) (msg map[string]interface{}, size int) {
+	t.Helper()
+	var frame compressedFrame
+	if err := json.Unmarshal([]byte(client.readLine()), &frame); err != nil || !frame.Compressed {
+		t.Fatalf("response is not a compressed frame: %v", err)
+	}
+	if err := json.NewDecoder(flate.NewReader(bytes.NewReader(frame.Data))).Decode(&msg); err != nil {
+		t.Fatalf("inflating frame: %v", err)
+	}
+	return msg, len(frame.Data)
+}
+
+func TestHelloCompressionLevelIsClampedAndApplied(t *testing.T) {
+	s := startServer(t, Config{Compression: "message", CompressMinBytes: 1, MinCompressionLevel: 2, MaxCompressionLevel: 9})
+
+	// Text that the slower levels compress noticeably better
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet"}
+	var text strings.Builder
+	for i := 0; text.Len() < 32<<10; i++ {
+		text.WriteString(words[(i*7+i/3+i*i%11)%len(words)])
+		text.WriteByte(' ')
+	}
+
+	sizes := map[int]int{}
+	for _, tt := range []struct{ requested, applied int }{{1, 2}, {9, 9}, {12, 9}} {
+		client := dialServer(t, s)
+		client.send(map[string]interface{}{"type": "hello", "payload": map[string]interface{}{"compression_level": tt.requested}})
+		if hello, _ := readFrame(t, client); payload(hello)["compression_level"] != float64(tt.applied) {
+			t.Fatalf("hello for level %d answered with %v, want level %d", tt.requested, hello, tt.applied)
+		}
+		client.send(map[string]interface{}{"type": "echo", "id": "big", "payload": map[string]interface{}{"text": text.String()}})
+		resp, size := readFrame(t, client)
+		if payload(resp)["text"] != text.String() {
+			t.Fatalf("level %d echo did not round-trip", tt.applied)
+		}
+		sizes[tt.applied] = size
+	}
+	if sizes[9] >= sizes[2] {
+		t.Fatalf("level 9 frame is %d bytes, not smaller than %d at level 2", sizes[9], sizes[2])
+	}
+}
+
+func TestDescribeListsHandlerInfo(t *testing.T) {
+	s := newTestServer(t, Config{})
+	noop := func(ctx context.Context, msg Message) (Message, error) { return msg, nil }
+	s.HandleWithInfo(HandlerInfo{Type: "quote", Description: "Latest price for payload.symbol", Schema: json.RawMessage(`{"required":["symbol"]}`)}, noop)
+	s.HandleWithInfo(HandlerInfo{Type: "order", Description: "Place an order"}, noop)
+	s.Handle("plain", noop)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+
+	want := []HandlerInfo{
+		{Type: "order", Description: "Place an order"},
+		{Type: "plain"},
+		{Type: "quote", Description: "Latest price for payload.symbol", Schema: json.RawMessage(`{"required":["symbol"]}`)},
+	}
+	if got := s.Handlers(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Handlers() = %+v, want %+v", got, want)
+	}
+
+	resp := dialServer(t, s).request(map[string]interface{}{"type": "describe", "id": "d1"})
+	var wantWire interface{}
+	data, _ := json.Marshal(want)
+	json.Unmarshal(data, &wantWire)
+	if got := payload(resp)["handlers"]; !reflect.DeepEqual(got, wantWire) {
+		t.Fatalf("describe returned %v, want %v", got, wantWire)
+	}
+}
+
+func TestWeightedPickerHonorsWeights(t *testing.T) {
+	weights := map[string]int{"a": 5, "b": 3, "c": 1, "off": 0, "neg": -2}
+	p := NewWeightedPicker(weights)
+
+	const cycles = 100
+	counts := map[string]int{}
+	run, longest := 0, 0
+	prev := ""
+	for i := 0; i < cycles*9; i++ {
+		backend := p.Pick()
+		counts[backend]++
+		if backend == prev {
+			run++
+		} else {
+			run = 1
+		}
+		prev, longest = backend, max(longest, run)
+	}
+	want := map[string]int{"a": 5 * cycles, "b": 3 * cycles, "c": cycles}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("picks over %d cycles = %v, want %v", cycles, counts, want)
+	}
+	if longest > 2 {
+		t.Fatalf("a backend was picked %d times in a row, want interleaved picks", longest)
+	}
+
+	if got := NewWeightedPicker(map[string]int{"off": 0}).Pick(); got != "" {
+		t.Fatalf("Pick with no usable backends = %q, want \"\"", got)
+	}
+}
+
+// fakeSink records pushed snapshots, failing them with err if set
+type fakeSink struct {
+	mu     sync.Mutex
+	pushes []MetricsSnapshot
+	err    error
+}
+
+func (k *fakeSink) Push(ctx context.Context, snap MetricsSnapshot) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pushes = append(k.pushes, snap)
+	return k.err
+}
+
+func TestFlushMetricsOnShutdownPushesFinalSnapshot(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flush bool
+		err   error
+	}{
+		{"flush", true, nil},
+		{"no flush", false, nil},
+		{"failed flush", true, errors.New("sink down")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{err: tt.err}
+			s := startServer(t, Config{MetricsSink: sink, MetricsPushInterval: time.Hour, FlushMetricsOnShutdown: tt.flush})
+			client := dialServer(t, s)
+			client.request(map[string]interface{}{"type": "echo", "id": "m1"})
+			client.request(map[string]interface{}{"type": "echo", "id": "m2"})
+			client.conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := s.Shutdown(ctx)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Shutdown: %v, want the sink's error", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			if !tt.flush {
+				if len(sink.pushes) != 0 {
+					t.Fatalf("%d pushes without FlushMetricsOnShutdown, want none within the hour", len(sink.pushes))
+				}
+				return
+			}
+			if len(sink.pushes) != 1 {
+				t.Fatalf("%d pushes, want one final flush", len(sink.pushes))
+			}
+			if final := sink.pushes[0]; final.MessagesReceived != 2 || final.ShutdownBacklog == nil {
+				t.Fatalf("final push %+v, want the 2 messages and the shutdown backlog", final)
+			}
+		})
+	}
+}
+
+func TestDeclaredTypesRestrictTheConnection(t *testing.T) {
+	s := startServer(t, Config{EnableTypeDeclarations: true})
+	declared := dialServer(t, s)
+	hello := declared.request(map[string]interface{}{"type": "hello", "payload": map[string]interface{}{
+		"types": map[string]interface{}{"reading": map[string]interface{}{"required": []interface{}{"sensor"}}},
+	}})
+	if hello["type"] != "hello" {
+		t.Fatalf("hello with declarations answered with %v", hello)
+	}
+
+	if resp := declared.request(map[string]interface{}{"type": "reading", "id": "r1", "payload": map[string]interface{}{"sensor": "s1"}}); resp["id"] != "r1" || resp["type"] == "error" {
+		t.Fatalf("declared type answered with %v", resp)
+	}
+	if resp := declared.request(map[string]interface{}{"type": "reading", "id": "r2", "payload": map[string]interface{}{}}); errorReason(resp) != "schema_violation" {
+		t.Fatalf("declared type missing its field answered with %v, want schema_violation", resp)
+	}
+	if resp := declared.request(map[string]interface{}{"type": "echo", "id": "e1"}); errorReason(resp) != "undeclared_type" {
+		t.Fatalf("undeclared type answered with %v, want undeclared_type", resp)
+	}
+
+	if resp := dialServer(t, s).request(map[string]interface{}{"type": "echo", "id": "e2"}); resp["id"] != "e2" || resp["type"] == "error" {
+		t.Fatalf("connection without declarations answered with %v", resp)
+	}
+}
+
+func TestSlowHandlerThresholdWarnsAndCounts(t *testing.T) {
+	s := newTestServer(t, Config{SlowHandlerThreshold: 20 * time.Millisecond})
+	logs := captureLog(s)
+	s.Handle("slow", func(ctx context.Context, msg Message) (Message, error) {
+		time.Sleep(60 * time.Millisecond)
+		return msg, nil
+	})
+	s.Handle("fast", func(ctx context.Context, msg Message) (Message, error) { return msg, nil })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	client.request(map[string]interface{}{"type": "slow", "id": "s1"})
+	client.request(map[string]interface{}{"type": "fast", "id": "f1"})
+	if out := logs.String(); !strings.Contains(out, `Warning: handler for "slow"`) || !strings.Contains(out, "(message s1)") {
+		t.Fatalf("no slow-handler warning naming the type and message: %q", out)
+	} else if strings.Contains(out, `handler for "fast"`) {
+		t.Fatalf("fast handler reported as slow: %q", out)
+	}
+	out := scrape(t, s)
+	if !strings.Contains(out, `server_slow_handler_calls_total{type="slow"} 1`+"\n") || strings.Contains(out, `{type="fast"}`) {
+		t.Fatalf("slow handler metric missing or fast handler counted:\n%s", out)
+	}
+}
+
+func TestZeroSlowHandlerThresholdUsesDefault(t *testing.T) {
+	config := Config{}.WithDefaults()
+	config.SlowHandlerThreshold = 0 // As if built without WithDefaults
+	s := NewServer(config)
+	logs := captureLog(s)
+	s.Handle("fast", func(ctx context.Context, msg Message) (Message, error) { return msg, nil })
+
+	s.processMessage(context.Background(), "conn-1", Message{Type: "fast", ID: "f1"})
+	if strings.Contains(logs.String(), "Warning") || s.metrics.slowHandlerCalls("fast").Load() != 0 {
+		t.Fatalf("zero threshold flagged a fast call as slow: %q", logs.String())
+	}
+}
+
+func TestSetFilterDropsMatchingMessages(t *testing.T) {
+	for _, reply := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ReplyFiltered=%t", reply), func(t *testing.T) {
+			s := startServer(t, Config{ReplyFiltered: reply})
+			s.SetFilter(func(c ConnContext, msg Message) bool { return msg.Type != "legacy" })
+			client := dialServer(t, s)
+
+			client.send(map[string]interface{}{"type": "legacy", "id": "l1"})
+			if reply {
+				if resp := client.read(); errorReason(resp) != "filtered" || resp["id"] != "l1" {
+					t.Fatalf("filtered message answered with %v, want a filtered error", resp)
+				}
+			}
+			// Responses are in order, so the next one would follow a leaked legacy reply
+			if resp := client.request(map[string]interface{}{"type": "echo", "id": "e1"}); resp["id"] != "e1" {
+				t.Fatalf("message after the filtered one answered with %v", resp)
+			}
+
+			s.SetFilter(nil)
+			if resp := client.request(map[string]interface{}{"type": "legacy", "id": "l2"}); resp["id"] != "l2" || resp["type"] != "legacy" {
+				t.Fatalf("legacy message after removing the filter answered with %v", resp)
+			}
+		})
+	}
+}
+
+// writeCountConn counts the writes made to it
+type writeCountConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c writeCountConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// writeCountListener hands out writeCountConns sharing one counter
+type writeCountListener struct {
+	*pipeListener
+	writes atomic.Int64
+}
+
+func (l *writeCountListener) Accept() (net.Conn, error) {
+	conn, err := l.pipeListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return writeCountConn{conn, &l.writes}, nil
+}
+
+func TestNoResponseClientIsServedWithoutWrites(t *testing.T) {
+	l := &writeCountListener{pipeListener: newPipeListener()}
+	s := newTestServer(t, Config{Listener: l, AllowNoResponse: true})
+	got := make(chan string, 10)
+	s.Handle("reading", func(ctx context.Context, msg Message) (Message, error) {
+		got <- msg.ID
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client never reads, so over a pipe any write would block the server
+	client := newTestClient(t, conn)
+	client.send(map[string]interface{}{"type": "hello", "payload": map[string]interface{}{"no_response": true}})
+	for i := 0; i < 3; i++ {
+		client.send(map[string]interface{}{"type": "reading", "id": fmt.Sprint(i)})
+	}
+	client.send(map[string]interface{}{"type": "echo", "id": "bad", "payload": "not an object"}) // Errors are not sent either
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-got:
+			if id != fmt.Sprint(i) {
+				t.Fatalf("handler got message %s, want %d", id, i)
+			}
+		case <-time.After(testReadTimeout):
+			t.Fatalf("message %d from the send-only client was not processed", i)
+		}
+	}
+	s.Broadcast(Message{Type: "news"})
+	time.Sleep(50 * time.Millisecond) // Let any stray write happen
+	if n := l.writes.Load(); n != 0 {
+		t.Fatalf("server made %d writes to a send-only client", n)
+	}
+}
+
+func TestMaxBufferedBytesShedsToStayWithinBudget(t *testing.T) {
+	const budget = 4000
+	s := startServer(t, Config{MaxBufferedBytes: budget, BroadcastRate: 1, BroadcastBurst: 1, OutboundQueueSize: 1000})
+	for i := 0; i < 3; i++ {
+		dialWithID(t, s) // Paced to one broadcast a second, so their queues fill
+	}
+
+	filler := strings.Repeat("x", 200)
+	for i := 0; i < 100; i++ {
+		s.Broadcast(Message{Type: "tick", ID: fmt.Sprint(i), Payload: map[string]interface{}{"data": filler}})
+		if queued := s.bufferedBytes.Load(); queued > budget {
+			t.Fatalf("after broadcast %d, %d bytes queued, over the budget of %d", i, queued, budget)
+		}
+	}
+	if queued := s.bufferedBytes.Load(); queued < budget/2 {
+		t.Fatalf("only %d bytes queued; the queues never approached the budget", queued)
+	}
+	if shed := s.metrics.broadcastsShed.Load(); shed == 0 {
+		t.Fatal("no broadcasts shed despite 3 slow connections getting 100 broadcasts")
+	}
+}
+
+func TestALPNRoutesEachProtocol(t *testing.T) {
+	ca := newTestCA(t)
+	release := make(chan struct{})
+	served := make(chan string, 1)
+	s := startTLSServer(t, ca, Config{
+		ALPNProtocol:           "json-tcp",
+		MaxPendingFirstMessage: 1,
+		ALPNHandlers: map[string]func(net.Conn){
+			"h2": func(conn net.Conn) {
+				defer conn.Close()
+				served <- conn.(*tls.Conn).ConnectionState().NegotiatedProtocol
+				io.WriteString(conn, "handed off\n")
+				<-release
+			},
+		},
+	})
+	defer close(release)
+
+	h2, err := dialTLS(t, s, ca, &tls.Config{NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("h2 dial: %v", err)
+	}
+	if line := h2.readLine(); line != "handed off" || <-served != "h2" {
+		t.Fatalf("h2 connection read %q, want the h2 handler's reply", line)
+	}
+	// The handed-off connection never sends us a message, so it must not
+	// hold the only MaxPendingFirstMessage slot
+	waitFor(t, time.Second, "the handed-off connection to leave the pending count", func() bool { return s.pendingFirst.Load() == 0 })
+
+	own, err := dialTLS(t, s, ca, &tls.Config{NextProtos: []string{"json-tcp"}})
+	if err != nil {
+		t.Fatalf("json-tcp dial: %v", err)
+	}
+	if resp := own.request(map[string]interface{}{"type": "echo", "id": "j1"}); resp["id"] != "j1" || resp["type"] == "error" {
+		t.Fatalf("json-tcp connection answered with %v while h2 was handed off", resp)
+	}
+}
+
+func TestPauseTypeRejectsOnlyThatType(t *testing.T) {
+	s := startServer(t, Config{})
+	first, second := dialServer(t, s), dialServer(t, s)
+
+	s.PauseType("orders")
+	for i, client := range []*testClient{first, second} {
+		resp := client.request(map[string]interface{}{"type": "orders", "id": fmt.Sprint(i)})
+		if p := payload(resp); errorReason(resp) != "type_paused" || p["retryable"] != true || p["code"] != float64(503) {
+			t.Fatalf("paused type on connection %d answered with %v, want a retryable 503 type_paused", i, resp)
+		}
+		if resp := client.request(map[string]interface{}{"type": "quotes", "id": fmt.Sprint(i)}); resp["type"] != "quotes" {
+			t.Fatalf("other type on connection %d answered with %v", i, resp)
+		}
+	}
+
+	s.ResumeType("orders")
+	if resp := first.request(map[string]interface{}{"type": "orders", "id": "after"}); resp["type"] != "orders" {
+		t.Fatalf("resumed type answered with %v", resp)
+	}
+}
+
+func TestMaxClockSkewDetectsAndRejects(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RejectClockSkew=%t", reject), func(t *testing.T) {
+			s := startServer(t, Config{MaxClockSkew: time.Minute, RejectClockSkew: reject})
+			client := dialServer(t, s)
+
+			future := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+			resp := client.request(map[string]interface{}{"type": "echo", "id": "f1", "time": future})
+			if reject != (errorReason(resp) == "clock_skew") {
+				t.Fatalf("far-future message answered with %v", resp)
+			}
+			if s.metrics.clockSkewed.Load() != 1 {
+				t.Fatalf("skewed messages counted %d, want 1", s.metrics.clockSkewed.Load())
+			}
+			now := time.Now().Format(time.RFC3339Nano)
+			for _, msg := range []map[string]interface{}{
+				{"type": "echo", "id": "n1", "time": now},
+				{"type": "echo", "id": "u1"}, // No client time to check
+			} {
+				if resp := client.request(msg); resp["type"] == "error" {
+					t.Fatalf("%v answered with %v", msg, resp)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolReusesConnectionsAcrossConcurrentRequests(t *testing.T) {
+	const size, workers, requests = 4, 16, 25
+	s := startServer(t, Config{})
+	pool := client.NewPool(serverAddr(s), size)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), testReadTimeout)
+				id := fmt.Sprintf("w%d-%d", w, i)
+				resp, err := pool.Do(ctx, client.Message{Type: "echo", ID: id, Payload: map[string]interface{}{"n": i}})
+				cancel()
+				if err == nil && (resp.ID != id || resp.Payload["n"] != float64(i)) {
+					err = fmt.Errorf("request %s answered with %+v", id, resp)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if dials := pool.Dials(); dials > size {
+		t.Fatalf("%d requests dialed %d connections, want at most the pool size %d", workers*requests, dials, size)
+	}
+	if accepted := s.metrics.connectionsAccepted.Load(); accepted != pool.Dials() {
+		t.Fatalf("server accepted %d connections, pool dialed %d", accepted, pool.Dials())
+	}
+
+	// Connections the server closed are redialed transparently
+	dials := pool.Dials()
+	s.DrainToCount(0, 50*time.Millisecond)
+	waitFor(t, time.Second, "the pool's connections to close", func() bool { return s.activeConnections() == 0 })
+	for i := 0; i < size; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), testReadTimeout)
+		resp, err := pool.Do(ctx, client.Message{Type: "echo", ID: fmt.Sprint("after", i)})
+		cancel()
+		if err != nil || resp.ID != fmt.Sprint("after", i) {
+			t.Fatalf("request after the server closed the pool's connections: %+v, %v", resp, err)
+		}
+	}
+	if redials := pool.Dials() - dials; redials == 0 || redials > size {
+		t.Fatalf("%d redials after the server closed the connections, want 1 to %d", redials, size)
+	}
+}
+
+func TestSampleEvery(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want uint64
+	}{
+		{1, 1},
+		{0.5, 2},
+		{0.3, 3},
+		{0.01, 100},
+		{0, 1}, // Config built without WithDefaults
+		{-1, 1},
+	}
+	for _, tt := range tests {
+		s := &Server{config: Config{MetricsSampleRate: tt.rate}}
+		if got := s.sampleEvery(); got != tt.want {
+			t.Errorf("sampleEvery() at rate %v = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestSampledDurationsEstimateTheMessageCount(t *testing.T) {
+	s := startServer(t, Config{MetricsSampleRate: 0.25})
+	client := dialServer(t, s)
+	for i := 0; i < 20; i++ {
+		client.request(map[string]interface{}{"type": "echo", "id": fmt.Sprint(i)})
+	}
+	// One message in 4 is timed and weighted by 4; the last is observed
+	// just after its response is sent
+	waitFor(t, time.Second, "the histogram to estimate the 20 messages", func() bool {
+		return strings.Contains(scrape(t, s), "server_message_duration_seconds_count 20\n")
+	})
+}
+
+func TestTLSInfoDescribesTheSession(t *testing.T) {
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, Config{ALPNProtocol: "json-tcp"})
+	client, err := dialTLS(t, s, ca, &tls.Config{ServerName: "localhost", NextProtos: []string{"json-tcp"}, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("TLS dial: %v", err)
+	}
+	state := client.conn.(*tls.Conn).ConnectionState()
+
+	info := payload(client.request(map[string]interface{}{"type": "tls_info", "id": "i1"}))
+	want := map[string]interface{}{
+		"tls":          true,
+		"version":      "TLS 1.2",
+		"cipher_suite": tls.CipherSuiteName(state.CipherSuite),
+		"alpn":         "json-tcp",
+		"server_name":  "localhost",
+		"resumed":      false,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("tls_info = %v, want %v", info, want)
+	}
+	if !strings.HasPrefix(info["cipher_suite"].(string), "TLS_ECDHE_") {
+		t.Fatalf("implausible cipher suite %v", info["cipher_suite"])
+	}
+
+	plain := startServer(t, Config{})
+	if info := payload(dialServer(t, plain).request(map[string]interface{}{"type": "tls_info"})); info["tls"] != false {
+		t.Fatalf("tls_info over plain TCP = %v, want tls false", info)
+	}
+}
+
+func TestIdleCloseSendsReasonCode(t *testing.T) {
+	s := startServer(t, Config{PostHandshakeIdleTimeout: 50 * time.Millisecond})
+	idle := dialServer(t, s)
+
+	notice := idle.read()
+	if p := payload(notice); notice["type"] != "close" || p["reason"] != "idle_timeout" || p["message"] == "" {
+		t.Fatalf("close notice = %v, want type close with reason idle_timeout and a message", notice)
+	}
+	if lines := idle.expectClosed(time.Second); len(lines) != 0 {
+		t.Fatalf("lines after the close notice: %q", lines)
+	}
+}
+
+func TestCloseNoticeDoesNotWaitForStuckClient(t *testing.T) {
+	l := newPipeListener()
+	s := newTestServer(t, Config{Listener: l, PostHandshakeIdleTimeout: 20 * time.Millisecond})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client never reads, so over a pipe the notice cannot be written
+	waitFor(t, time.Second, "the connection to register", func() bool { return s.activeConnections() == 1 })
+	start := time.Now()
+	waitFor(t, time.Second, "the stuck connection to close", func() bool { return s.activeConnections() == 0 })
+	if took := time.Since(start); took > closeWriteTimeout+500*time.Millisecond {
+		t.Fatalf("closing a stuck client took %v, want about the %v notice deadline", took, closeWriteTimeout)
+	}
+}
+
+func TestReplayOnRecoveryReprocessesInOrder(t *testing.T) {
+	s := newTestServer(t, Config{BreakerThreshold: 2, BreakerCooldown: 100 * time.Millisecond, ReplayOnRecovery: true})
+	var failing atomic.Bool
+	var mu sync.Mutex
+	var handled []string
+	s.Handle("work", func(ctx context.Context, msg Message) (Message, error) {
+		if failing.Load() {
+			return Message{}, errors.New("backend down")
+		}
+		mu.Lock()
+		handled = append(handled, msg.ID)
+		mu.Unlock()
+		return msg, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(s)
+	client := dialServer(t, s)
+
+	failing.Store(true)
+	for _, id := range []string{"f1", "f2"} {
+		if resp := client.request(map[string]interface{}{"type": "work", "id": id}); errorReason(resp) != "handler_error" {
+			t.Fatalf("failing call %s answered with %v", id, resp)
+		}
+	}
+	for _, id := range []string{"b1", "b2", "b3"} {
+		if resp := client.request(map[string]interface{}{"type": "work", "id": id}); errorReason(resp) != "circuit_open" {
+			t.Fatalf("call %s with the breaker open answered with %v, want circuit_open", id, resp)
+		}
+	}
+
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond) // Past the cooldown
+	client.send(map[string]interface{}{"type": "echo", "id": "next"})
+	for _, want := range []string{"b1", "b2", "b3", "next"} {
+		if resp := client.read(); resp["id"] != want || resp["type"] == "error" {
+			t.Fatalf("read %v, want the response to %s", resp, want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"b1", "b2", "b3"}; !reflect.DeepEqual(handled, want) {
+		t.Fatalf("handler reprocessed %v, want %v", handled, want)
+	}
+}
+
+func TestInvalidUTF8IsSanitizedInResponses(t *testing.T) {
+	tests := []struct {
+		mode         string
+		text, blob   string
+		base64Fields interface{}
+	}{
+		{"", "a\uFFFD\uFFFDb", "\x01\x02\uFFFD", nil}, // encoding/json: one U+FFFD per byte
+		{"replace", "a\uFFFDb", "\x01\x02\uFFFD", nil},
+		{"base64", "Yf/+Yg==", "AQL/", []interface{}{"nested.blob", "text"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("mode=%q", tt.mode), func(t *testing.T) {
+			s := newTestServer(t, Config{InvalidUTF8: tt.mode})
+			s.Handle("binary", func(ctx context.Context, msg Message) (Message, error) {
+				msg.Payload = map[string]interface{}{
+					"text":   "a\xff\xfeb",
+					"nested": map[string]interface{}{"blob": "\x01\x02\xff", "ok": "fine"},
+				}
+				return msg, nil
+			})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer stopServer(s)
+			client := dialServer(t, s)
+
+			p := payload(client.request(map[string]interface{}{"type": "binary", "id": "b1"}))
+			nested, _ := p["nested"].(map[string]interface{})
+			if p["text"] != tt.text || nested["blob"] != tt.blob || nested["ok"] != "fine" || !reflect.DeepEqual(p["base64_fields"], tt.base64Fields) {
+				t.Fatalf("payload %q, want text %q, blob %q, base64_fields %v", p, tt.text, tt.blob, tt.base64Fields)
+			}
+
+			// Raw invalid bytes from the client are echoed without killing the connection
+			client.sendLine("{\"type\":\"echo\",\"id\":\"raw\",\"payload\":{\"s\":\"x\xffy\"}}")
+			if resp := client.read(); resp["id"] != "raw" || !utf8.ValidString(fmt.Sprint(payload(resp)["s"])) {
+				t.Fatalf("echo of invalid UTF-8 answered with %v", resp)
+			}
+		})
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	s := NewServer(Config{})
+	logs := captureLog(s)
+	if got := s.LogLevel(); got != "info" {
+		t.Fatalf("initial level %q, want info", got)
+	}
+	if err := s.SetLogLevel("debug"); err != nil || s.LogLevel() != "debug" {
+		t.Fatalf("SetLogLevel(debug) = %v, level %q", err, s.LogLevel())
+	}
+	if err := s.SetLogLevel("verbose"); err == nil || s.LogLevel() != "debug" {
+		t.Fatalf("SetLogLevel(verbose) = %v, level %q; want an error and no change", err, s.LogLevel())
+	}
+	s.SetLogLevel("debug") // Unchanged, so not logged again
+	if err := s.SetLogLevel(""); err != nil || s.LogLevel() != "info" {
+		t.Fatalf("SetLogLevel(\"\") = %v, level %q; want info", err, s.LogLevel())
+	}
+	if got, want := logs.String(), "Log level set to debug\nLog level set to info\n"; got != want {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+}
+
+// fakeComponent records its Start and Shutdown calls in a shared log
+type fakeComponent struct {
+	name     string
+	calls    *[]string
+	startErr error
+}
+
+func (c fakeComponent) Start() error {
+	*c.calls = append(*c.calls, "start "+c.name)
+	return c.startErr
+}
+
+func (c fakeComponent) Shutdown(context.Context) error {
+	*c.calls = append(*c.calls, "shutdown "+c.name)
+	return nil
+}
+
+func TestComponentsStartAndShutDownInOrder(t *testing.T) {
+	badLog := filepath.Join(t.TempDir(), "missing", "events.log")
+	tests := []struct {
+		name      string
+		config    Config
+		secondErr error
+		wantStart bool
+		want      []string
+	}{
+		{"started and stopped", Config{}, nil, true, []string{"start a", "start b", "shutdown b", "shutdown a"}},
+		{"second fails to start", Config{}, errors.New("boom"), false, []string{"start a", "start b", "shutdown a"}},
+		{"event log fails to open", Config{EventLogFile: badLog}, nil, false, []string{"start a", "start b", "shutdown b", "shutdown a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			s := newTestServer(t, tt.config)
+			s.AddComponent("a", fakeComponent{name: "a", calls: &calls})
+			s.AddComponent("b", fakeComponent{name: "b", calls: &calls, startErr: tt.secondErr})
+			err := s.Start()
+			if (err == nil) != tt.wantStart {
+				t.Fatalf("Start() = %v, want started %v", err, tt.wantStart)
+			}
+			if err == nil {
+				stopServer(s)
+			}
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Fatalf("calls %q, want %q", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthPrecedenceBetweenCertAndToken(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("bob")
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		config     Config
+		withCert   bool
+		needsToken bool   // The first message is rejected until the token is sent
+		identity   string // Of the connection once authenticated
+	}{
+		{"cert only", Config{TLSClientCAFile: ca.certFile}, true, false, "bob"},
+		{"token only", Config{Authenticate: acceptToken}, false, true, "alice"},
+		{"both, cert presented", Config{TLSClientCAFile: ca.certFile, Authenticate: acceptToken}, true, false, "bob"},
+		{"both, no cert", Config{TLSClientCAFile: ca.certFile, Authenticate: acceptToken}, false, true, "alice"},
+		{"both, token precedence", Config{TLSClientCAFile: ca.certFile, Authenticate: acceptToken, AuthPrecedence: "token"}, true, true, "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTLSServer(t, ca, tt.config)
+			config := &tls.Config{ServerName: "localhost"}
+			if tt.withCert {
+				config.Certificates = []tls.Certificate{clientCert}
+			}
+			client, err := dialTLS(t, s, ca, config)
+			if err != nil {
+				t.Fatalf("TLS dial: %v", err)
+			}
+
+			resp := client.request(map[string]interface{}{"type": "echo", "id": "e1"})
+			if got := errorReason(resp) == "unauthenticated"; got != tt.needsToken {
+				t.Fatalf("echo before auth = %v, want rejected %v", resp, tt.needsToken)
+			}
+			if tt.needsToken {
+				if resp := client.request(map[string]interface{}{"type": "auth", "id": "a1", "payload": map[string]interface{}{"token": "secret"}}); payload(resp)["identity"] != tt.identity {
+					t.Fatalf("auth = %v, want identity %q", resp, tt.identity)
+				}
+			}
+			if conns := s.Connections(); len(conns) != 1 || conns[0].Identity != tt.identity {
+				t.Fatalf("Connections = %+v, want one with identity %q", conns, tt.identity)
+			}
+		})
+	}
+}
+
+func TestShutdownBacklogCountsDeliveredAndDropped(t *testing.T) {
+	const queued = 20
+	tests := []struct {
+		name        string
+		drain       bool
+		maxBuffered int64 // With a late broadcast big enough to shed the queue
+	}{
+		{"DrainBroadcasts", true, 0},
+		{"without DrainBroadcasts", false, 0},
+		{"shed by MaxBufferedBytes", true, 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// At 50 a second only a few of the queue fit in the 100ms drain
+			s := newTestServer(t, Config{BroadcastRate: 50, BroadcastBurst: 1, OutboundQueueSize: 64, DrainBroadcasts: tt.drain, MaxBufferedBytes: tt.maxBuffered, ShutdownDrainTimeout: 100 * time.Millisecond})
+			logs := captureLog(s)
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer stopServer(s)
+			client, connID := dialWithID(t, s)
+			cc, _ := s.lookupConnection(connID)
+			go io.Copy(io.Discard, client.conn)
+			for i := 0; i < queued; i++ {
+				s.Broadcast(Message{Type: "tick", ID: fmt.Sprint(i)})
+			}
+
+			done := make(chan struct{})
+			go func() {
+				stopServer(s)
+				close(done)
+			}()
+			if tt.maxBuffered > 0 {
+				// A broadcast that picked its targets before the drain began
+				waitFor(t, time.Second, "the drain to begin", func() bool { return s.ShutdownBacklog().Queued > 0 })
+				s.enqueue(cc, outboundMessage{msg: Message{Type: "tick", ID: "late"}, size: tt.maxBuffered})
+				if s.metrics.broadcastsShed.Load() == 0 {
+					t.Fatal("the late broadcast shed nothing")
+				}
+			}
+			<-done
+
+			got := s.ShutdownBacklog()
+			// The burst token may have sent the first before the drain began
+			if got.Queued < queued-1 || got.Delivered+got.Dropped != got.Queued || got.Dropped == 0 {
+				t.Fatalf("ShutdownBacklog = %+v, want about %d queued, all delivered or dropped, some dropped", got, queued)
+			}
+			if tt.drain && tt.maxBuffered == 0 && got.Delivered < 2 {
+				t.Fatalf("ShutdownBacklog = %+v, want the drain to deliver some", got)
+			}
+			want := fmt.Sprintf("Shutdown backlog: %d broadcasts queued, %d delivered, %d dropped", got.Queued, got.Delivered, got.Dropped)
+			if !strings.Contains(logs.String(), want) {
+				t.Fatalf("log lacks %q:\n%s", want, logs)
+			}
+		})
+	}
+}
+
+func TestAdminTraceReturnsRecentMessages(t *testing.T) {
+	for _, withPayloads := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TracePayloads=%v", withPayloads), func(t *testing.T) {
+			s := newTestServer(t, Config{EnableAdmin: true, TraceBufferSize: 3, TracePayloads: withPayloads})
+			s.Handle("fail", func(ctx context.Context, msg Message) (Message, error) {
+				return Message{}, errors.New("nope")
+			})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer stopServer(s)
+			traced, connID := dialWithID(t, s) // Its echo "hello" is pushed out of the ring below
+			for _, id := range []string{"e1", "e2"} {
+				traced.request(map[string]interface{}{"type": "echo", "id": id, "payload": map[string]interface{}{"n": id}})
+			}
+			traced.request(map[string]interface{}{"type": "fail", "id": "f1"})
+
+			admin := dialServer(t, s)
+			resp := admin.request(map[string]interface{}{"type": "trace", "id": "t1", "payload": map[string]interface{}{"conn_id": connID}})
+			entries, _ := payload(resp)["entries"].([]interface{})
+			if len(entries) != 3 {
+				t.Fatalf("trace = %v, want 3 entries", resp)
+			}
+			var got []string
+			for _, e := range entries {
+				entry := e.(map[string]interface{})
+				reason, _ := entry["error_reason"].(string)
+				got = append(got, strings.TrimSpace(fmt.Sprintf("%v %v -> %v %s", entry["type"], entry["id"], entry["response_type"], reason)))
+				if _, ok := entry["payload"]; ok != (withPayloads && entry["type"] == "echo") {
+					t.Fatalf("entry %v, want a payload only with TracePayloads", entry)
+				}
+			}
+			if want := []string{"echo e1 -> echo", "echo e2 -> echo", "fail f1 -> error handler_error"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("trace entries %q, want %q oldest first", got, want)
+			}
+
+			unknown := admin.request(map[string]interface{}{"type": "trace", "id": "t2", "payload": map[string]interface{}{"conn_id": "nope"}})
+			if errorReason(unknown) != "bad_request" {
+				t.Fatalf("trace of an unknown connection = %v, want bad_request", unknown)
+			}
+		})
+	}
+}
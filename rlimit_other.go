@@ -0,0 +1,24 @@
+// rlimit_other.go
+
+//go:build !unix
+
+package main
+
+// fdFractionLimit ignores fraction, since this platform has no open file
+// limit to take it of, and returns absolute or defaultMaxConnections;
+// checkFDLimit logs that it was ignored
+func fdFractionLimit(absolute int, fraction float64) int {
+	if absolute > 0 {
+		return absolute
+	}
+	return defaultMaxConnections
+}
+
+// checkFDLimit has no open file limit to check MaxConnections against on
+// this platform, so it only warns that MaxConnFDFraction had no effect
+func (s *Server) checkFDLimit() {
+	if s.config.MaxConnFDFraction > 0 {
+		s.logger.Printf("Warning: MaxConnFDFraction is not supported on this platform and was ignored; MaxConnections is %d",
+			s.config.MaxConnections)
+	}
+}
@@ -0,0 +1,44 @@
+// rlimit_unix.go
+
+//go:build unix
+
+package main
+
+import "syscall"
+
+// fdFractionLimit returns fraction of the open file soft limit, or
+// absolute when that is set and lower. If the limit cannot be read it
+// returns absolute, or defaultMaxConnections when absolute is unset.
+func fdFractionLimit(absolute int, fraction float64) int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		if absolute > 0 {
+			return absolute
+		}
+		return defaultMaxConnections
+	}
+	computed := max(int(float64(uint64(limit.Cur))*fraction), 1)
+	if absolute > 0 && absolute < computed {
+		return absolute
+	}
+	return computed
+}
+
+// checkFDLimit warns when MaxConnections exceeds the open file soft limit:
+// every connection needs a descriptor, so accepts would start failing
+// before the configured limit is reached
+func (s *Server) checkFDLimit() {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		s.logger.Printf("Could not read the open file limit: %v", err)
+		return
+	}
+	if s.config.MaxConnFDFraction > 0 {
+		s.logger.Printf("MaxConnections is %d with MaxConnFDFraction %v of the open file limit %d",
+			s.config.MaxConnections, s.config.MaxConnFDFraction, limit.Cur)
+	}
+	if uint64(s.config.MaxConnections) > uint64(limit.Cur) {
+		s.logger.Printf("Warning: MaxConnections is %d but the open file limit is %d (hard limit %d); "+
+			"raise it with 'ulimit -n' or lower -max-connections", s.config.MaxConnections, limit.Cur, limit.Max)
+	}
+}
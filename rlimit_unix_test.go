@@ -0,0 +1,63 @@
+// rlimit_unix_test.go
+
+//go:build unix
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCheckFDLimitWarnsAboveSoftLimit(t *testing.T) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	soft := uint64(limit.Cur)
+	if soft >= 1<<30 {
+		t.Skipf("open file limit %d is effectively unlimited", soft)
+	}
+
+	s := newTestServer(t, Config{MaxConnections: int(soft) + 1})
+	logs := captureLog(s)
+	s.checkFDLimit()
+	if !strings.Contains(logs.String(), "Warning: MaxConnections is") {
+		t.Fatalf("no warning for MaxConnections above the limit %d: %q", soft, logs.String())
+	}
+
+	s = newTestServer(t, Config{MaxConnections: int(soft)})
+	logs = captureLog(s)
+	s.checkFDLimit()
+	if strings.Contains(logs.String(), "Warning") {
+		t.Fatalf("warned for MaxConnections within the limit: %q", logs.String())
+	}
+}
+
+func TestMaxConnFDFractionFollowsSoftLimit(t *testing.T) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	soft := uint64(limit.Cur)
+	if soft >= 1<<30 {
+		t.Skipf("open file limit %d is effectively unlimited", soft)
+	}
+	half := max(int(soft/2), 1)
+
+	tests := []struct {
+		absolute int
+		want     int
+	}{
+		{0, half},            // Only the fraction
+		{half + 10, half},    // The fraction is lower
+		{half - 1, half - 1}, // The absolute limit is lower
+	}
+	for _, tt := range tests {
+		s := NewServer(Config{MaxConnections: tt.absolute, MaxConnFDFraction: 0.5}.WithDefaults())
+		if got := s.config.MaxConnections; got != tt.want {
+			t.Errorf("MaxConnections %d with half of the limit %d: got %d, want %d", tt.absolute, soft, got, tt.want)
+		}
+	}
+}
@@ -10,7 +10,7 @@ fi
 
 # Build the server
 echo "Building server..."
-go build -o server main.go
+go build -o server .
 
 # Make the run script executable
 chmod +x run.sh
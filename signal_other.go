@@ -0,0 +1,15 @@
+// signal_other.go
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyDumpSignal does nothing: there is no SIGUSR2 on this platform, so
+// the state dump is only available through Server.DumpState
+func notifyDumpSignal(c chan<- os.Signal) {}
+
+// notifyLogLevelSignal does nothing: there is no SIGUSR1 on this platform,
+// so the log level is set with -log-level or Server.SetLogLevel
+func notifyLogLevelSignal(c chan<- os.Signal) {}
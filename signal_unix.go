@@ -0,0 +1,21 @@
+// signal_unix.go
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumpSignal relays SIGUSR2, which requests a state dump, to c
+func notifyDumpSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// notifyLogLevelSignal relays SIGUSR1, which toggles debug logging, to c
+func notifyLogLevelSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}